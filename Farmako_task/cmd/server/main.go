@@ -1,129 +1,436 @@
-package main
-
-import (
-	"context"
-	"log"
-	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
-	"time"
-
-	"coupon-system/internal/api"
-	"coupon-system/internal/models"
-	"coupon-system/internal/repository"
-	"coupon-system/internal/service"
-
-	"github.com/gin-gonic/gin"
-	"github.com/redis/go-redis/v9"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
-)
-
-func main() {
-	// Initialize database
-	db, err := initDB()
-	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
-	}
-
-	// Initialize Redis
-	redisClient := initRedis()
-
-	// Initialize repositories
-	couponRepo := repository.NewCouponRepository(db)
-
-	// Initialize services
-	couponService := service.NewCouponService(couponRepo)
-
-	// Initialize handlers
-	handler := api.NewHandler(couponService)
-
-	// Initialize router
-	router := setupRouter(handler)
-
-	// Create server
-	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: router,
-	}
-
-	// Graceful shutdown
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
-		}
-	}()
-
-	// Wait for interrupt signal to gracefully shutdown the server
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutting down server...")
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
-	}
-
-	log.Println("Server exiting")
-}
-
-func initDB() (*gorm.DB, error) {
-	dsn := os.Getenv("DATABASE_URL")
-	if dsn == "" {
-		dsn = "host=localhost user=postgres password=postgres dbname=coupon_system port=5432 sslmode=disable"
-	}
-
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
-	if err != nil {
-		return nil, err
-	}
-
-	// Auto migrate the schema
-	err = db.AutoMigrate(
-		&models.Coupon{},
-		&models.Medicine{},
-		&models.Category{},
-		&models.CouponUsage{},
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	return db, nil
-}
-
-func initRedis() *redis.Client {
-	redisAddr := os.Getenv("REDIS_URL")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
-	}
-
-	return redis.NewClient(&redis.Options{
-		Addr: redisAddr,
-	})
-}
-
-func setupRouter(handler *api.Handler) *gin.Engine {
-	router := gin.Default()
-
-	// Middleware
-	router.Use(gin.Recovery())
-	router.Use(gin.Logger())
-
-	// Routes
-	admin := router.Group("/admin")
-	{
-		admin.POST("/coupons", handler.CreateCoupon)
-	}
-
-	coupons := router.Group("/coupons")
-	{
-		coupons.GET("/applicable", handler.GetApplicableCoupons)
-		coupons.POST("/validate", handler.ValidateCoupon)
-	}
-
-	return router
-}
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"coupon-system/internal/api"
+	"coupon-system/internal/auth"
+	"coupon-system/internal/cache"
+	"coupon-system/internal/config"
+	"coupon-system/internal/featureflag"
+	"coupon-system/internal/idempotency"
+	"coupon-system/internal/jobs"
+	"coupon-system/internal/metrics"
+	"coupon-system/internal/models"
+	"coupon-system/internal/repository"
+	"coupon-system/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+//go:generate swag init -d ../.. -g cmd/server/main.go -o ../../docs
+
+// @title Coupon System API
+// @version 1.0
+// @description Coupon creation, validation and redemption for the medicine ordering platform.
+// @BasePath /
+func main() {
+	// Initialize logging
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("failed to load configuration", "error", err)
+		os.Exit(1)
+	}
+
+	// Initialize metrics
+	metrics.Register(prometheus.DefaultRegisterer)
+
+	// Initialize database
+	db, err := initDB(cfg)
+	if err != nil {
+		slog.Error("failed to connect to database", "error", err)
+		os.Exit(1)
+	}
+
+	// Initialize Redis. Without it the cache, idempotency keys and Redis
+	// feature flags are off and everything is served from Postgres.
+	var redisClient *redis.Client
+	if cfg.CacheEnabled {
+		redisClient = initRedis(cfg)
+	} else {
+		slog.Info("redis disabled; caching and idempotency keys are off")
+	}
+
+	// Initialize repositories
+	couponRepo := repository.NewCouponRepository(db)
+
+	// Initialize services
+	couponCache := cache.NewCouponCache(redisClient)
+	couponCache.SetApplicableTTL(cfg.ApplicableCacheTTL)
+	couponCache.SetPreviewTTL(cfg.PreviewCacheTTL)
+	couponService := service.NewCouponService(couponRepo, couponCache)
+	couponService.SetCodeCharset(cfg.CodeCharset)
+	couponService.SetChecksumCodes(cfg.ChecksumCodes)
+	couponService.SetAllowStacking(cfg.AllowStacking)
+	couponService.SetRoundingMode(cfg.DiscountRounding)
+	couponService.SetDiscountSanity(cfg.StrictDiscountValues, cfg.MaxFixedDiscount)
+	couponService.SetOrderDiscountCap(cfg.MaxOrderDiscountPct)
+	couponService.SetMaxScanCartItems(cfg.MaxScanCartItems)
+
+	// Initialize authentication
+	tokens, err := auth.NewTokens([]byte(cfg.JWTSecret))
+	if err != nil {
+		slog.Error("failed to initialize authentication", "error", err)
+		os.Exit(1)
+	}
+
+	// Initialize handlers
+	handler := api.NewHandler(couponService)
+	handler.SetMaxCartItems(cfg.MaxCartItems)
+
+	// Initialize feature flags
+	flags := featureflag.NewStore(redisClient)
+
+	// Initialize idempotency store
+	idempotencyStore := idempotency.NewStore(redisClient)
+
+	// Initialize router
+	router := setupRouter(handler, tokens, flags, idempotencyStore, cfg.RequestTimeout, int64(cfg.MaxRequestBytes))
+
+	// Create server
+	srv := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           router,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+
+	// Start background jobs
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	var jobsWG sync.WaitGroup
+	jobsWG.Add(2)
+	go func() {
+		defer jobsWG.Done()
+		jobs.ExpireCoupons(jobsCtx, couponService, cfg.ExpiryCleanupInterval)
+	}()
+	go func() {
+		defer jobsWG.Done()
+		jobs.RefreshActiveCoupons(jobsCtx, couponService, cfg.ActiveCouponsInterval)
+	}()
+
+	// Graceful shutdown
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("failed to start server", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Wait for interrupt signal to gracefully shutdown the server
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	slog.Info("shutting down server")
+
+	stopJobs()
+	jobsWG.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownErr := srv.Shutdown(ctx)
+	if shutdownErr != nil {
+		slog.Error("server forced to shutdown", "error", shutdownErr)
+	}
+
+	// Close the backing stores only once no request can still be using them
+	closeErr := closeStores(db, redisClient)
+	if shutdownErr != nil || closeErr != nil {
+		os.Exit(1)
+	}
+
+	slog.Info("server exiting")
+}
+
+// closeStores closes the database pool and the Redis client, if any, logging
+// the outcome of each, and returns the first error.
+func closeStores(db *gorm.DB, redisClient *redis.Client) error {
+	var firstErr error
+
+	sqlDB, err := db.DB()
+	if err == nil {
+		err = sqlDB.Close()
+	}
+	if err != nil {
+		slog.Error("failed to close database", "error", err)
+		firstErr = err
+	} else {
+		slog.Info("database closed")
+	}
+
+	if redisClient == nil {
+		return firstErr
+	}
+	if err := redisClient.Close(); err != nil {
+		slog.Error("failed to close redis", "error", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	} else {
+		slog.Info("redis closed")
+	}
+
+	return firstErr
+}
+
+func initDB(cfg *config.Config) (*gorm.DB, error) {
+	db, err := gorm.Open(postgres.Open(cfg.DatabaseURL), &gorm.Config{
+		TranslateError: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Configure the connection pool
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
+	if err := migrateMoneyColumns(db); err != nil {
+		return nil, err
+	}
+	if err := normalizeCouponCodes(db); err != nil {
+		return nil, err
+	}
+	if err := renameCustomerSegments(db); err != nil {
+		return nil, err
+	}
+
+	// Auto migrate the schema
+	err = db.AutoMigrate(
+		&models.Coupon{},
+		&models.Medicine{},
+		&models.Category{},
+		&models.CouponUsage{},
+		&models.AuditLog{},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureCaseInsensitiveCodeIndex(db); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// moneyColumns lists the amount columns that were stored as double precision
+// before amounts moved to decimal.
+var moneyColumns = map[string][]string{
+	"coupons":       {"discount_value", "min_discount_amount", "max_discount_amount", "min_order_value"},
+	"medicines":     {"price"},
+	"coupon_usages": {"discount_applied", "order_total"},
+}
+
+// migrateMoneyColumns converts any remaining double precision amount columns
+// to numeric(12,2), rounding existing values to minor units. Columns that are
+// already numeric, or tables that do not exist yet, are left to AutoMigrate.
+func migrateMoneyColumns(db *gorm.DB) error {
+	for table, columns := range moneyColumns {
+		for _, column := range columns {
+			var dataType string
+			err := db.Raw(`SELECT data_type FROM information_schema.columns
+				WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?`,
+				table, column).Scan(&dataType).Error
+			if err != nil {
+				return err
+			}
+			if dataType != "double precision" {
+				continue
+			}
+
+			err = db.Exec("ALTER TABLE ? ALTER COLUMN ? TYPE numeric(12,2) USING round(?::numeric, 2)",
+				clause.Table{Name: table}, clause.Column{Name: column}, clause.Column{Name: column}).Error
+			if err != nil {
+				return err
+			}
+			slog.Info("migrated money column to numeric", "table", table, "column", column)
+		}
+	}
+	return nil
+}
+
+// normalizeCouponCodes rewrites coupon codes stored before codes were
+// normalized (see models.NormalizeCode). A code whose normalized form is
+// already taken by another coupon is left alone and logged, since renaming it
+// would break the unique index; such coupons need manual attention.
+func normalizeCouponCodes(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&models.Coupon{}) {
+		return nil
+	}
+
+	res := db.Exec(`UPDATE coupons c SET code = upper(trim(c.code))
+		WHERE c.code <> upper(trim(c.code))
+		AND NOT EXISTS (
+			SELECT 1 FROM coupons o
+			WHERE o.id <> c.id AND upper(trim(o.code)) = upper(trim(c.code))
+		)`)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		slog.Info("normalized coupon codes", "count", res.RowsAffected)
+	}
+
+	var conflicts []string
+	err := db.Raw("SELECT code FROM coupons WHERE code <> upper(trim(code))").Scan(&conflicts).Error
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		slog.Warn("coupon codes could not be normalized because the normalized code is taken", "codes", conflicts)
+	}
+	return nil
+}
+
+// renameCustomerSegments rewrites the segments stored before they were
+// renamed to what they measure: "new" and "returning" customers were only ever
+// counted by their coupon orders.
+func renameCustomerSegments(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&models.Coupon{}) {
+		return nil
+	}
+
+	res := db.Exec(`UPDATE coupons SET customer_segment = CASE customer_segment
+		WHEN 'new' THEN ? ELSE ? END
+		WHERE customer_segment IN ('new', 'returning')`,
+		models.FirstCouponCustomers, models.RepeatCouponCustomers)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		slog.Info("renamed coupon customer segments", "count", res.RowsAffected)
+	}
+	return nil
+}
+
+// ensureCaseInsensitiveCodeIndex adds a unique index on lower(code), so no two
+// coupons, soft-deleted ones included, have codes that differ only in case.
+// Create and Update then report such a collision as a duplicate code. If
+// legacy codes already collide the index cannot be built; they are logged and
+// the index is retried on the next start once they have been renamed.
+func ensureCaseInsensitiveCodeIndex(db *gorm.DB) error {
+	var collisions []string
+	err := db.Raw(`SELECT lower(code) FROM coupons
+		GROUP BY lower(code) HAVING count(*) > 1`).Scan(&collisions).Error
+	if err != nil {
+		return err
+	}
+	if len(collisions) > 0 {
+		slog.Warn("coupon codes differ only in case; not enforcing case-insensitive uniqueness", "codes", collisions)
+		return nil
+	}
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_coupons_code_lower ON coupons (lower(code))").Error
+}
+
+func initRedis(cfg *config.Config) *redis.Client {
+	// Redis only backs caches and other fail-open features, so keep its
+	// timeouts short: an outage should degrade requests, not stall them.
+	return redis.NewClient(&redis.Options{
+		Addr:         cfg.RedisAddr,
+		DialTimeout:  cfg.RedisDialTimeout,
+		ReadTimeout:  cfg.RedisTimeout,
+		WriteTimeout: cfg.RedisTimeout,
+	})
+}
+
+// registerSwagger serves the API reference under /swagger. It is only set in
+// builds with the swagger tag (see swagger.go), since those need the docs
+// package generated by swag first.
+var registerSwagger func(router *gin.Engine)
+
+func setupRouter(handler *api.Handler, tokens *auth.Tokens, flags *featureflag.Store, idempotencyStore *idempotency.Store, requestTimeout time.Duration, maxBodyBytes int64) *gin.Engine {
+	router := gin.New()
+
+	// Middleware
+	router.Use(gin.Recovery())
+	router.Use(api.RequestID())
+	router.Use(api.RequestLogger())
+	router.Use(api.Authenticate(tokens))
+
+	// Routes
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	if registerSwagger != nil {
+		registerSwagger(router)
+	}
+
+	// The usage export streams arbitrarily large ranges, so it is exempt from
+	// the request timeout applied to every other API route.
+	router.GET("/admin/coupons/usage/export", api.AdminOnly(), handler.ExportCouponUsage)
+
+	timed := router.Group("/", api.RequestTimeout(requestTimeout), api.LimitBody(maxBodyBytes))
+
+	// AdminOnly depends on the user and role set by Authenticate, so the
+	// admin routes must stay behind it.
+	admin := timed.Group("/admin", api.AdminOnly(), api.AuditActor())
+	{
+		admin.POST("/coupons", handler.CreateCoupon)
+		admin.PUT("/coupons/:id", handler.UpdateCoupon)
+		admin.POST("/coupons/generate", handler.GenerateCoupons)
+		admin.POST("/coupons/import", handler.ImportCoupons)
+		admin.POST("/coupons/:id/clone", handler.CloneCoupon)
+		admin.POST("/coupons/:id/medicines", handler.UpdateCouponMedicines)
+		admin.POST("/coupons/:id/categories", handler.UpdateCouponCategories)
+		admin.POST("/coupons/:id/reconcile", handler.ReconcileCouponUsage)
+		admin.POST("/coupons/deactivate", handler.DeactivateCoupons)
+		admin.GET("/coupons/search", handler.SearchCoupons)
+		admin.GET("/coupons/usage", handler.ListCouponUsage)
+		admin.GET("/coupons/report", handler.GetCouponReport)
+		admin.GET("/coupons/code/:code", handler.GetCouponByCode)
+		admin.POST("/coupons/category-matrix", handler.GetCategoryMatrix)
+		admin.GET("/coupons/:id/stats", handler.GetCouponStats)
+		admin.GET("/coupons/:id/audit", handler.GetCouponAuditLog)
+		admin.GET("/reports/liability", handler.GetLiabilityReport)
+		admin.GET("/users/:id/coupon-usage", handler.GetUserCouponUsage)
+		admin.POST("/usage/purge", handler.PurgeUsage)
+	}
+
+	coupons := timed.Group("/coupons")
+	{
+		coupons.POST("/applicable",
+			api.FeatureGate(flags, featureflag.ApplicableCoupons, 30*time.Second),
+			handler.GetApplicableCoupons,
+		)
+		coupons.POST("/best",
+			api.FeatureGate(flags, featureflag.ApplicableCoupons, 30*time.Second),
+			handler.GetBestCoupon,
+		)
+		coupons.POST("/validate",
+			api.ObserveLatency(metrics.ValidateLatency),
+			handler.ValidateCoupon,
+		)
+		coupons.POST("/revalidate", handler.RevalidateCoupons)
+		coupons.POST("/preview", handler.PreviewCoupon)
+		coupons.GET("/for-medicine/:id", handler.ListCouponsForMedicine)
+		coupons.GET("/:code/terms", handler.GetCouponTerms)
+		coupons.GET("/:code/qr", handler.GetCouponQR)
+		coupons.POST("/redeem",
+			api.Idempotency(idempotencyStore),
+			handler.RedeemCoupon,
+		)
+	}
+
+	return router
+}
@@ -0,0 +1,17 @@
+//go:build swagger
+
+package main
+
+import (
+	_ "coupon-system/docs"
+
+	"github.com/gin-gonic/gin"
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
+)
+
+func init() {
+	registerSwagger = func(router *gin.Engine) {
+		router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	}
+}
@@ -0,0 +1,43 @@
+// Command token mints a bearer token for local development and testing,
+// signed with the JWT_SECRET the server uses.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"coupon-system/internal/auth"
+
+	"github.com/google/uuid"
+)
+
+func main() {
+	userID := flag.String("user", "", "user ID to issue the token to (default: a random one)")
+	role := flag.String("role", "", `role claim, e.g. "admin"`)
+	ttl := flag.Duration("ttl", 24*time.Hour, "how long the token stays valid")
+	flag.Parse()
+
+	id := uuid.New()
+	if *userID != "" {
+		parsed, err := uuid.Parse(*userID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid -user:", err)
+			os.Exit(2)
+		}
+		id = parsed
+	}
+
+	tokens, err := auth.NewTokens([]byte(os.Getenv("JWT_SECRET")))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "JWT_SECRET:", err)
+		os.Exit(1)
+	}
+	token, err := tokens.Issue(auth.Claims{UserID: id, Role: *role, ExpiresAt: time.Now().Add(*ttl)})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(token)
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+func init() {
+	// Report fields by their JSON names so FieldError.Field matches what the
+	// client sent
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(jsonFieldName)
+	}
+}
+
+// embeddedName stands in the validation namespace for an embedded struct
+// such as CouponTemplate, whose fields JSON promotes into the parent object.
+const embeddedName = "~"
+
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	switch {
+	case name == "-":
+		return ""
+	case name == "" && field.Anonymous:
+		return embeddedName
+	case name == "":
+		return field.Name
+	}
+	return name
+}
+
+// FieldError describes one request field that failed a binding rule.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// bindingError turns a ShouldBindJSON error into an ErrorResponse. Validation
+// failures list every failing field, not just the first; other errors, such
+// as malformed JSON, are reported as-is.
+func bindingError(err error) ErrorResponse {
+	var invalid validator.ValidationErrors
+	if !errors.As(err, &invalid) {
+		return ErrorResponse{Error: err.Error()}
+	}
+
+	fields := make([]FieldError, len(invalid))
+	for i, fe := range invalid {
+		// The namespace starts with the request type name; drop it and any
+		// embedded structs to get a path such as valid_time_window.end_time
+		_, path, _ := strings.Cut(fe.Namespace(), ".")
+		path = strings.ReplaceAll(path, embeddedName+".", "")
+		fields[i] = FieldError{
+			Field:   path,
+			Rule:    fe.Tag(),
+			Message: fieldMessage(fe),
+		}
+	}
+	return ErrorResponse{Error: "invalid request", Fields: fields}
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "oneof":
+		return "must be one of: " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	case "min":
+		return "must be at least " + fe.Param() + lengthUnit(fe)
+	case "max":
+		return "must be at most " + fe.Param() + lengthUnit(fe)
+	case "gt":
+		return "must be greater than " + fe.Param()
+	case "gte":
+		return "must be at least " + fe.Param()
+	case "lte":
+		return "must be at most " + fe.Param()
+	case "gtfield":
+		return "must be after " + fe.Param()
+	}
+	return fmt.Sprintf("failed the %q rule", fe.Tag())
+}
+
+// lengthUnit names what min and max count for fe's kind of value: elements of
+// a list, characters of a string, or nothing for a number.
+func lengthUnit(fe validator.FieldError) string {
+	switch fe.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return " items"
+	case reflect.String:
+		return " characters"
+	}
+	return ""
+}
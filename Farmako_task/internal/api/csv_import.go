@@ -0,0 +1,160 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// cellKind says how a CSV cell is turned into the JSON value of its column.
+type cellKind int
+
+const (
+	// cellString cells are taken literally, as a JSON string.
+	cellString cellKind = iota
+	// cellList cells are "|"-separated values, as a JSON array of strings.
+	cellList
+	// cellJSON cells are JSON themselves: numbers, booleans, objects and
+	// arrays of objects.
+	cellJSON
+)
+
+// importColumns maps every CreateCouponRequest field, by JSON name, to the
+// kind of cell a coupon import carries for it.
+var importColumns = func() map[string]cellKind {
+	columns := make(map[string]cellKind)
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(CreateCouponRequest{})) {
+		if !field.Anonymous {
+			columns[jsonFieldName(field)] = cellKindOf(field.Type)
+		}
+	}
+	return columns
+}()
+
+func cellKindOf(t reflect.Type) cellKind {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t.Kind() == reflect.String,
+		t == reflect.TypeOf(time.Time{}),
+		t == reflect.TypeOf(decimal.Decimal{}),
+		t == reflect.TypeOf(uuid.UUID{}):
+		return cellString
+	case t.Kind() == reflect.Slice &&
+		(t.Elem().Kind() == reflect.String || t.Elem() == reflect.TypeOf(uuid.UUID{})):
+		return cellList
+	}
+	return cellJSON
+}
+
+// couponRow is one data row of a coupon import: the request it describes,
+// or why it could not be read.
+type couponRow struct {
+	Line    int
+	Request CreateCouponRequest
+	Err     error
+}
+
+// readCouponCSV parses a coupon import. The header row names the columns by
+// their CreateCouponRequest JSON names, in any order; every data row is
+// decoded and validated like a create request, with empty cells left unset.
+// Bad rows are returned with their error. An error is returned only when the
+// header is unusable or there are more than maxRows data rows.
+func readCouponCSV(r io.Reader, maxRows int) ([]couponRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("import file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if _, ok := importColumns[name]; !ok {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate column %q", name)
+		}
+		seen[name] = true
+		header[i] = name
+	}
+
+	var rows []couponRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if len(rows) == maxRows {
+			return nil, fmt.Errorf("import is limited to %d rows", maxRows)
+		}
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, couponRow{Line: parseErr.StartLine, Err: parseErr.Err})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		rows = append(rows, parseCouponRecord(line, header, record))
+	}
+	return rows, nil
+}
+
+func parseCouponRecord(line int, header, record []string) couponRow {
+	row := couponRow{Line: line}
+	for i, cell := range record {
+		cell = strings.TrimSpace(cell)
+		if cell == "" {
+			continue
+		}
+		if err := decodeCell(&row.Request, header[i], cell); err != nil {
+			row.Err = fmt.Errorf("column %s: invalid value %q", header[i], cell)
+			return row
+		}
+	}
+
+	if err := binding.Validator.ValidateStruct(&row.Request); err != nil {
+		row.Err = err
+	}
+	return row
+}
+
+// decodeCell sets the field of req named column from cell.
+func decodeCell(req *CreateCouponRequest, column, cell string) error {
+	var value interface{} = json.RawMessage(cell)
+	switch importColumns[column] {
+	case cellString:
+		value = cell
+	case cellList:
+		items := strings.Split(cell, "|")
+		for i := range items {
+			items[i] = strings.TrimSpace(items[i])
+		}
+		value = items
+	}
+
+	data, err := json.Marshal(map[string]interface{}{column: value})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, req)
+}
@@ -1,161 +1,1659 @@
-package api
-
-import (
-	"net/http"
-	"time"
-
-	"coupon-system/internal/models"
-	"coupon-system/internal/service"
-
-	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
-)
-
-type Handler struct {
-	couponService *service.CouponService
-}
-
-func NewHandler(couponService *service.CouponService) *Handler {
-	return &Handler{
-		couponService: couponService,
-	}
-}
-
-// @Summary Create a new coupon
-// @Description Create a new coupon with the given parameters
-// @Tags coupons
-// @Accept json
-// @Produce json
-// @Param coupon body CreateCouponRequest true "Coupon creation request"
-// @Success 201 {object} models.Coupon
-// @Failure 400 {object} ErrorResponse
-// @Router /admin/coupons [post]
-func (h *Handler) CreateCoupon(c *gin.Context) {
-	var req CreateCouponRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
-		return
-	}
-
-	input := service.CreateCouponInput{
-		Code:                 req.Code,
-		ExpiryDate:           req.ExpiryDate,
-		UsageType:            models.UsageType(req.UsageType),
-		DiscountType:         models.DiscountType(req.DiscountType),
-		DiscountValue:        req.DiscountValue,
-		MinOrderValue:        req.MinOrderValue,
-		MaxUsagePerUser:      req.MaxUsagePerUser,
-		ValidTimeWindow:      req.ValidTimeWindow,
-		TermsAndConditions:   req.TermsAndConditions,
-		ApplicableMedicines:  req.ApplicableMedicines,
-		ApplicableCategories: req.ApplicableCategories,
-	}
-
-	coupon, err := h.couponService.CreateCoupon(c.Request.Context(), input)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusCreated, coupon)
-}
-
-// @Summary Get applicable coupons
-// @Description Get all applicable coupons for the given cart items
-// @Tags coupons
-// @Accept json
-// @Produce json
-// @Param request body GetApplicableCouponsRequest true "Get applicable coupons request"
-// @Success 200 {array} models.Coupon
-// @Failure 400 {object} ErrorResponse
-// @Router /coupons/applicable [get]
-func (h *Handler) GetApplicableCoupons(c *gin.Context) {
-	var req GetApplicableCouponsRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
-		return
-	}
-
-	coupons, err := h.couponService.GetApplicableCoupons(
-		c.Request.Context(),
-		req.CartItems,
-		req.OrderTotal,
-	)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"applicable_coupons": coupons,
-	})
-}
-
-// @Summary Validate a coupon
-// @Description Validate a coupon for the given cart items
-// @Tags coupons
-// @Accept json
-// @Produce json
-// @Param request body ValidateCouponRequest true "Validate coupon request"
-// @Success 200 {object} service.ValidateCouponOutput
-// @Failure 400 {object} ErrorResponse
-// @Router /coupons/validate [post]
-func (h *Handler) ValidateCoupon(c *gin.Context) {
-	var req ValidateCouponRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
-		return
-	}
-
-	// Get user ID from context (assuming it's set by auth middleware)
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "user not authenticated"})
-		return
-	}
-
-	input := service.ValidateCouponInput{
-		Code:       req.CouponCode,
-		CartItems:  req.CartItems,
-		OrderTotal: req.OrderTotal,
-		UserID:     userID.(uuid.UUID),
-		Timestamp:  time.Now(),
-	}
-
-	result, err := h.couponService.ValidateCoupon(c.Request.Context(), input)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, result)
-}
-
-type CreateCouponRequest struct {
-	Code                 string             `json:"code" binding:"required"`
-	ExpiryDate           time.Time          `json:"expiry_date" binding:"required"`
-	UsageType            string             `json:"usage_type" binding:"required,oneof=one_time multi_use time_based"`
-	DiscountType         string             `json:"discount_type" binding:"required,oneof=percentage fixed"`
-	DiscountValue        float64            `json:"discount_value" binding:"required,gt=0"`
-	MinOrderValue        float64            `json:"min_order_value" binding:"gte=0"`
-	MaxUsagePerUser      int                `json:"max_usage_per_user" binding:"required,gte=1"`
-	ValidTimeWindow      *models.TimeWindow `json:"valid_time_window"`
-	TermsAndConditions   string             `json:"terms_and_conditions"`
-	ApplicableMedicines  []models.Medicine  `json:"applicable_medicines"`
-	ApplicableCategories []models.Category  `json:"applicable_categories"`
-}
-
-type GetApplicableCouponsRequest struct {
-	CartItems  []models.Medicine `json:"cart_items" binding:"required"`
-	OrderTotal float64           `json:"order_total" binding:"required,gte=0"`
-}
-
-type ValidateCouponRequest struct {
-	CouponCode string            `json:"coupon_code" binding:"required"`
-	CartItems  []models.Medicine `json:"cart_items" binding:"required"`
-	OrderTotal float64           `json:"order_total" binding:"required,gte=0"`
-}
-
-type ErrorResponse struct {
-	Error string `json:"error"`
-}
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"coupon-system/internal/logging"
+	"coupon-system/internal/models"
+	"coupon-system/internal/repository"
+	"coupon-system/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/skip2/go-qrcode"
+)
+
+// DefaultMaxCartItems is the largest cart accepted unless SetMaxCartItems
+// overrides it.
+const DefaultMaxCartItems = 200
+
+type Handler struct {
+	couponService *service.CouponService
+	maxCartItems  int
+}
+
+func NewHandler(couponService *service.CouponService) *Handler {
+	return &Handler{
+		couponService: couponService,
+		maxCartItems:  DefaultMaxCartItems,
+	}
+}
+
+// SetMaxCartItems sets how many lines a cart may have. Larger carts are
+// rejected with 413 before any coupon is evaluated against them.
+func (h *Handler) SetMaxCartItems(n int) {
+	if n > 0 {
+		h.maxCartItems = n
+	}
+}
+
+// cartWithinLimit writes a 413 and returns false if cartItems has more lines
+// than the handler accepts.
+func (h *Handler) cartWithinLimit(c *gin.Context, cartItems []models.Medicine) bool {
+	if len(cartItems) <= h.maxCartItems {
+		return true
+	}
+	c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: fmt.Sprintf("cart_items may contain at most %d items", h.maxCartItems)})
+	return false
+}
+
+// orderValid writes an error response and returns false unless the order
+// amounts are not negative and the cart is acceptable: within the size limit
+// (413), with an ID on every item (400) and passing validateCart (422).
+func (h *Handler) orderValid(c *gin.Context, cartItems []models.Medicine, orderTotal, deliveryCharge, taxes decimal.Decimal) bool {
+	switch {
+	case orderTotal.IsNegative():
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "order_total must not be negative"})
+		return false
+	case deliveryCharge.IsNegative():
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "delivery_charge must not be negative"})
+		return false
+	case taxes.IsNegative():
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "taxes must not be negative"})
+		return false
+	}
+	if !h.cartWithinLimit(c, cartItems) || !cartIDsPresent(c, cartItems) {
+		return false
+	}
+	if err := validateCart(cartItems); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error()})
+		return false
+	}
+	return true
+}
+
+// cartIDsPresent writes a 400 listing every cart item without a medicine ID
+// and returns false if there are any. A missing ID decodes as uuid.Nil, which
+// would otherwise silently fail to match any coupon restriction.
+func cartIDsPresent(c *gin.Context, cartItems []models.Medicine) bool {
+	var fields []FieldError
+	for i, item := range cartItems {
+		if item.ID == uuid.Nil {
+			fields = append(fields, FieldError{
+				Field:   fmt.Sprintf("cart_items[%d].id", i),
+				Rule:    "required",
+				Message: "is required",
+			})
+		}
+	}
+	if fields == nil {
+		return true
+	}
+	c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request", Fields: fields})
+	return false
+}
+
+// @Summary Create a new coupon
+// @Description Create a new coupon with the given parameters
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param coupon body CreateCouponRequest true "Coupon creation request"
+// @Success 201 {object} CreateCouponResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse "Code already taken, ignoring case"
+// @Router /admin/coupons [post]
+func (h *Handler) CreateCoupon(c *gin.Context) {
+	var req CreateCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+
+	input := req.toInput()
+	coupon, err := h.couponService.CreateCoupon(c.Request.Context(), input)
+	if isCouponInputError(err) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if errors.Is(err, repository.ErrDuplicateCode) {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, CreateCouponResponse{
+		Coupon:   coupon,
+		Warnings: h.couponService.DiscountWarnings(input),
+	})
+}
+
+// @Summary Update a coupon
+// @Description Replace a coupon's definition. The request must carry the version last read; a stale version is rejected with 409.
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param id path string true "Coupon ID"
+// @Param coupon body UpdateCouponRequest true "Coupon update request"
+// @Success 200 {object} models.Coupon
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /admin/coupons/{id} [put]
+func (h *Handler) UpdateCoupon(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid coupon id"})
+		return
+	}
+
+	var req UpdateCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+
+	coupon, err := h.couponService.UpdateCoupon(c.Request.Context(), id, req.Version, req.toInput())
+	switch {
+	case isCouponInputError(err):
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	case errors.Is(err, service.ErrCouponNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	case errors.Is(err, repository.ErrVersionConflict), errors.Is(err, repository.ErrDuplicateCode):
+		c.JSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+		return
+	case err != nil:
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, coupon)
+}
+
+// @Summary Get a coupon's audit trail
+// @Description Every create, update and deactivation of the coupon, oldest first, with the acting user and the state before and after
+// @Tags coupons
+// @Produce json
+// @Param id path string true "Coupon ID"
+// @Success 200 {array} models.AuditLog
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/coupons/{id}/audit [get]
+func (h *Handler) GetCouponAuditLog(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid coupon id"})
+		return
+	}
+
+	entries, err := h.couponService.ListAuditLog(c.Request.Context(), id)
+	if errors.Is(err, service.ErrCouponNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// @Summary Look up a coupon by code
+// @Description Return the coupon with the given code, including deactivated coupons
+// @Tags coupons
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Success 200 {object} models.Coupon
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/coupons/code/{code} [get]
+func (h *Handler) GetCouponByCode(c *gin.Context) {
+	coupon, err := h.couponService.GetCouponByCode(c.Request.Context(), c.Param("code"))
+	if errors.Is(err, service.ErrCouponNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, coupon)
+}
+
+// @Summary Clone a coupon
+// @Description Create a new coupon with the given code from an existing coupon's definition, linked to the same medicines and categories. The copy is active and has no redemptions; expiry_date optionally overrides the source's expiry.
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param id path string true "Source coupon ID"
+// @Param request body CloneCouponRequest true "Clone coupon request"
+// @Success 201 {object} models.Coupon
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse "Code already exists"
+// @Router /admin/coupons/{id}/clone [post]
+func (h *Handler) CloneCoupon(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid coupon id"})
+		return
+	}
+
+	var req CloneCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+
+	coupon, err := h.couponService.CloneCoupon(c.Request.Context(), id, req.Code, req.ExpiryDate)
+	switch {
+	case isCouponInputError(err):
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	case errors.Is(err, service.ErrCouponNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	case errors.Is(err, repository.ErrDuplicateCode):
+		c.JSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+		return
+	case err != nil:
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, coupon)
+}
+
+// @Summary Change a coupon's medicines
+// @Description Add, remove or replace the medicines a coupon is restricted to. Replacing with an empty list, with no categories linked, makes the coupon apply to every medicine.
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param id path string true "Coupon ID"
+// @Param request body UpdateCouponLinksRequest true "Link update"
+// @Success 200 {object} models.Coupon
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/coupons/{id}/medicines [post]
+func (h *Handler) UpdateCouponMedicines(c *gin.Context) {
+	h.updateCouponLinks(c, h.couponService.UpdateCouponMedicines)
+}
+
+// @Summary Change a coupon's categories
+// @Description Add, remove or replace the categories a coupon is restricted to. Replacing with an empty list, with no medicines linked, makes the coupon apply to every category.
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param id path string true "Coupon ID"
+// @Param request body UpdateCouponLinksRequest true "Link update"
+// @Success 200 {object} models.Coupon
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/coupons/{id}/categories [post]
+func (h *Handler) UpdateCouponCategories(c *gin.Context) {
+	h.updateCouponLinks(c, h.couponService.UpdateCouponCategories)
+}
+
+func (h *Handler) updateCouponLinks(c *gin.Context, update func(context.Context, uuid.UUID, models.LinkOp, []uuid.UUID) (*models.Coupon, error)) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid coupon id"})
+		return
+	}
+
+	var req UpdateCouponLinksRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+	op := models.LinkOp(req.Op)
+	if op != models.LinkReplace && len(req.IDs) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "ids must not be empty for " + req.Op})
+		return
+	}
+
+	coupon, err := update(c.Request.Context(), id, op, req.IDs)
+	switch {
+	case isCouponInputError(err):
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	case errors.Is(err, service.ErrCouponNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	case err != nil:
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, coupon)
+}
+
+// @Summary Reconcile a coupon's usage count
+// @Description Recount the coupon's redemptions and correct its times_used counter if it has drifted. Returns the counter before and after.
+// @Tags coupons
+// @Produce json
+// @Param id path string true "Coupon ID"
+// @Success 200 {object} models.UsageReconciliation
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/coupons/{id}/reconcile [post]
+func (h *Handler) ReconcileCouponUsage(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid coupon id"})
+		return
+	}
+
+	result, err := h.couponService.ReconcileUsage(c.Request.Context(), id)
+	if errors.Is(err, service.ErrCouponNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// @Summary Purge old coupon usage
+// @Description Delete redemptions made before the cutoff, for coupons that are inactive, expired or deleted only. Usage of live coupons is kept because per-user limits are counted from it.
+// @Tags coupons
+// @Produce json
+// @Param before query string true "Cutoff, RFC3339 or YYYY-MM-DD, in the past"
+// @Success 200 {object} PurgeUsageResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /admin/usage/purge [post]
+func (h *Handler) PurgeUsage(c *gin.Context) {
+	before, err := parseTimeParam(c.Query("before"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "before: " + err.Error()})
+		return
+	}
+
+	purged, err := h.couponService.PurgeUsage(c.Request.Context(), before)
+	if errors.Is(err, service.ErrInvalidPurgeCutoff) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, PurgeUsageResponse{Purged: purged})
+}
+
+// @Summary Deactivate coupons in bulk
+// @Description Deactivate every active coupon whose code starts with prefix (case-insensitive), or the coupons with the listed codes. Exactly one of prefix and codes must be given.
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param request body DeactivateCouponsRequest true "Deactivate coupons request"
+// @Success 200 {object} DeactivateCouponsResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /admin/coupons/deactivate [post]
+func (h *Handler) DeactivateCoupons(c *gin.Context) {
+	var req DeactivateCouponsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+	prefix := strings.TrimSpace(req.Prefix)
+	if (prefix == "") == (len(req.Codes) == 0) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "exactly one of prefix and codes is required"})
+		return
+	}
+
+	var deactivated int64
+	var err error
+	if prefix != "" {
+		deactivated, err = h.couponService.DeactivateByPrefix(c.Request.Context(), prefix)
+	} else {
+		deactivated, err = h.couponService.DeactivateCodes(c.Request.Context(), req.Codes)
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, DeactivateCouponsResponse{Deactivated: deactivated})
+}
+
+// @Summary Generate coupons
+// @Description Mint a batch of coupons with random codes sharing one discount template
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param request body GenerateCouponsRequest true "Generate coupons request"
+// @Success 201 {object} GenerateCouponsResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /admin/coupons/generate [post]
+func (h *Handler) GenerateCoupons(c *gin.Context) {
+	var req GenerateCouponsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+
+	input := service.GenerateCouponsInput{
+		Count:    req.Count,
+		Prefix:   req.Prefix,
+		Length:   req.Length,
+		Template: req.CouponTemplate.toInput(),
+	}
+
+	codes, err := h.couponService.GenerateCoupons(c.Request.Context(), input)
+	if isCouponInputError(err) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, GenerateCouponsResponse{Codes: codes})
+}
+
+// Limits on a coupon import upload.
+const (
+	maxImportBytes = 1 << 20
+	maxImportRows  = 1000
+)
+
+// @Summary Import coupons from CSV
+// @Description Create coupons from an uploaded CSV file. The header row names the columns by the JSON field names of a create request; lists such as applicable_medicine_ids are "|"-separated and tiers or windows are JSON. Valid rows are inserted in one transaction; the response reports every row's outcome by line number.
+// @Tags coupons
+// @Accept multipart/form-data
+// @Produce json
+// @Param file formData file true "CSV file, at most 1 MiB and 1000 rows"
+// @Success 200 {object} ImportCouponsResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Router /admin/coupons/import [post]
+func (h *Handler) ImportCoupons(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	header, err := c.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: fmt.Sprintf("import file exceeds %d bytes", maxImportBytes)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "file is required: " + err.Error()})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	defer file.Close()
+
+	rows, err := readCouponCSV(file, maxImportRows)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	resp := ImportCouponsResponse{Results: make([]ImportCouponResult, len(rows))}
+	var valid []service.ImportRow
+	var positions []int
+	for i, row := range rows {
+		resp.Results[i] = ImportCouponResult{Line: row.Line, Code: row.Request.Code}
+		if row.Err != nil {
+			rejection := bindingError(row.Err)
+			resp.Results[i].Error = rejection.Error
+			resp.Results[i].Fields = rejection.Fields
+			continue
+		}
+		valid = append(valid, service.ImportRow{Line: row.Line, Input: row.Request.toInput()})
+		positions = append(positions, i)
+	}
+
+	results, err := h.couponService.ImportCoupons(c.Request.Context(), valid)
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	for j, result := range results {
+		r := &resp.Results[positions[j]]
+		r.Code = result.Code
+		if result.Err != nil {
+			r.Error = result.Err.Error()
+			continue
+		}
+		id := result.CouponID
+		r.CouponID = &id
+		resp.Imported++
+	}
+	resp.Failed = len(rows) - resp.Imported
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// @Summary List coupon usage
+// @Description Page through every redemption in (used_at, id) order. Pass the returned next_cursor to fetch the following page; it is omitted after the last page.
+// @Tags coupons
+// @Produce json
+// @Param cursor query string false "Cursor from the previous page"
+// @Param limit query int false "Page size (default 20, max 1000)"
+// @Success 200 {object} CouponUsagePageResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /admin/coupons/usage [get]
+func (h *Handler) ListCouponUsage(c *gin.Context) {
+	cursor, err := repository.DecodeUsageCursor(c.Query("cursor"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	limit, err := parseLimit(c, maxUsagePageSize)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	usages, next, err := h.couponService.ListUsage(c.Request.Context(), cursor, limit)
+	if errors.Is(err, service.ErrInvalidLimit) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	resp := CouponUsagePageResponse{Usages: usages}
+	if next != nil {
+		resp.NextCursor = next.Encode()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// @Summary Export coupon usage
+// @Description Stream coupon redemptions in [from, to) as a CSV download
+// @Tags coupons
+// @Produce text/csv
+// @Param from query string true "Start of range (RFC3339 or YYYY-MM-DD)"
+// @Param to query string true "End of range, exclusive (RFC3339 or YYYY-MM-DD)"
+// @Success 200 {file} file
+// @Failure 400 {object} ErrorResponse
+// @Router /admin/coupons/usage/export [get]
+func (h *Handler) ExportCouponUsage(c *gin.Context) {
+	from, err := parseTimeParam(c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid from: " + err.Error()})
+		return
+	}
+	to, err := parseTimeParam(c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid to: " + err.Error()})
+		return
+	}
+	if !to.After(from) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "to must be after from"})
+		return
+	}
+
+	// The export may outlive the server's write timeout; lift it for this
+	// response only
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		logging.FromContext(c.Request.Context()).Warn("could not lift write deadline for export", "error", err)
+	}
+
+	w := csv.NewWriter(c.Writer)
+	started := false
+	start := func() error {
+		started = true
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", `attachment; filename="coupon_usage.csv"`)
+		c.Status(http.StatusOK)
+		return w.Write([]string{"usage_id", "coupon_id", "coupon_code", "user_id", "order_id", "discount_applied", "order_total", "used_at"})
+	}
+
+	err = h.couponService.ExportUsage(c.Request.Context(), from, to, func(u repository.UsageRecord) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		if err := w.Write([]string{
+			u.ID.String(),
+			u.CouponID.String(),
+			u.CouponCode,
+			u.UserID.String(),
+			u.OrderID.String(),
+			u.DiscountApplied.StringFixed(2),
+			u.OrderTotal.StringFixed(2),
+			u.UsedAt.UTC().Format(time.RFC3339),
+		}); err != nil {
+			return err
+		}
+		w.Flush()
+		return w.Error()
+	})
+	if err != nil {
+		if !started {
+			c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+			return
+		}
+		// Headers are already on the wire; all we can do is stop streaming.
+		_ = c.Error(err)
+		return
+	}
+
+	if !started {
+		if err := start(); err != nil {
+			_ = c.Error(err)
+			return
+		}
+	}
+	w.Flush()
+}
+
+// @Summary Redeem a coupon
+// @Description Validate a coupon for an order and, if valid, record its usage. With dry_run set nothing is recorded. Send an Idempotency-Key header to make retries safe.
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param Idempotency-Key header string false "Key identifying this redemption attempt"
+// @Param request body RedeemCouponRequest true "Redeem coupon request"
+// @Success 201 {object} service.ValidateCouponOutput
+// @Success 200 {object} service.ValidateCouponOutput "Coupon not valid or dry run; nothing recorded"
+// @Failure 400 {object} ErrorResponse "Malformed request body"
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse "Coupon already used or order already has a coupon"
+// @Failure 413 {object} ErrorResponse "Body too large or too many cart items"
+// @Failure 422 {object} ErrorResponse "Well-formed request with invalid cart contents or missing order_id"
+// @Failure 429 {object} ErrorResponse "User has reached the coupon's usage limit"
+// @Router /coupons/redeem [post]
+func (h *Handler) RedeemCoupon(c *gin.Context) {
+	var req RedeemCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+	if !h.orderValid(c, req.CartItems, req.OrderTotal, req.DeliveryCharge, req.Taxes) {
+		return
+	}
+	if req.OrderID == uuid.Nil {
+		c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Error: "order_id is required"})
+		return
+	}
+
+	// Get user ID from context (assuming it's set by auth middleware)
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "user not authenticated"})
+		return
+	}
+
+	input := service.ValidateCouponInput{
+		Code:      req.CouponCode,
+		CartItems: req.CartItems,
+		Order: models.OrderContext{
+			ItemsTotal:     req.OrderTotal,
+			DeliveryCharge: req.DeliveryCharge,
+			Taxes:          req.Taxes,
+		},
+		PaymentMethod: req.PaymentMethod,
+		Currency:      req.Currency,
+		UserID:        userID.(uuid.UUID),
+		OrderID:       req.OrderID,
+		Timestamp:     time.Now(),
+		DryRun:        req.DryRun,
+	}
+
+	result, err := h.couponService.RecordCouponUsage(c.Request.Context(), input)
+	if err != nil {
+		c.JSON(redemptionErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	if !result.IsValid || req.DryRun {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	c.JSON(http.StatusCreated, result)
+}
+
+// redemptionErrorStatus maps an error from RecordCouponUsage to an HTTP
+// status: 429 once the user or the coupon has used up its redemptions, 409
+// when the redemption clashes with an existing one, and serverErrorStatus
+// otherwise.
+func redemptionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, repository.ErrUsageLimitExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, repository.ErrCouponAlreadyUsed), errors.Is(err, repository.ErrOrderHasCoupon):
+		return http.StatusConflict
+	}
+	return serverErrorStatus(err)
+}
+
+// @Summary Get coupon/category applicability matrix
+// @Description For each category, list the codes of coupons that apply to it
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param request body CategoryMatrixRequest true "Category matrix request"
+// @Success 200 {object} CategoryMatrixResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /admin/coupons/category-matrix [post]
+func (h *Handler) GetCategoryMatrix(c *gin.Context) {
+	var req CategoryMatrixRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+
+	matrix, err := h.couponService.GetCategoryMatrix(c.Request.Context(), req.CategoryIDs)
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, CategoryMatrixResponse{Matrix: matrix})
+}
+
+// @Summary Get coupon usage statistics
+// @Description Total redemptions, unique users, total discount granted and first/last use of a coupon
+// @Tags coupons
+// @Produce json
+// @Param id path string true "Coupon ID"
+// @Success 200 {object} models.CouponStats
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/coupons/{id}/stats [get]
+func (h *Handler) GetCouponStats(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid coupon id"})
+		return
+	}
+
+	stats, err := h.couponService.GetCouponStats(c.Request.Context(), id)
+	if errors.Is(err, service.ErrCouponNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// @Summary Coupon performance report
+// @Description Top coupons by redemption count or total discount granted in [from, to)
+// @Tags coupons
+// @Produce json
+// @Param from query string true "Start of range (RFC3339 or YYYY-MM-DD)"
+// @Param to query string true "End of range, exclusive (RFC3339 or YYYY-MM-DD)"
+// @Param sort query string false "Ranking metric: redemptions (default) or discount"
+// @Param limit query int false "Maximum results (default 20, max 100)"
+// @Success 200 {array} models.CouponPerformance
+// @Failure 400 {object} ErrorResponse
+// @Router /admin/coupons/report [get]
+func (h *Handler) GetCouponReport(c *gin.Context) {
+	from, err := parseTimeParam(c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid from: " + err.Error()})
+		return
+	}
+	to, err := parseTimeParam(c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid to: " + err.Error()})
+		return
+	}
+	if !to.After(from) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "to must be after from"})
+		return
+	}
+	sortBy := models.PerformanceSort(c.DefaultQuery("sort", string(models.SortByRedemptions)))
+	if !sortBy.IsValid() {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "sort must be redemptions or discount"})
+		return
+	}
+	limit, _, err := parsePagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	report, err := h.couponService.TopCoupons(c.Request.Context(), from, to, sortBy, limit)
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// @Summary Search coupons by code
+// @Description Case-insensitive code prefix search for admin typeahead
+// @Tags coupons
+// @Produce json
+// @Param q query string true "Code prefix"
+// @Param limit query int false "Maximum results (default 20, max 100)"
+// @Success 200 {array} models.CouponSearchResult
+// @Failure 400 {object} ErrorResponse
+// @Router /admin/coupons/search [get]
+func (h *Handler) SearchCoupons(c *gin.Context) {
+	prefix := strings.TrimSpace(c.Query("q"))
+	if prefix == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "q is required"})
+		return
+	}
+	limit, _, err := parsePagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	results, err := h.couponService.SearchCoupons(c.Request.Context(), prefix, limit)
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+// @Summary Get a user's coupon usage
+// @Description Redemptions made by a user, most recent first, with lifetime totals
+// @Tags users
+// @Produce json
+// @Param id path string true "User ID"
+// @Param limit query int false "Page size (default 20, max 100)"
+// @Param offset query int false "Number of redemptions to skip"
+// @Success 200 {object} UserCouponUsageResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /admin/users/{id}/coupon-usage [get]
+func (h *Handler) GetUserCouponUsage(c *gin.Context) {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid user id"})
+		return
+	}
+	limit, offset, err := parsePagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	usages, summary, err := h.couponService.ListUserUsage(c.Request.Context(), userID, limit, offset)
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, UserCouponUsageResponse{
+		Summary: *summary,
+		Usages:  usages,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
+
+// @Summary Get discount liability report
+// @Description Upper-bound discount exposure per customer across active coupons
+// @Tags reports
+// @Produce json
+// @Success 200 {object} models.LiabilityReport
+// @Router /admin/reports/liability [get]
+func (h *Handler) GetLiabilityReport(c *gin.Context) {
+	report, err := h.couponService.GetLiabilityReport(c.Request.Context())
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// @Summary Get applicable coupons
+// @Description Get all coupons the user could apply to the given cart, largest discount first. Only coupons that would pass validation for this user, payment method and currency are returned.
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param request body GetApplicableCouponsRequest true "Get applicable coupons request"
+// @Param explain query bool false "Also return the cart items each restricted coupon applies to"
+// @Param If-None-Match header string false "ETag of a previous response"
+// @Success 200 {object} ApplicableCouponsResponse
+// @Success 304 "Unchanged since the response with the given ETag"
+// @Failure 400 {object} ErrorResponse "Malformed request, or cart too large to search; validate a specific code instead"
+// @Failure 401 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse "Body too large or too many cart items"
+// @Failure 422 {object} ErrorResponse "Well-formed request with invalid cart contents"
+// @Failure 503 {object} ErrorResponse "Endpoint disabled by feature flag"
+// @Router /coupons/applicable [post]
+func (h *Handler) GetApplicableCoupons(c *gin.Context) {
+	var req GetApplicableCouponsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+	if !h.orderValid(c, req.CartItems, req.OrderTotal, req.DeliveryCharge, req.Taxes) {
+		return
+	}
+	if len(req.CartItems) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "cart_items must contain at least one item"})
+		return
+	}
+
+	// Get user ID from context (assuming it's set by auth middleware)
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "user not authenticated"})
+		return
+	}
+
+	coupons, err := h.couponService.GetApplicableCoupons(c.Request.Context(), req.toInput(userID.(uuid.UUID)))
+	if errors.Is(err, service.ErrCartTooLargeToScan) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	// Always send an array, never null, so "no coupons" has a single shape
+	if coupons == nil {
+		coupons = []models.Coupon{}
+	}
+	resp := ApplicableCouponsResponse{
+		ApplicableCoupons: coupons,
+		Count:             len(coupons),
+		HasCoupons:        len(coupons) > 0,
+	}
+	if c.Query("explain") == "true" {
+		resp.MatchedItems = make(map[uuid.UUID][]models.MatchedItem)
+		for i := range coupons {
+			if matched := coupons[i].MatchedItems(req.CartItems); matched != nil {
+				resp.MatchedItems[coupons[i].ID] = matched
+			}
+		}
+	}
+	jsonWithETag(c, resp)
+}
+
+// @Summary Get the best coupon
+// @Description Get the coupon that yields the largest discount among those that would pass validation for the given cart
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param request body GetApplicableCouponsRequest true "Get best coupon request"
+// @Success 200 {object} service.BestCouponOutput
+// @Failure 400 {object} ErrorResponse "Malformed request, or cart too large to search; validate a specific code instead"
+// @Failure 401 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse "Body too large or too many cart items"
+// @Failure 422 {object} ErrorResponse "Well-formed request with invalid cart contents"
+// @Failure 404 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse "Endpoint disabled by feature flag"
+// @Router /coupons/best [post]
+func (h *Handler) GetBestCoupon(c *gin.Context) {
+	var req GetApplicableCouponsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+	if !h.orderValid(c, req.CartItems, req.OrderTotal, req.DeliveryCharge, req.Taxes) {
+		return
+	}
+	if len(req.CartItems) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "cart_items must contain at least one item"})
+		return
+	}
+
+	// Get user ID from context (assuming it's set by auth middleware)
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "user not authenticated"})
+		return
+	}
+
+	best, err := h.couponService.GetBestCoupon(c.Request.Context(), req.toInput(userID.(uuid.UUID)))
+	if errors.Is(err, service.ErrCartTooLargeToScan) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	if best == nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "no applicable coupons"})
+		return
+	}
+
+	c.JSON(http.StatusOK, best)
+}
+
+// @Summary Validate a coupon
+// @Description Validate a coupon for the given cart items. Read-only: never records a usage.
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param request body ValidateCouponRequest true "Validate coupon request"
+// @Param suggest query bool false "Also look for a coupon that would save more"
+// @Success 200 {object} service.ValidateCouponOutput "Coupon accepted or rejected; see is_valid and reason"
+// @Failure 400 {object} ErrorResponse "Malformed request body"
+// @Failure 401 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse "Body too large or too many cart items"
+// @Failure 422 {object} ErrorResponse "Well-formed request with invalid cart contents"
+// @Router /coupons/validate [post]
+func (h *Handler) ValidateCoupon(c *gin.Context) {
+	var req ValidateCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+	if !h.orderValid(c, req.CartItems, req.OrderTotal, req.DeliveryCharge, req.Taxes) {
+		return
+	}
+
+	// Get user ID from context (assuming it's set by auth middleware)
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "user not authenticated"})
+		return
+	}
+
+	input := service.ValidateCouponInput{
+		Code:      req.CouponCode,
+		CartItems: req.CartItems,
+		Order: models.OrderContext{
+			ItemsTotal:     req.OrderTotal,
+			DeliveryCharge: req.DeliveryCharge,
+			Taxes:          req.Taxes,
+		},
+		PaymentMethod: req.PaymentMethod,
+		Currency:      req.Currency,
+		UserID:        userID.(uuid.UUID),
+		OrderID:       req.OrderID,
+		Timestamp:     time.Now(),
+	}
+
+	result, err := h.couponService.ValidateCoupon(c.Request.Context(), input)
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	// The suggestion is a nudge, not part of the answer; failing to find one
+	// should not fail the validation
+	if c.Query("suggest") == "true" {
+		suggestion, err := h.couponService.SuggestBetterCoupon(c.Request.Context(), input, result)
+		if err != nil {
+			logging.FromContext(c.Request.Context()).Warn("could not suggest a better coupon", "error", err)
+		}
+		result.Suggestion = suggestion
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// @Summary Re-validate applied coupons
+// @Description Re-validate several previously applied coupon codes against an updated cart in one call. Read-only: never records a usage.
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param request body RevalidateCouponsRequest true "Revalidate coupons request"
+// @Success 200 {array} service.RevalidatedCoupon "One result per code, in request order"
+// @Failure 400 {object} ErrorResponse "Malformed request body"
+// @Failure 401 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse "Body too large or too many cart items"
+// @Failure 422 {object} ErrorResponse "Well-formed request with invalid cart contents"
+// @Router /coupons/revalidate [post]
+func (h *Handler) RevalidateCoupons(c *gin.Context) {
+	var req RevalidateCouponsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+	if !h.orderValid(c, req.CartItems, req.OrderTotal, req.DeliveryCharge, req.Taxes) {
+		return
+	}
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "user not authenticated"})
+		return
+	}
+
+	input := service.ValidateCouponInput{
+		CartItems: req.CartItems,
+		Order: models.OrderContext{
+			ItemsTotal:     req.OrderTotal,
+			DeliveryCharge: req.DeliveryCharge,
+			Taxes:          req.Taxes,
+		},
+		PaymentMethod: req.PaymentMethod,
+		Currency:      req.Currency,
+		UserID:        userID.(uuid.UUID),
+		OrderID:       req.OrderID,
+		Timestamp:     time.Now(),
+	}
+
+	results, err := h.couponService.RevalidateCoupons(c.Request.Context(), req.CouponCodes, input)
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+// @Summary Get a coupon's terms
+// @Description Customer-facing rules of an active coupon: discount summary, minimum order value, expiry, eligible medicines and categories, and terms and conditions
+// @Tags coupons
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Success 200 {object} models.CouponTerms
+// @Failure 404 {object} ErrorResponse "Unknown, inactive or expired code"
+// @Router /coupons/{code}/terms [get]
+func (h *Handler) GetCouponTerms(c *gin.Context) {
+	terms, err := h.couponService.GetCouponTerms(c.Request.Context(), c.Param("code"))
+	if errors.Is(err, service.ErrCouponNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, terms)
+}
+
+// qrImageSize is the width and height, in pixels, of coupon QR codes.
+const qrImageSize = 256
+
+// @Summary Get a coupon as a QR code
+// @Description PNG QR code of an active coupon for in-store display. The QR payload is just the code, so scanning it pre-fills the code in the app; the discount summary is sent in the X-Coupon-Summary header for the caption.
+// @Tags coupons
+// @Produce png
+// @Param code path string true "Coupon code"
+// @Success 200 {file} binary
+// @Failure 404 {object} ErrorResponse "Unknown, inactive or expired code"
+// @Router /coupons/{code}/qr [get]
+func (h *Handler) GetCouponQR(c *gin.Context) {
+	terms, err := h.couponService.GetCouponTerms(c.Request.Context(), c.Param("code"))
+	if errors.Is(err, service.ErrCouponNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	png, err := qrcode.Encode(terms.Code, qrcode.Medium, qrImageSize)
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.Header("X-Coupon-Summary", terms.Summary)
+	c.Data(http.StatusOK, "image/png", png)
+}
+
+// @Summary List coupons for a medicine
+// @Description Active coupons that could apply to the medicine (restricted to it, to its category, or unrestricted), for product pages. Personal coupons are not listed.
+// @Tags coupons
+// @Produce json
+// @Param id path string true "Medicine ID"
+// @Success 200 {array} models.CouponOffer
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /coupons/for-medicine/{id} [get]
+func (h *Handler) ListCouponsForMedicine(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid medicine id"})
+		return
+	}
+
+	offers, err := h.couponService.ListOffersForMedicine(c.Request.Context(), id)
+	if errors.Is(err, service.ErrMedicineNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, offers)
+}
+
+// @Summary Preview a coupon
+// @Description Price a coupon against a cart for an anonymous visitor, e.g. on a landing page. Per-user redemption limits are not checked, so a valid preview does not guarantee the code will redeem; coupons assigned to a user are never previewable.
+// @Tags coupons
+// @Accept json
+// @Produce json
+// @Param request body PreviewCouponRequest true "Preview coupon request"
+// @Success 200 {object} service.ValidateCouponOutput "Coupon accepted or rejected; see is_valid and reason"
+// @Failure 400 {object} ErrorResponse "Malformed request body"
+// @Failure 413 {object} ErrorResponse "Body too large or too many cart items"
+// @Failure 422 {object} ErrorResponse "Well-formed request with invalid cart contents"
+// @Router /coupons/preview [post]
+func (h *Handler) PreviewCoupon(c *gin.Context) {
+	var req PreviewCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, bindingError(err))
+		return
+	}
+	if !h.orderValid(c, req.CartItems, req.OrderTotal, req.DeliveryCharge, req.Taxes) {
+		return
+	}
+
+	input := service.ValidateCouponInput{
+		Code:      req.CouponCode,
+		CartItems: req.CartItems,
+		Order: models.OrderContext{
+			ItemsTotal:     req.OrderTotal,
+			DeliveryCharge: req.DeliveryCharge,
+			Taxes:          req.Taxes,
+		},
+		PaymentMethod: req.PaymentMethod,
+		Currency:      req.Currency,
+		Timestamp:     time.Now(),
+	}
+
+	result, err := h.couponService.PreviewCoupon(c.Request.Context(), input)
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// CouponTemplate holds the settings a coupon is created with, apart from its
+// code and assignee. It is shared by the requests that create one coupon and
+// those that generate many alike.
+type CouponTemplate struct {
+	StartDate               time.Time             `json:"start_date"`
+	ExpiryDate              time.Time             `json:"expiry_date" binding:"required"`
+	UsageType               string                `json:"usage_type" binding:"required,oneof=one_time multi_use time_based"`
+	DiscountType            string                `json:"discount_type" binding:"required,oneof=percentage fixed"`
+	DiscountValue           decimal.Decimal       `json:"discount_value"`
+	SecondaryDiscountType   string                `json:"secondary_discount_type" binding:"omitempty,oneof=percentage fixed"`
+	SecondaryDiscountValue  decimal.Decimal       `json:"secondary_discount_value"`
+	Currency                string                `json:"currency"`
+	DiscountScope           string                `json:"discount_scope" binding:"omitempty,oneof=order cheapest_item most_expensive_item"`
+	CustomerSegment         string                `json:"customer_segment" binding:"omitempty,oneof=all first_coupon repeat_coupon"`
+	MinDiscountAmount       decimal.Decimal       `json:"min_discount_amount"`
+	MaxDiscountAmount       decimal.Decimal       `json:"max_discount_amount"`
+	MinOrderValue           decimal.Decimal       `json:"min_order_value"`
+	MaxOrderValue           decimal.Decimal       `json:"max_order_value"`
+	MinOrderTiers           models.MinOrderTiers  `json:"min_order_tiers" binding:"dive"`
+	DiscountTiers           models.DiscountTiers  `json:"discount_tiers"`
+	MinOnApplicableItems    bool                  `json:"min_on_applicable_items"`
+	MinOrderIncludesCharges bool                  `json:"min_order_includes_charges"`
+	MaxUsagePerUser         int                   `json:"max_usage_per_user" binding:"required,gte=1"`
+	MaxUsagePerUserDay      int                   `json:"max_usage_per_user_per_day" binding:"gte=0"`
+	MaxTotalUsage           int64                 `json:"max_total_usage" binding:"gte=0"`
+	RolloutPercentage       int                   `json:"rollout_percentage" binding:"gte=0,lte=100"`
+	MinItemCount            int                   `json:"min_item_count" binding:"gte=0"`
+	ValidTimeWindow         *models.TimeWindow    `json:"valid_time_window"`
+	DailyWindow             *models.DailyWindow   `json:"daily_window"`
+	PaymentMethods          models.PaymentMethods `json:"payment_methods"`
+	TermsAndConditions      string                `json:"terms_and_conditions"`
+	ApplicableMedicineIDs   []uuid.UUID           `json:"applicable_medicine_ids"`
+	ApplicableCategoryIDs   []uuid.UUID           `json:"applicable_category_ids"`
+}
+
+type CreateCouponRequest struct {
+	Code           string     `json:"code" binding:"required"`
+	AssignedUserID *uuid.UUID `json:"assigned_user_id"`
+	CouponTemplate
+}
+
+func (t CouponTemplate) toInput() service.CreateCouponInput {
+	return service.CreateCouponInput{
+		StartDate:               t.StartDate,
+		ExpiryDate:              t.ExpiryDate,
+		UsageType:               models.UsageType(t.UsageType),
+		DiscountType:            models.DiscountType(t.DiscountType),
+		DiscountValue:           t.DiscountValue,
+		SecondaryDiscountType:   models.DiscountType(t.SecondaryDiscountType),
+		SecondaryDiscountValue:  t.SecondaryDiscountValue,
+		Currency:                t.Currency,
+		DiscountScope:           models.DiscountScope(t.DiscountScope),
+		CustomerSegment:         models.CustomerSegment(t.CustomerSegment),
+		MinDiscountAmount:       t.MinDiscountAmount,
+		MaxDiscountAmount:       t.MaxDiscountAmount,
+		MinOrderValue:           t.MinOrderValue,
+		MaxOrderValue:           t.MaxOrderValue,
+		MinOrderTiers:           t.MinOrderTiers,
+		DiscountTiers:           t.DiscountTiers,
+		MinOnApplicableItems:    t.MinOnApplicableItems,
+		MinOrderIncludesCharges: t.MinOrderIncludesCharges,
+		MaxUsagePerUser:         t.MaxUsagePerUser,
+		MaxUsagePerUserDay:      t.MaxUsagePerUserDay,
+		MaxTotalUsage:           t.MaxTotalUsage,
+		RolloutPercentage:       t.RolloutPercentage,
+		MinItemCount:            t.MinItemCount,
+		ValidTimeWindow:         t.ValidTimeWindow,
+		DailyWindow:             t.DailyWindow,
+		PaymentMethods:          t.PaymentMethods,
+		TermsAndConditions:      t.TermsAndConditions,
+		ApplicableMedicineIDs:   t.ApplicableMedicineIDs,
+		ApplicableCategoryIDs:   t.ApplicableCategoryIDs,
+	}
+}
+
+func (r CreateCouponRequest) toInput() service.CreateCouponInput {
+	input := r.CouponTemplate.toInput()
+	input.Code = r.Code
+	input.AssignedUserID = r.AssignedUserID
+	return input
+}
+
+// CreateCouponResponse is the created coupon plus any warnings about values
+// that were accepted but look like mistakes.
+type CreateCouponResponse struct {
+	*models.Coupon
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// UpdateCouponRequest is a full coupon definition plus the version the
+// client last read, used for optimistic locking.
+type UpdateCouponRequest struct {
+	CreateCouponRequest
+	Version int `json:"version" binding:"required,gte=1"`
+}
+
+// CloneCouponRequest names the copy and optionally gives it a new expiry.
+type CloneCouponRequest struct {
+	Code       string     `json:"code" binding:"required"`
+	ExpiryDate *time.Time `json:"expiry_date"`
+}
+
+type DeactivateCouponsRequest struct {
+	Prefix string   `json:"prefix"`
+	Codes  []string `json:"codes" binding:"omitempty,max=1000"`
+}
+
+// UpdateCouponLinksRequest changes a coupon's medicine or category links.
+type UpdateCouponLinksRequest struct {
+	Op  string      `json:"op" binding:"required,oneof=add remove replace"`
+	IDs []uuid.UUID `json:"ids" binding:"required"`
+}
+
+type DeactivateCouponsResponse struct {
+	Deactivated int64 `json:"deactivated"`
+}
+
+type PurgeUsageResponse struct {
+	Purged int64 `json:"purged"`
+}
+
+type GenerateCouponsRequest struct {
+	Count  int    `json:"count" binding:"required,gte=1,lte=1000"`
+	Prefix string `json:"prefix"`
+	Length int    `json:"length" binding:"required,gte=4,lte=32"`
+	CouponTemplate
+}
+
+type GenerateCouponsResponse struct {
+	Codes []string `json:"codes"`
+}
+
+// ImportCouponResult is the outcome of one row of a coupon import: the ID of
+// the created coupon, or why the row was rejected.
+type ImportCouponResult struct {
+	Line     int          `json:"line"`
+	Code     string       `json:"code,omitempty"`
+	CouponID *uuid.UUID   `json:"coupon_id,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Fields   []FieldError `json:"fields,omitempty"`
+}
+
+type ImportCouponsResponse struct {
+	Imported int                  `json:"imported"`
+	Failed   int                  `json:"failed"`
+	Results  []ImportCouponResult `json:"results"`
+}
+
+type CategoryMatrixRequest struct {
+	CategoryIDs []uuid.UUID `json:"category_ids" binding:"required,min=1"`
+}
+
+type CategoryMatrixResponse struct {
+	Matrix map[uuid.UUID][]string `json:"matrix"`
+}
+
+type GetApplicableCouponsRequest struct {
+	CartItems      []models.Medicine `json:"cart_items"`
+	OrderTotal     decimal.Decimal   `json:"order_total"`
+	DeliveryCharge decimal.Decimal   `json:"delivery_charge"`
+	Taxes          decimal.Decimal   `json:"taxes"`
+	PaymentMethod  string            `json:"payment_method"`
+	Currency       string            `json:"currency"`
+}
+
+// toInput is the validation every candidate coupon must pass for userID.
+func (r GetApplicableCouponsRequest) toInput(userID uuid.UUID) service.ValidateCouponInput {
+	return service.ValidateCouponInput{
+		CartItems: r.CartItems,
+		Order: models.OrderContext{
+			ItemsTotal:     r.OrderTotal,
+			DeliveryCharge: r.DeliveryCharge,
+			Taxes:          r.Taxes,
+		},
+		PaymentMethod: r.PaymentMethod,
+		Currency:      r.Currency,
+		UserID:        userID,
+		Timestamp:     time.Now(),
+	}
+}
+
+type ApplicableCouponsResponse struct {
+	ApplicableCoupons []models.Coupon `json:"applicable_coupons"`
+	Count             int             `json:"count"`
+	HasCoupons        bool            `json:"has_coupons"`
+	// MatchedItems maps each restricted coupon's ID to the cart items it
+	// applies to. It is only returned with explain=true.
+	MatchedItems map[uuid.UUID][]models.MatchedItem `json:"matched_items,omitempty"`
+}
+
+type ValidateCouponRequest struct {
+	CouponCode     string            `json:"coupon_code" binding:"required"`
+	CartItems      []models.Medicine `json:"cart_items" binding:"required"`
+	OrderTotal     decimal.Decimal   `json:"order_total"`
+	DeliveryCharge decimal.Decimal   `json:"delivery_charge"`
+	Taxes          decimal.Decimal   `json:"taxes"`
+	PaymentMethod  string            `json:"payment_method"`
+	Currency       string            `json:"currency"`
+	OrderID        uuid.UUID         `json:"order_id"`
+}
+
+// RevalidateCouponsRequest is an updated cart plus the codes applied to it.
+type RevalidateCouponsRequest struct {
+	CouponCodes    []string          `json:"coupon_codes" binding:"required,min=1,max=20,dive,required"`
+	CartItems      []models.Medicine `json:"cart_items" binding:"required"`
+	OrderTotal     decimal.Decimal   `json:"order_total"`
+	DeliveryCharge decimal.Decimal   `json:"delivery_charge"`
+	Taxes          decimal.Decimal   `json:"taxes"`
+	PaymentMethod  string            `json:"payment_method"`
+	Currency       string            `json:"currency"`
+	OrderID        uuid.UUID         `json:"order_id"`
+}
+
+// PreviewCouponRequest is a cart without any user or order details.
+type PreviewCouponRequest struct {
+	CouponCode     string            `json:"coupon_code" binding:"required"`
+	CartItems      []models.Medicine `json:"cart_items" binding:"required"`
+	OrderTotal     decimal.Decimal   `json:"order_total"`
+	DeliveryCharge decimal.Decimal   `json:"delivery_charge"`
+	Taxes          decimal.Decimal   `json:"taxes"`
+	PaymentMethod  string            `json:"payment_method"`
+	Currency       string            `json:"currency"`
+}
+
+type RedeemCouponRequest struct {
+	ValidateCouponRequest
+	DryRun bool `json:"dry_run"`
+}
+
+type CouponUsagePageResponse struct {
+	Usages     []repository.UsageRecord `json:"usages"`
+	NextCursor string                   `json:"next_cursor,omitempty"`
+}
+
+type UserCouponUsageResponse struct {
+	Summary models.UserUsageSummary  `json:"summary"`
+	Usages  []repository.UsageRecord `json:"usages"`
+	Limit   int                      `json:"limit"`
+	Offset  int                      `json:"offset"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// Fields lists every field that failed request validation, if any.
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// isCouponInputError reports whether err is a coupon definition rejected by
+// the service's own validation, which should surface as a 400.
+func isCouponInputError(err error) bool {
+	var unknownRefs *service.UnknownReferencesError
+	var suspicious *service.SuspiciousDiscountError
+	return errors.Is(err, service.ErrInvalidTimeWindow) ||
+		errors.Is(err, service.ErrInvalidStartDate) ||
+		errors.Is(err, service.ErrInvalidDiscountBand) ||
+		errors.Is(err, service.ErrInvalidAmount) ||
+		errors.Is(err, service.ErrInvalidOrderValueRange) ||
+		errors.Is(err, service.ErrExpiryNotInFuture) ||
+		errors.Is(err, service.ErrTimeWindowAfterExpiry) ||
+		errors.Is(err, service.ErrInvalidDiscountTiers) ||
+		errors.Is(err, service.ErrInvalidSecondaryDiscount) ||
+		errors.Is(err, service.ErrInvalidCodeChecksum) ||
+		errors.Is(err, service.ErrInvalidCurrency) ||
+		errors.Is(err, service.ErrInvalidRollout) ||
+		errors.As(err, &unknownRefs) ||
+		errors.As(err, &suspicious)
+}
+
+// jsonWithETag writes body as a 200 JSON response tagged with an ETag derived
+// from its content, or an empty 304 if the request's If-None-Match already
+// names that ETag.
+func jsonWithETag(c *gin.Context, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.JSON(serverErrorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+// etagMatches reports whether an If-None-Match header value names etag,
+// comparing weakly as RFC 9110 requires for If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCart rejects carts that parse correctly but cannot describe a real
+// order: items with a negative price or quantity. Items without an ID are
+// caught earlier by cartIDsPresent.
+func validateCart(cartItems []models.Medicine) error {
+	for i, item := range cartItems {
+		switch {
+		case item.Price.IsNegative():
+			return fmt.Errorf("cart_items[%d]: price must not be negative", i)
+		case item.Quantity < 0:
+			return fmt.Errorf("cart_items[%d]: quantity must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// parseTimeParam accepts either a full RFC3339 timestamp or a bare
+// YYYY-MM-DD date (interpreted as midnight UTC).
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, errors.New("value is required")
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+
+	// maxUsagePageSize is larger than maxPageSize because keyset pages stay
+	// cheap however far a client walks.
+	maxUsagePageSize = 1000
+)
+
+// parsePagination reads the limit and offset query parameters, defaulting to
+// the first page of defaultPageSize items.
+func parsePagination(c *gin.Context) (limit, offset int, err error) {
+	limit, err = parseLimit(c, maxPageSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	if value := c.Query("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// parseLimit reads the limit query parameter, between 1 and max, defaulting
+// to defaultPageSize.
+func parseLimit(c *gin.Context, max int) (int, error) {
+	value := c.Query("limit")
+	if value == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > max {
+		return 0, fmt.Errorf("limit must be between 1 and %d", max)
+	}
+	return limit, nil
+}
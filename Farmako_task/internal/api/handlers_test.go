@@ -0,0 +1,346 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"coupon-system/internal/models"
+	"coupon-system/internal/repository"
+	"coupon-system/internal/service"
+	"coupon-system/internal/testdb"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestGetCouponQR(t *testing.T) {
+	repo := repository.NewCouponRepository(testdb.Open(t))
+	handler := NewHandler(service.NewCouponService(repo, nil))
+	router := gin.New()
+	router.GET("/coupons/:code/qr", handler.GetCouponQR)
+
+	for code, expiry := range map[string]time.Duration{"SAVE10": 24 * time.Hour, "LAPSED": -time.Hour} {
+		coupon := &models.Coupon{
+			ID:                uuid.New(),
+			Code:              code,
+			ExpiryDate:        time.Now().Add(expiry),
+			UsageType:         models.MultiUse,
+			DiscountType:      models.PercentageDiscount,
+			DiscountValue:     decimal.NewFromInt(10),
+			RolloutPercentage: 100,
+			IsActive:          true,
+			Version:           1,
+		}
+		if err := repo.Create(context.Background(), coupon); err != nil {
+			t.Fatalf("create coupon %s: %v", code, err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		code       string
+		wantStatus int
+	}{
+		{"active coupon", "SAVE10", http.StatusOK},
+		{"code is case-insensitive", "save10", http.StatusOK},
+		{"unknown code", "NOSUCH", http.StatusNotFound},
+		{"expired coupon", "LAPSED", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/coupons/"+tt.code+"/qr", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+				t.Errorf("Content-Type = %q, want image/png", ct)
+			}
+			if rec.Header().Get("X-Coupon-Summary") == "" {
+				t.Error("X-Coupon-Summary header is missing")
+			}
+			img, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+			if err != nil {
+				t.Fatalf("body is not a PNG: %v", err)
+			}
+			if b := img.Bounds(); b.Dx() != qrImageSize || b.Dy() != qrImageSize {
+				t.Errorf("image is %dx%d, want %dx%d", b.Dx(), b.Dy(), qrImageSize, qrImageSize)
+			}
+		})
+	}
+}
+
+func TestGetCouponQRCancelled(t *testing.T) {
+	repo := repository.NewCouponRepository(testdb.Open(t))
+	router := gin.New()
+	router.GET("/coupons/:code/qr", RequestTimeout(time.Minute), NewHandler(service.NewCouponService(repo, nil)).GetCouponQR)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/coupons/SAVE10/qr", nil).WithContext(ctx))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503: %s", rec.Code, rec.Body)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if !strings.Contains(resp.Error, context.Canceled.Error()) {
+		t.Errorf("error = %q, want the repository's %q", resp.Error, context.Canceled)
+	}
+}
+
+func TestCreateCouponReportsEveryInvalidField(t *testing.T) {
+	// Binding fails before the service is reached, so none is needed
+	router := gin.New()
+	router.POST("/admin/coupons", NewHandler(nil).CreateCoupon)
+
+	body := `{
+		"expiry_date": "2030-01-01T00:00:00Z",
+		"usage_type": "forever",
+		"discount_type": "percentage",
+		"max_usage_per_user": 0,
+		"rollout_percentage": 150,
+		"min_order_tiers": [{"min_prior_orders": -1, "min_order_value": "100"}],
+		"valid_time_window": {
+			"start_time": "2030-01-01T18:00:00Z",
+			"end_time": "2030-01-01T09:00:00Z"
+		}
+	}`
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/coupons", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+
+	got := make(map[string]string, len(resp.Fields))
+	for _, f := range resp.Fields {
+		got[f.Field] = f.Rule
+	}
+	want := map[string]string{
+		"code":                                "required",
+		"usage_type":                          "oneof",
+		"max_usage_per_user":                  "required",
+		"rollout_percentage":                  "lte",
+		"min_order_tiers[0].min_prior_orders": "gte",
+		"valid_time_window.end_time":          "gtfield",
+	}
+	for field, rule := range want {
+		if got[field] != rule {
+			t.Errorf("field %s: rule = %q, want %q", field, got[field], rule)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d invalid fields, want %d: %v", len(got), len(want), resp.Fields)
+	}
+}
+
+func TestGenerateCouponsReportsTemplateFields(t *testing.T) {
+	router := gin.New()
+	router.POST("/admin/coupons/generate", NewHandler(nil).GenerateCoupons)
+
+	body := `{
+		"count": 0,
+		"length": 8,
+		"expiry_date": "2030-01-01T00:00:00Z",
+		"usage_type": "forever",
+		"discount_type": "percentage",
+		"max_usage_per_user": 1,
+		"valid_time_window": {
+			"start_time": "2030-01-01T18:00:00Z",
+			"end_time": "2030-01-01T09:00:00Z"
+		}
+	}`
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/coupons/generate", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+
+	var got []string
+	for _, f := range resp.Fields {
+		got = append(got, f.Field)
+	}
+	// Fields of the embedded CouponTemplate are reported without its name
+	if want := []string{"count", "usage_type", "valid_time_window.end_time"}; !slices.Equal(got, want) {
+		t.Errorf("invalid fields = %v, want %v", got, want)
+	}
+}
+
+func TestCartChecks(t *testing.T) {
+	// Every check runs before the service is reached, so none is needed
+	handler := NewHandler(nil)
+	handler.SetMaxCartItems(2)
+	router := gin.New()
+	router.POST("/coupons/applicable", handler.GetApplicableCoupons)
+	router.POST("/coupons/best", handler.GetBestCoupon)
+	router.POST("/coupons/validate", handler.ValidateCoupon)
+	router.POST("/coupons/preview", handler.PreviewCoupon)
+
+	item := func(price string, quantity int) string {
+		return fmt.Sprintf(`{"id": %q, "price": %q, "quantity": %d}`, uuid.New(), price, quantity)
+	}
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{"negative order total", `"order_total": "-1", "cart_items": [` + item("10", 1) + `]`, http.StatusBadRequest, "order_total must not be negative"},
+		{"negative taxes", `"order_total": "10", "taxes": "-1", "cart_items": [` + item("10", 1) + `]`, http.StatusBadRequest, "taxes must not be negative"},
+		{"too many items", `"order_total": "30", "cart_items": [` + item("10", 1) + `,` + item("10", 1) + `,` + item("10", 1) + `]`, http.StatusRequestEntityTooLarge, "cart_items may contain at most 2 items"},
+		{"missing item id", `"order_total": "10", "cart_items": [{"price": "10", "quantity": 1}]`, http.StatusBadRequest, "invalid request"},
+		{"negative price", `"order_total": "10", "cart_items": [` + item("-10", 1) + `]`, http.StatusUnprocessableEntity, "cart_items[0]: price must not be negative"},
+		{"negative quantity", `"order_total": "10", "cart_items": [` + item("10", -1) + `]`, http.StatusUnprocessableEntity, "cart_items[0]: quantity must not be negative"},
+	}
+	for _, route := range []string{"/coupons/applicable", "/coupons/best", "/coupons/validate", "/coupons/preview"} {
+		for _, tt := range tests {
+			t.Run(route+"/"+tt.name, func(t *testing.T) {
+				body := `{"coupon_code": "SAVE10", ` + tt.body + `}`
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, route, strings.NewReader(body)))
+				if rec.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+				}
+				var resp ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("decode response: %v", err)
+				}
+				if resp.Error != tt.wantError {
+					t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+				}
+			})
+		}
+	}
+}
+
+// importRequest is a multipart upload of csv as the coupon import file.
+func importRequest(t *testing.T, csv string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile("file", "coupons.csv")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	file.Write([]byte(csv))
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/coupons/import", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func TestImportCouponsRejectsBadHeader(t *testing.T) {
+	// The header is checked before any row reaches the service
+	router := gin.New()
+	router.POST("/admin/coupons/import", NewHandler(service.NewCouponService(nil, nil)).ImportCoupons)
+
+	tests := []struct {
+		name      string
+		csv       string
+		wantError string
+	}{
+		{"unknown column", "code,colour\nSAVE10,red\n", `unknown column "colour"`},
+		{"duplicate column", "code,Code\nSAVE10,SAVE10\n", `duplicate column "code"`},
+		{"empty file", "", "import file is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, importRequest(t, tt.csv))
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body)
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if resp.Error != tt.wantError {
+				t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestImportCoupons(t *testing.T) {
+	repo := repository.NewCouponRepository(testdb.Open(t))
+	router := gin.New()
+	router.POST("/admin/coupons/import", NewHandler(service.NewCouponService(repo, nil)).ImportCoupons)
+
+	expiry := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	csv := "code,expiry_date,usage_type,discount_type,discount_value,max_usage_per_user\n" +
+		"GOOD10," + expiry + ",multi_use,percentage,10,1\n" +
+		"SHORT," + expiry + ",multi_use\n" +
+		"BADTYPE," + expiry + ",multi_use,bogus,10,0\n" +
+		"GOOD10," + expiry + ",multi_use,percentage,10,1\n"
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, importRequest(t, csv))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var resp ImportCouponsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Imported != 1 || resp.Failed != 3 || len(resp.Results) != 4 {
+		t.Fatalf("imported %d, failed %d, %d results; want 1, 3, 4", resp.Imported, resp.Failed, len(resp.Results))
+	}
+
+	tests := []struct {
+		line       int
+		wantError  string
+		wantFields []string
+	}{
+		{2, "", nil},
+		{3, "wrong number of fields", nil},
+		{4, "invalid request", []string{"discount_type", "max_usage_per_user"}},
+		{5, "appears earlier in the import", nil},
+	}
+	for i, tt := range tests {
+		got := resp.Results[i]
+		if got.Line != tt.line {
+			t.Errorf("result %d is for line %d, want %d", i, got.Line, tt.line)
+		}
+		if tt.wantError == "" {
+			if got.Error != "" || got.CouponID == nil {
+				t.Errorf("line %d: error %q, coupon %v; want it imported", tt.line, got.Error, got.CouponID)
+			}
+			continue
+		}
+		if !strings.Contains(got.Error, tt.wantError) {
+			t.Errorf("line %d: error %q, want it to mention %q", tt.line, got.Error, tt.wantError)
+		}
+		var fields []string
+		for _, f := range got.Fields {
+			fields = append(fields, f.Field)
+		}
+		if !slices.Equal(fields, tt.wantFields) {
+			t.Errorf("line %d: failing fields %v, want %v", tt.line, fields, tt.wantFields)
+		}
+	}
+}
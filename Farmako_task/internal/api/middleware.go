@@ -0,0 +1,281 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"coupon-system/internal/auth"
+	"coupon-system/internal/featureflag"
+	"coupon-system/internal/idempotency"
+	"coupon-system/internal/logging"
+	"coupon-system/internal/repository"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RequestIDHeader carries the correlation ID between clients and the server.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID propagates the caller's X-Request-ID, or generates one, stores it
+// in the request context for logging, and echoes it in the response.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" {
+			id = uuid.NewString()
+		}
+
+		c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), id))
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// RequestLogger writes one structured log line per request, tagged with the
+// request ID set by RequestID.
+func RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		logging.FromContext(c.Request.Context()).Info("request",
+			"method", c.Request.Method,
+			"path", c.FullPath(),
+			"status", c.Writer.Status(),
+			"latency_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
+
+// Authenticate verifies the bearer token in the Authorization header and
+// stores its user ID (a uuid.UUID) and role in the context as user_id and
+// role. Requests without the header continue anonymously, leaving handlers
+// that need a user to answer 401; a header with a bad or expired token is
+// rejected with 401 outright.
+func Authenticate(tokens *auth.Tokens) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if header == "" {
+			c.Next()
+			return
+		}
+
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "authorization header must be a bearer token"})
+			return
+		}
+		claims, err := tokens.Verify(strings.TrimSpace(token), time.Now())
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		c.Set("user_id", claims.UserID)
+		c.Set("role", claims.Role)
+		c.Next()
+	}
+}
+
+// AdminRole is the role claim that grants access to the admin API.
+const AdminRole = "admin"
+
+// AdminOnly restricts a route to admins. It reads the user_id and role set by
+// Authenticate, so it must run after it: requests without a user get 401 and
+// users without AdminRole 403.
+func AdminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("user_id"); !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "user not authenticated"})
+			return
+		}
+		if c.GetString("role") != AdminRole {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Error: "admin role required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// AuditActor attributes coupon mutations made by the request to the
+// authenticated user, when there is one, in the audit log.
+func AuditActor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if userID, ok := c.Get("user_id"); ok {
+			if id, ok := userID.(uuid.UUID); ok {
+				c.Request = c.Request.WithContext(repository.WithActor(c.Request.Context(), id))
+			}
+		}
+		c.Next()
+	}
+}
+
+// RequestTimeout bounds each request's context by timeout. Repository calls
+// run with that context, so a slow query is cancelled instead of holding the
+// request open indefinitely.
+func RequestTimeout(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// serverErrorStatus maps an unexpected error to an HTTP status: 504 when the
+// request ran out of time (see RequestTimeout), 503 when it was cancelled
+// before the work could finish, and 500 for anything else.
+func serverErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// LimitBody caps request bodies at maxBytes so an oversized payload cannot
+// exhaust memory while it is bound. Requests declaring a larger
+// Content-Length are rejected with 413 before any handler runs; a body that
+// only turns out larger while streaming fails to bind.
+func LimitBody(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > maxBytes {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: fmt.Sprintf("request body exceeds %d bytes", maxBytes)})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		c.Next()
+	}
+}
+
+// FeatureGate rejects requests with 503 and a Retry-After header while the
+// named feature is disabled, letting operators shed load from expensive
+// endpoints during incidents.
+func FeatureGate(flags *featureflag.Store, name string, retryAfter time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if flags.IsDisabled(c.Request.Context(), name) {
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, ErrorResponse{Error: "endpoint temporarily disabled"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ObserveLatency records the duration of each request in seconds.
+func ObserveLatency(observer prometheus.Observer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		observer.Observe(time.Since(start).Seconds())
+	}
+}
+
+// IdempotencyKeyHeader lets clients safely retry non-idempotent requests.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Idempotency replays the original response for requests that repeat an
+// Idempotency-Key header, so retries never execute the handler twice. Keys
+// are scoped per authenticated user, and bound to a hash of the first
+// request's body: reusing a key with a different body is rejected with 422
+// rather than answered with another request's response. Server errors are
+// not recorded, leaving the key free for a retry. Requests without the header
+// pass through, as do all requests when the store is unreachable or nil.
+func Idempotency(store *idempotency.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" || store == nil {
+			c.Next()
+			return
+		}
+		if userID, ok := c.Get("user_id"); ok {
+			key = fmt.Sprintf("%v:%s", userID, key)
+		}
+		key = c.FullPath() + ":" + key
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(sum[:])
+
+		ctx := c.Request.Context()
+		recorded, err := store.Begin(ctx, key, fingerprint)
+		switch {
+		case errors.Is(err, idempotency.ErrKeyReused):
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error()})
+			return
+		case errors.Is(err, idempotency.ErrInProgress):
+			c.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+			return
+		case err != nil:
+			logging.FromContext(ctx).Warn("idempotency store unavailable", "error", err)
+			c.Next()
+			return
+		case recorded != nil:
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(recorded.Status, recorded.ContentType, recorded.Body)
+			c.Abort()
+			return
+		}
+
+		w := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		if w.Status() >= http.StatusInternalServerError {
+			if err := store.Release(ctx, key); err != nil {
+				logging.FromContext(ctx).Warn("failed to release idempotency key", "error", err)
+			}
+			return
+		}
+		resp := idempotency.Response{
+			Status:      w.Status(),
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        w.body.Bytes(),
+			Fingerprint: fingerprint,
+		}
+		if err := store.Complete(ctx, key, resp); err != nil {
+			logging.FromContext(ctx).Warn("failed to record idempotent response", "error", err)
+		}
+	}
+}
+
+// recordingWriter tees the response body so it can be stored.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"coupon-system/internal/auth"
+	"coupon-system/internal/featureflag"
+	"coupon-system/internal/idempotency"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func newTestIdempotencyStore(t *testing.T) *idempotency.Store {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return idempotency.NewStore(client)
+}
+
+func TestIdempotency(t *testing.T) {
+	// The handler stands in for redeem: every call records one usage
+	var usages int
+	router := gin.New()
+	router.POST("/redeem", Idempotency(newTestIdempotencyStore(t)), func(c *gin.Context) {
+		usages++
+		c.JSON(http.StatusOK, gin.H{"usages": usages})
+	})
+
+	tests := []struct {
+		name         string
+		key          string
+		body         string
+		wantStatus   int
+		wantBody     string
+		wantReplayed bool
+		wantUsages   int
+	}{
+		{"first request runs", "k1", `{"order_id":"a"}`, http.StatusOK, `{"usages":1}`, false, 1},
+		{"retry replays the first response", "k1", `{"order_id":"a"}`, http.StatusOK, `{"usages":1}`, true, 1},
+		{"reused key with another body is rejected", "k1", `{"order_id":"b"}`, http.StatusUnprocessableEntity, "", false, 1},
+		{"new key runs", "k2", `{"order_id":"b"}`, http.StatusOK, `{"usages":2}`, false, 2},
+		{"no key always runs", "", `{"order_id":"b"}`, http.StatusOK, `{"usages":3}`, false, 3},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/redeem", strings.NewReader(tt.body))
+		if tt.key != "" {
+			req.Header.Set(IdempotencyKeyHeader, tt.key)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.wantStatus)
+		}
+		if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+			t.Errorf("%s: body %s, want %s", tt.name, rec.Body.String(), tt.wantBody)
+		}
+		if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplayed {
+			t.Errorf("%s: replayed = %v, want %v", tt.name, replayed, tt.wantReplayed)
+		}
+		if usages != tt.wantUsages {
+			t.Errorf("%s: %d usages recorded, want %d", tt.name, usages, tt.wantUsages)
+		}
+	}
+}
+
+func TestAdminOnly(t *testing.T) {
+	tokens, err := auth.NewTokens([]byte(strings.Repeat("s", auth.MinSecretBytes)))
+	if err != nil {
+		t.Fatalf("NewTokens: %v", err)
+	}
+	issue := func(role string, ttl time.Duration) string {
+		token, err := tokens.Issue(auth.Claims{UserID: uuid.New(), Role: role, ExpiresAt: time.Now().Add(ttl)})
+		if err != nil {
+			t.Fatalf("Issue: %v", err)
+		}
+		return "Bearer " + token
+	}
+
+	router := gin.New()
+	router.Use(Authenticate(tokens))
+	router.GET("/admin/ping", AdminOnly(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{"admin gets through", issue(AdminRole, time.Hour), http.StatusOK},
+		{"other role is forbidden", issue("customer", time.Hour), http.StatusForbidden},
+		{"no token", "", http.StatusUnauthorized},
+		{"expired token", issue(AdminRole, -time.Minute), http.StatusUnauthorized},
+		{"garbage token", "Bearer not-a-token", http.StatusUnauthorized},
+		{"not a bearer token", "Basic YWRtaW46YWRtaW4=", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/ping", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		timeout    time.Duration
+		wantErr    error
+		wantStatus int
+	}{
+		{"client already gone", cancelled, time.Minute, context.Canceled, http.StatusServiceUnavailable},
+		{"deadline passes", context.Background(), time.Millisecond, context.DeadlineExceeded, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen error
+			router := gin.New()
+			router.GET("/slow", RequestTimeout(tt.timeout), func(c *gin.Context) {
+				ctx := c.Request.Context()
+				<-ctx.Done()
+				seen = ctx.Err()
+				c.JSON(serverErrorStatus(seen), ErrorResponse{Error: seen.Error()})
+			})
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(tt.ctx))
+			if !errors.Is(seen, tt.wantErr) {
+				t.Errorf("handler saw %v, want %v", seen, tt.wantErr)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestFeatureGate(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	newRouter := func(flags *featureflag.Store) *gin.Engine {
+		router := gin.New()
+		router.POST("/coupons/best", FeatureGate(flags, featureflag.ApplicableCoupons, 30*time.Second), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		return router
+	}
+	call := func(router *gin.Engine) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/coupons/best", nil))
+		return rec
+	}
+	wantDisabled := func(t *testing.T, rec *httptest.ResponseRecorder) {
+		t.Helper()
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want 503", rec.Code)
+		}
+		if got := rec.Header().Get("Retry-After"); got != "30" {
+			t.Errorf("Retry-After = %q, want 30", got)
+		}
+		if !strings.Contains(rec.Body.String(), "endpoint temporarily disabled") {
+			t.Errorf("body = %s", rec.Body)
+		}
+	}
+
+	router := newRouter(featureflag.NewStore(client))
+	if rec := call(router); rec.Code != http.StatusOK {
+		t.Fatalf("enabled: status = %d, want 200", rec.Code)
+	}
+
+	t.Setenv("FEATURE_DISABLE_APPLICABLE_COUPONS", "true")
+	wantDisabled(t, call(router))
+
+	t.Setenv("FEATURE_DISABLE_APPLICABLE_COUPONS", "")
+	if rec := call(router); rec.Code != http.StatusOK {
+		t.Fatalf("re-enabled: status = %d, want 200", rec.Code)
+	}
+
+	// The Redis key disables the feature at runtime, without a restart
+	server.Set("feature:disabled:"+featureflag.ApplicableCoupons, "1")
+	wantDisabled(t, call(newRouter(featureflag.NewStore(client))))
+}
@@ -0,0 +1,137 @@
+// Package auth issues and verifies the bearer tokens that identify API users.
+//
+// Tokens are HS256-signed JWTs whose subject is the user's ID and whose role
+// claim grants access to the admin API. Only HS256 is accepted: a token
+// naming any other algorithm, "none" included, is rejected.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MinSecretBytes is the shortest signing secret accepted, matching the
+// output size of SHA-256.
+const MinSecretBytes = 32
+
+var (
+	// ErrInvalidToken is returned by Verify for malformed tokens and tokens
+	// with a bad signature or claims.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired is returned by Verify for tokens past their expiry.
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Claims identifies the user a token was issued to.
+type Claims struct {
+	UserID    uuid.UUID
+	Role      string
+	ExpiresAt time.Time
+}
+
+// header is the only JOSE header Verify accepts.
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// payload is the JWT claim set; exp is in seconds since the epoch.
+type payload struct {
+	Sub  string `json:"sub"`
+	Role string `json:"role,omitempty"`
+	Exp  int64  `json:"exp"`
+}
+
+// Tokens signs and verifies tokens with a shared secret.
+type Tokens struct {
+	secret []byte
+}
+
+// NewTokens returns a Tokens signing with secret, which must be at least
+// MinSecretBytes long.
+func NewTokens(secret []byte) (*Tokens, error) {
+	if len(secret) < MinSecretBytes {
+		return nil, errors.New("auth secret must be at least 32 bytes")
+	}
+	return &Tokens{secret: secret}, nil
+}
+
+// Issue returns a signed token carrying claims.
+func (t *Tokens) Issue(claims Claims) (string, error) {
+	h, err := json.Marshal(header{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(payload{
+		Sub:  claims.UserID.String(),
+		Role: claims.Role,
+		Exp:  claims.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := encode(h) + "." + encode(p)
+	return signed + "." + encode(t.sign(signed)), nil
+}
+
+// Verify checks token's signature and expiry at now and returns its claims.
+func (t *Tokens) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	sig, err := decode(parts[2])
+	if err != nil || !hmac.Equal(sig, t.sign(parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	if err := unmarshal(parts[0], &h); err != nil || h.Alg != "HS256" {
+		return nil, ErrInvalidToken
+	}
+	var p payload
+	if err := unmarshal(parts[1], &p); err != nil || p.Exp == 0 {
+		return nil, ErrInvalidToken
+	}
+	userID, err := uuid.Parse(p.Sub)
+	if err != nil || userID == uuid.Nil {
+		return nil, ErrInvalidToken
+	}
+
+	expiresAt := time.Unix(p.Exp, 0)
+	if !now.Before(expiresAt) {
+		return nil, ErrTokenExpired
+	}
+	return &Claims{UserID: userID, Role: p.Role, ExpiresAt: expiresAt}, nil
+}
+
+func (t *Tokens) sign(signed string) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func unmarshal(part string, v any) error {
+	b, err := decode(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
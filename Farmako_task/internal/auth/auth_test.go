@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestTokens(t *testing.T, secret string) *Tokens {
+	t.Helper()
+	tokens, err := NewTokens([]byte(secret))
+	if err != nil {
+		t.Fatalf("NewTokens: %v", err)
+	}
+	return tokens
+}
+
+func TestNewTokensRejectsShortSecret(t *testing.T) {
+	if _, err := NewTokens([]byte("short")); err == nil {
+		t.Error("NewTokens accepted a 5 byte secret")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tokens := newTestTokens(t, strings.Repeat("s", MinSecretBytes))
+	other := newTestTokens(t, strings.Repeat("o", MinSecretBytes))
+	now := time.Unix(1_700_000_000, 0)
+	userID := uuid.New()
+
+	valid, err := tokens.Issue(Claims{UserID: userID, Role: "admin", ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	expired, _ := tokens.Issue(Claims{UserID: userID, ExpiresAt: now})
+	foreign, _ := other.Issue(Claims{UserID: userID, Role: "admin", ExpiresAt: now.Add(time.Hour)})
+	parts := strings.Split(valid, ".")
+	unsigned := encode([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", valid, nil},
+		{"expired", expired, ErrTokenExpired},
+		{"signed with another secret", foreign, ErrInvalidToken},
+		{"alg none", unsigned, ErrInvalidToken},
+		{"tampered payload", parts[0] + "." + encode([]byte(`{"sub":"`+userID.String()+`","role":"admin","exp":9999999999}`)) + "." + parts[2], ErrInvalidToken},
+		{"malformed", "not-a-token", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := tokens.Verify(tt.token, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if claims.UserID != userID || claims.Role != "admin" {
+				t.Errorf("Verify() = %+v, want user %s with role admin", claims, userID)
+			}
+		})
+	}
+}
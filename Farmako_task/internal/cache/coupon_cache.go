@@ -0,0 +1,298 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"coupon-system/internal/logging"
+	"coupon-system/internal/metrics"
+	"coupon-system/internal/models"
+	"coupon-system/internal/retry"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// applicableVersionKey is bumped on every coupon mutation. It is part of
+	// every applicable-coupons and preview key, so bumping it orphans all
+	// cached results at once; orphans then age out via their TTL.
+	applicableVersionKey = "coupons:applicable:version"
+	applicableKeyPrefix  = "coupons:applicable:"
+	previewKeyPrefix     = "coupons:preview:"
+
+	// DefaultApplicableTTL is how long applicable-coupon results are cached
+	// unless SetApplicableTTL overrides it.
+	DefaultApplicableTTL = 60 * time.Second
+
+	// DefaultPreviewTTL is how long preview results are cached unless
+	// SetPreviewTTL overrides it. It is short because a preview also depends
+	// on how often the coupon has been redeemed, which does not invalidate
+	// the cache.
+	DefaultPreviewTTL = 10 * time.Second
+
+	// outageBackoff is how long the cache stops calling Redis after a
+	// connection failure, so an outage costs one failed call per window
+	// instead of one per request.
+	outageBackoff = 10 * time.Second
+)
+
+// OrderTotalBucket is the granularity at which order totals share a cache
+// entry.
+var OrderTotalBucket = decimal.NewFromInt(100)
+
+// CouponCache caches coupon lookups in Redis. A nil *CouponCache is valid and
+// behaves as a cache that always misses. Redis failures are logged and
+// treated as misses so the database remains the source of truth; after a
+// connection failure reads and writes skip Redis for outageBackoff.
+type CouponCache struct {
+	redis         *redis.Client
+	applicableTTL time.Duration
+	previewTTL    time.Duration
+
+	// skipUntil is the UnixNano time before which Redis is not called.
+	skipUntil atomic.Int64
+}
+
+// NewCouponCache returns a cache backed by redisClient, or a nil (always
+// missing) cache when redisClient is nil.
+func NewCouponCache(redisClient *redis.Client) *CouponCache {
+	if redisClient == nil {
+		return nil
+	}
+	return &CouponCache{
+		redis:         redisClient,
+		applicableTTL: DefaultApplicableTTL,
+		previewTTL:    DefaultPreviewTTL,
+	}
+}
+
+// SetApplicableTTL overrides how long applicable-coupon results are cached.
+func (c *CouponCache) SetApplicableTTL(ttl time.Duration) {
+	if c != nil && ttl > 0 {
+		c.applicableTTL = ttl
+	}
+}
+
+// SetPreviewTTL overrides how long preview results are cached.
+func (c *CouponCache) SetPreviewTTL(ttl time.Duration) {
+	if c != nil && ttl > 0 {
+		c.previewTTL = ttl
+	}
+}
+
+// BucketCeiling returns the upper bound of the order-total bucket containing
+// orderTotal. Cached applicable-coupon sets are computed for the whole
+// bucket, so callers must still drop coupons whose minimum or maximum order
+// value excludes the exact total.
+func BucketCeiling(orderTotal decimal.Decimal) decimal.Decimal {
+	return orderTotal.Div(OrderTotalBucket).Floor().Add(decimal.NewFromInt(1)).Mul(OrderTotalBucket)
+}
+
+// BucketFloor returns the lower bound of the order-total bucket containing
+// orderTotal.
+func BucketFloor(orderTotal decimal.Decimal) decimal.Decimal {
+	return orderTotal.Div(OrderTotalBucket).Floor().Mul(OrderTotalBucket)
+}
+
+// GetApplicable returns the cached applicable coupons for the user, cart and
+// bucket of orderTotal.
+func (c *CouponCache) GetApplicable(ctx context.Context, userID uuid.UUID, cartItems []models.Medicine, orderTotal decimal.Decimal) (coupons []models.Coupon, hit bool) {
+	if c != nil {
+		defer func() {
+			result := metrics.CacheMiss
+			if hit {
+				result = metrics.CacheHit
+			}
+			metrics.CacheLookups.WithLabelValues(result).Inc()
+		}()
+	}
+
+	if !c.available() {
+		return nil, false
+	}
+
+	key, err := c.applicableKey(ctx, userID, cartItems, orderTotal)
+	if err != nil {
+		c.failed(ctx, "coupon cache unavailable", err)
+		return nil, false
+	}
+
+	var data []byte
+	err = retry.Do(ctx, func() error {
+		var err error
+		data, err = c.redis.Get(ctx, key).Bytes()
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			c.failed(ctx, "coupon cache read failed", err)
+		}
+		return nil, false
+	}
+
+	if err := json.Unmarshal(data, &coupons); err != nil {
+		logging.FromContext(ctx).Warn("coupon cache entry corrupt", "key", key, "error", err)
+		return nil, false
+	}
+	return coupons, true
+}
+
+// SetApplicable stores the applicable coupons for the user, cart and bucket of
+// orderTotal.
+func (c *CouponCache) SetApplicable(ctx context.Context, userID uuid.UUID, cartItems []models.Medicine, orderTotal decimal.Decimal, coupons []models.Coupon) {
+	if !c.available() {
+		return
+	}
+
+	key, err := c.applicableKey(ctx, userID, cartItems, orderTotal)
+	if err != nil {
+		c.failed(ctx, "coupon cache unavailable", err)
+		return
+	}
+
+	data, err := json.Marshal(coupons)
+	if err != nil {
+		return
+	}
+	if err := c.redis.Set(ctx, key, data, c.applicableTTL).Err(); err != nil {
+		c.failed(ctx, "coupon cache write failed", err)
+	}
+}
+
+// GetPreview decodes the cached preview of coupon code for the request
+// identified by signature into result, and reports whether there was one.
+func (c *CouponCache) GetPreview(ctx context.Context, code, signature string, result interface{}) bool {
+	if !c.available() {
+		return false
+	}
+
+	key, err := c.previewKey(ctx, code, signature)
+	if err != nil {
+		c.failed(ctx, "coupon cache unavailable", err)
+		return false
+	}
+
+	var data []byte
+	err = retry.Do(ctx, func() error {
+		var err error
+		data, err = c.redis.Get(ctx, key).Bytes()
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			c.failed(ctx, "coupon cache read failed", err)
+		}
+		return false
+	}
+
+	if err := json.Unmarshal(data, result); err != nil {
+		logging.FromContext(ctx).Warn("coupon cache entry corrupt", "key", key, "error", err)
+		return false
+	}
+	return true
+}
+
+// SetPreview stores the preview of coupon code for the request identified by
+// signature. Only store results that no redemption by the caller can change:
+// previews, never a validation for a known user.
+func (c *CouponCache) SetPreview(ctx context.Context, code, signature string, result interface{}) {
+	if !c.available() {
+		return
+	}
+
+	key, err := c.previewKey(ctx, code, signature)
+	if err != nil {
+		c.failed(ctx, "coupon cache unavailable", err)
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	if err := c.redis.Set(ctx, key, data, c.previewTTL).Err(); err != nil {
+		c.failed(ctx, "coupon cache write failed", err)
+	}
+}
+
+// InvalidateApplicable discards every cached applicable-coupons and preview
+// result. Call it after any coupon is created, updated or deleted. It always
+// tries Redis, even while reads are being skipped, so a recovering Redis does
+// not serve results cached before the change.
+func (c *CouponCache) InvalidateApplicable(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	if err := c.redis.Incr(ctx, applicableVersionKey).Err(); err != nil {
+		logging.FromContext(ctx).Warn("coupon cache invalidation failed", "error", err)
+	}
+}
+
+// available reports whether Redis should be called: the cache is configured
+// and not backing off after a connection failure.
+func (c *CouponCache) available() bool {
+	return c != nil && time.Now().UnixNano() >= c.skipUntil.Load()
+}
+
+// failed logs a Redis error and, if it looks like a connection problem,
+// skips Redis for outageBackoff.
+func (c *CouponCache) failed(ctx context.Context, msg string, err error) {
+	logging.FromContext(ctx).Warn(msg, "error", err)
+	if retry.IsTransient(err) {
+		c.skipUntil.Store(time.Now().Add(outageBackoff).UnixNano())
+	}
+}
+
+func (c *CouponCache) applicableKey(ctx context.Context, userID uuid.UUID, cartItems []models.Medicine, orderTotal decimal.Decimal) (string, error) {
+	version, err := c.version(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d:%s:%s:%s", applicableKeyPrefix, version, userID, CartSignature(cartItems), BucketCeiling(orderTotal).StringFixed(2)), nil
+}
+
+func (c *CouponCache) previewKey(ctx context.Context, code, signature string) (string, error) {
+	version, err := c.version(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d:%s:%s", previewKeyPrefix, version, code, signature), nil
+}
+
+// version returns the current value of applicableVersionKey, which is zero
+// until the first mutation.
+func (c *CouponCache) version(ctx context.Context) (int64, error) {
+	var version int64
+	err := retry.Do(ctx, func() error {
+		var err error
+		version, err = c.redis.Get(ctx, applicableVersionKey).Int64()
+		return err
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+	return version, nil
+}
+
+// CartSignature hashes the medicines in a cart, together with the category
+// each was submitted under, into a key that does not depend on item order.
+func CartSignature(cartItems []models.Medicine) string {
+	parts := make([]string, len(cartItems))
+	for i, item := range cartItems {
+		parts[i] = item.ID.String() + "|" + item.Category
+	}
+	sort.Strings(parts)
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
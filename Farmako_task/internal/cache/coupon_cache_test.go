@@ -0,0 +1,202 @@
+package cache
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"coupon-system/internal/models"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/shopspring/decimal"
+)
+
+func newTestCache(t *testing.T) *CouponCache {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewCouponCache(client)
+}
+
+type preview struct {
+	Discount string
+}
+
+func TestPreviewCache(t *testing.T) {
+	c := newTestCache(t)
+	ctx := context.Background()
+
+	var got preview
+	if c.GetPreview(ctx, "SAVE10", "cart", &got) {
+		t.Fatal("hit before anything was cached")
+	}
+
+	c.SetPreview(ctx, "SAVE10", "cart", preview{Discount: "30"})
+	tests := []struct {
+		name    string
+		code    string
+		sig     string
+		wantHit bool
+	}{
+		{"same code and cart", "SAVE10", "cart", true},
+		{"another cart", "SAVE10", "other", false},
+		{"another code", "SAVE20", "cart", false},
+	}
+	for _, tt := range tests {
+		got = preview{}
+		if hit := c.GetPreview(ctx, tt.code, tt.sig, &got); hit != tt.wantHit {
+			t.Errorf("%s: hit = %v, want %v", tt.name, hit, tt.wantHit)
+		}
+		if tt.wantHit && got.Discount != "30" {
+			t.Errorf("%s: cached discount = %q, want 30", tt.name, got.Discount)
+		}
+	}
+
+	c.InvalidateApplicable(ctx)
+	if c.GetPreview(ctx, "SAVE10", "cart", &got) {
+		t.Error("hit after invalidation")
+	}
+}
+
+func TestNilCacheAlwaysMisses(t *testing.T) {
+	c := NewCouponCache(nil)
+	if c != nil {
+		t.Fatal("NewCouponCache(nil) returned a non-nil cache")
+	}
+	ctx := context.Background()
+	userID := uuid.New()
+	total := decimal.NewFromInt(250)
+
+	c.SetApplicableTTL(time.Minute)
+	c.SetPreviewTTL(time.Minute)
+	c.SetPreview(ctx, "SAVE10", "cart", preview{Discount: "30"})
+	var got preview
+	if c.GetPreview(ctx, "SAVE10", "cart", &got) {
+		t.Error("nil cache reported a preview hit")
+	}
+	c.SetApplicable(ctx, userID, nil, total, []models.Coupon{{Code: "SAVE10"}})
+	if _, hit := c.GetApplicable(ctx, userID, nil, total); hit {
+		t.Error("nil cache reported an applicable hit")
+	}
+	c.InvalidateApplicable(ctx)
+}
+
+// commandCounter is a redis.Hook that counts the commands sent to Redis.
+type commandCounter struct {
+	atomic.Int64
+}
+
+func (h *commandCounter) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *commandCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (h *commandCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// newUnreachableCache returns a cache whose Redis address refuses
+// connections, and a count of the commands it has tried to send.
+func newUnreachableCache(t *testing.T) (*CouponCache, *commandCounter) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	commands := new(commandCounter)
+	client.AddHook(commands)
+	return NewCouponCache(client), commands
+}
+
+func TestCacheSkipsRedisDuringOutage(t *testing.T) {
+	c, commands := newUnreachableCache(t)
+	ctx := context.Background()
+	userID := uuid.New()
+	total := decimal.NewFromInt(250)
+
+	if _, hit := c.GetApplicable(ctx, userID, nil, total); hit {
+		t.Fatal("hit with Redis down")
+	}
+	if commands.Load() == 0 {
+		t.Fatal("first lookup did not call Redis")
+	}
+	if c.available() {
+		t.Fatal("cache still calls Redis after a connection failure")
+	}
+
+	// Within outageBackoff every read and write misses without calling Redis
+	before := commands.Load()
+	var got preview
+	if c.GetPreview(ctx, "SAVE10", "cart", &got) {
+		t.Error("preview hit with Redis down")
+	}
+	if _, hit := c.GetApplicable(ctx, userID, nil, total); hit {
+		t.Error("applicable hit with Redis down")
+	}
+	c.SetPreview(ctx, "SAVE10", "cart", preview{Discount: "30"})
+	c.SetApplicable(ctx, userID, nil, total, []models.Coupon{{Code: "SAVE10"}})
+	if n := commands.Load() - before; n != 0 {
+		t.Errorf("%d Redis commands during the backoff, want 0", n)
+	}
+
+	// Invalidation is the exception: it always tries Redis
+	c.InvalidateApplicable(ctx)
+	if commands.Load() == before {
+		t.Error("invalidation skipped Redis during the backoff")
+	}
+
+	// Once the backoff has passed, lookups try Redis again
+	c.skipUntil.Store(time.Now().Add(-time.Second).UnixNano())
+	before = commands.Load()
+	c.GetPreview(ctx, "SAVE10", "cart", &got)
+	if commands.Load() == before {
+		t.Error("lookup after the backoff did not call Redis")
+	}
+}
+
+func TestCartSignature(t *testing.T) {
+	paracetamol := models.Medicine{ID: uuid.New(), Category: "painkiller", Price: decimal.NewFromInt(40)}
+	cetirizine := models.Medicine{ID: uuid.New(), Category: "allergy", Price: decimal.NewFromInt(25)}
+	cart := []models.Medicine{paracetamol, cetirizine}
+
+	recategorized := cetirizine
+	recategorized.Category = "antihistamine"
+	repriced := paracetamol
+	repriced.Price = decimal.NewFromInt(45)
+	repriced.Quantity = 3
+
+	tests := []struct {
+		name     string
+		other    []models.Medicine
+		wantSame bool
+	}{
+		{"same cart", []models.Medicine{paracetamol, cetirizine}, true},
+		{"items in another order", []models.Medicine{cetirizine, paracetamol}, true},
+		{"price and quantity do not pick coupons", []models.Medicine{repriced, cetirizine}, true},
+		{"item in another category", []models.Medicine{paracetamol, recategorized}, false},
+		{"item removed", []models.Medicine{paracetamol}, false},
+		{"item added", []models.Medicine{paracetamol, cetirizine, {ID: uuid.New(), Category: "vitamins"}}, false},
+	}
+	want := CartSignature(cart)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := CartSignature(tt.other) == want; same != tt.wantSame {
+				t.Errorf("same signature = %v, want %v", same, tt.wantSame)
+			}
+		})
+	}
+}
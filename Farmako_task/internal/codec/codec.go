@@ -0,0 +1,79 @@
+// Package codec encodes coupon codes with a trailing check character so that
+// mistyped printed codes can be rejected without a database lookup.
+//
+// The check character is a weighted sum mod N over Alphabet, doubling every
+// other character as in the Luhn algorithm. N is 31, a prime, so doubling
+// permutes the values mod N and the check catches every single-character
+// substitution and every transposition of adjacent characters. (Luhn mod N's
+// digit folding only keeps doubling a permutation for even N.) Characters
+// outside Alphabet, such as separators or a campaign prefix containing 0, O,
+// 1, I or L, are not covered by the check and are skipped.
+package codec
+
+import (
+	"errors"
+	"strings"
+)
+
+// Alphabet is the set of characters covered by the check. It matches the
+// default charset of generated coupon codes.
+const Alphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// ErrNoPayload is returned by Encode when payload has no character from
+// Alphabet to compute a check over.
+var ErrNoPayload = errors.New("code has no characters to check")
+
+// Encode returns payload with its check character appended.
+func Encode(payload string) (string, error) {
+	check, ok := checkChar(payload)
+	if !ok {
+		return "", ErrNoPayload
+	}
+	return payload + string(check), nil
+}
+
+// Validate reports whether code ends in the correct check character for the
+// rest of it. Codes are compared case-insensitively.
+func Validate(code string) bool {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) < 2 {
+		return false
+	}
+	check, ok := checkChar(code[:len(code)-1])
+	return ok && code[len(code)-1] == check
+}
+
+// checkChar computes the check character for payload, or false if payload has
+// no character from Alphabet.
+func checkChar(payload string) (byte, bool) {
+	n := len(Alphabet)
+	factor := 2
+	sum := 0
+	seen := false
+
+	for i := len(payload) - 1; i >= 0; i-- {
+		value := strings.IndexByte(Alphabet, upper(payload[i]))
+		if value < 0 {
+			continue
+		}
+		seen = true
+
+		sum = (sum + factor*value) % n
+		if factor == 2 {
+			factor = 1
+		} else {
+			factor = 2
+		}
+	}
+	if !seen {
+		return 0, false
+	}
+	return Alphabet[(n-sum)%n], true
+}
+
+func upper(c byte) byte {
+	if 'a' <= c && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
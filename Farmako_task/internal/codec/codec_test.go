@@ -0,0 +1,107 @@
+package codec
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+		wantErr error
+	}{
+		// Alphabet[0] has value zero, so an all-A payload checks to A
+		{"check at the start of the alphabet", "A", "AA", nil},
+		// B counts once, so the check must make up 30
+		{"check at the end of the alphabet", "BA", "BA9", nil},
+		{"separators are kept but not checked", "SUMMER-25", "SUMMER-25" + checkOf(t, "SUMMER25"), nil},
+		{"nothing to check", "-0O1IL-", "", ErrNoPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Encode(tt.payload)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Encode(%q) error = %v, want %v", tt.payload, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Encode(%q) = %q, want %q", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+func checkOf(t *testing.T, payload string) string {
+	t.Helper()
+	code, err := Encode(payload)
+	if err != nil {
+		t.Fatalf("Encode(%q): %v", payload, err)
+	}
+	return code[len(code)-1:]
+}
+
+func TestValidate(t *testing.T) {
+	valid, err := Encode("SAVE2Q24XK")
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"round trip", valid, true},
+		{"lower case", strings.ToLower(valid), true},
+		{"surrounding space", "  " + valid + " ", true},
+		{"check wrapped past the end of the alphabet", "BAA", false},
+		{"corrupted character", "SAVF2Q24XK" + valid[len(valid)-1:], false},
+		{"corrupted check", valid[:len(valid)-1] + string(next(valid[len(valid)-1])), false},
+		{"transposed characters", "SAVE22Q4XK" + valid[len(valid)-1:], false},
+		{"too short", "A", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Validate(tt.code); got != tt.want {
+				t.Errorf("Validate(%q) = %v, want %v", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+// next returns the character after c in Alphabet, wrapping around.
+func next(c byte) byte {
+	i := strings.IndexByte(Alphabet, c)
+	return Alphabet[(i+1)%len(Alphabet)]
+}
+
+func TestValidateCatchesEveryTypo(t *testing.T) {
+	code, err := Encode("SAVE2Q24XK")
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	for i := range code {
+		for j := 0; j < len(Alphabet); j++ {
+			if Alphabet[j] == code[i] {
+				continue
+			}
+			typo := code[:i] + string(Alphabet[j]) + code[i+1:]
+			if Validate(typo) {
+				t.Errorf("Validate(%q) accepted a substitution at %d", typo, i)
+			}
+		}
+	}
+	for i := 0; i+1 < len(code); i++ {
+		if code[i] == code[i+1] {
+			continue
+		}
+		swapped := code[:i] + string(code[i+1]) + string(code[i]) + code[i+2:]
+		if Validate(swapped) {
+			t.Errorf("Validate(%q) accepted a transposition at %d", swapped, i)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"coupon-system/internal/auth"
+	"coupon-system/internal/models"
+
+	"github.com/shopspring/decimal"
+)
+
+// Config is the server configuration, read once from the environment at
+// startup. Every setting but JWTSecret has a default suitable for local
+// development; see the Configuration section of the README for the variable
+// names.
+type Config struct {
+	Port              string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	RequestTimeout    time.Duration
+	MaxRequestBytes   int
+	MaxCartItems      int
+	MaxScanCartItems  int
+
+	JWTSecret string
+
+	DatabaseURL     string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	CacheEnabled     bool
+	RedisAddr        string
+	RedisDialTimeout time.Duration
+	RedisTimeout     time.Duration
+
+	ApplicableCacheTTL    time.Duration
+	PreviewCacheTTL       time.Duration
+	ExpiryCleanupInterval time.Duration
+	ActiveCouponsInterval time.Duration
+	CodeCharset           string
+	ChecksumCodes         bool
+	AllowStacking         bool
+	DiscountRounding      models.RoundingMode
+	StrictDiscountValues  bool
+	MaxFixedDiscount      decimal.Decimal
+	MaxOrderDiscountPct   decimal.Decimal
+}
+
+// Load reads the configuration from the environment. Unset variables take
+// their defaults; if any variable is set to an unusable value Load returns an
+// error naming every such variable, so a bad deploy fails at startup with the
+// whole list rather than one problem at a time.
+func Load() (*Config, error) {
+	var e env
+	cfg := &Config{
+		Port:              e.port("PORT", "8080"),
+		ReadHeaderTimeout: e.duration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       e.duration("SERVER_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:      e.duration("SERVER_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       e.duration("SERVER_IDLE_TIMEOUT", 60*time.Second),
+		RequestTimeout:    e.duration("REQUEST_TIMEOUT", 10*time.Second),
+		MaxRequestBytes:   e.int("MAX_REQUEST_BYTES", 1<<20),
+		MaxCartItems:      e.int("MAX_CART_ITEMS", 200),
+		MaxScanCartItems:  e.int("MAX_APPLICABLE_CART_ITEMS", 50),
+
+		JWTSecret: e.secret("JWT_SECRET", auth.MinSecretBytes),
+
+		DatabaseURL:     e.string("DATABASE_URL", "host=localhost user=postgres password=postgres dbname=coupon_system port=5432 sslmode=disable"),
+		MaxOpenConns:    e.int("DB_MAX_OPEN_CONNS", 25),
+		MaxIdleConns:    e.int("DB_MAX_IDLE_CONNS", 10),
+		ConnMaxLifetime: e.duration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+		ConnMaxIdleTime: e.duration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute),
+
+		CacheEnabled:     e.bool("CACHE_ENABLED", true),
+		RedisAddr:        e.string("REDIS_URL", "localhost:6379"),
+		RedisDialTimeout: e.duration("REDIS_DIAL_TIMEOUT", time.Second),
+		RedisTimeout:     e.duration("REDIS_TIMEOUT", 500*time.Millisecond),
+
+		ApplicableCacheTTL:    e.duration("APPLICABLE_CACHE_TTL", 60*time.Second),
+		PreviewCacheTTL:       e.duration("PREVIEW_CACHE_TTL", 10*time.Second),
+		ExpiryCleanupInterval: e.duration("COUPON_EXPIRY_INTERVAL", time.Hour),
+		ActiveCouponsInterval: e.duration("ACTIVE_COUPONS_INTERVAL", time.Minute),
+		CodeCharset:           e.string("COUPON_CODE_CHARSET", ""),
+		ChecksumCodes:         e.bool("CHECKSUM_CODES", false),
+		AllowStacking:         e.bool("ALLOW_COUPON_STACKING", false),
+		DiscountRounding:      e.rounding("DISCOUNT_ROUNDING", models.RoundNearest),
+		StrictDiscountValues:  e.bool("STRICT_DISCOUNT_VALUES", false),
+		MaxFixedDiscount:      e.amount("MAX_FIXED_DISCOUNT", decimal.Zero),
+		MaxOrderDiscountPct:   e.percent("MAX_ORDER_DISCOUNT_PERCENT", decimal.Zero),
+	}
+	if len(e.problems) > 0 {
+		return nil, errors.New("invalid configuration: " + strings.Join(e.problems, "; "))
+	}
+	return cfg, nil
+}
+
+// env reads typed values from the environment, collecting a problem for each
+// variable that is set but unusable.
+type env struct {
+	problems []string
+}
+
+func (e *env) invalid(name, value, want string) {
+	e.problems = append(e.problems, fmt.Sprintf("%s=%q is not %s", name, value, want))
+}
+
+func (e *env) string(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// secret reads a required secret of at least minBytes bytes. Its value is
+// never echoed in problems.
+func (e *env) secret(name string, minBytes int) string {
+	value := os.Getenv(name)
+	if len(value) < minBytes {
+		e.problems = append(e.problems, fmt.Sprintf("%s must be set to at least %d bytes", name, minBytes))
+	}
+	return value
+}
+
+func (e *env) port(name, def string) string {
+	value := e.string(name, def)
+	if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+		e.invalid(name, value, "a port number")
+	}
+	return value
+}
+
+// duration reads a positive Go duration such as "5s" or "15m".
+func (e *env) duration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		e.invalid(name, value, "a positive duration")
+		return def
+	}
+	return d
+}
+
+// int reads a positive integer.
+func (e *env) int(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		e.invalid(name, value, "a positive integer")
+		return def
+	}
+	return n
+}
+
+func (e *env) bool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.invalid(name, value, "true or false")
+		return def
+	}
+	return b
+}
+
+// amount reads a non-negative decimal amount such as "2500" or "99.50".
+func (e *env) amount(name string, def decimal.Decimal) decimal.Decimal {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := decimal.NewFromString(value)
+	if err != nil || d.IsNegative() {
+		e.invalid(name, value, "a non-negative amount")
+		return def
+	}
+	return d
+}
+
+// percent reads a percentage between 0 and 100 such as "40" or "12.5".
+func (e *env) percent(name string, def decimal.Decimal) decimal.Decimal {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := decimal.NewFromString(value)
+	if err != nil || d.IsNegative() || d.GreaterThan(decimal.NewFromInt(100)) {
+		e.invalid(name, value, "a percentage between 0 and 100")
+		return def
+	}
+	return d
+}
+
+func (e *env) rounding(name string, def models.RoundingMode) models.RoundingMode {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	mode := models.RoundingMode(value)
+	if !mode.IsValid() {
+		e.invalid(name, value, "nearest, floor or ceil")
+		return def
+	}
+	return mode
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"coupon-system/internal/models"
+
+	"github.com/shopspring/decimal"
+)
+
+// variables lists every environment variable Load reads.
+var variables = []string{
+	"PORT", "SERVER_READ_HEADER_TIMEOUT", "SERVER_READ_TIMEOUT", "SERVER_WRITE_TIMEOUT",
+	"SERVER_IDLE_TIMEOUT", "REQUEST_TIMEOUT", "MAX_REQUEST_BYTES", "MAX_CART_ITEMS",
+	"MAX_APPLICABLE_CART_ITEMS", "JWT_SECRET", "DATABASE_URL", "DB_MAX_OPEN_CONNS",
+	"DB_MAX_IDLE_CONNS", "DB_CONN_MAX_LIFETIME", "DB_CONN_MAX_IDLE_TIME", "CACHE_ENABLED",
+	"REDIS_URL", "REDIS_DIAL_TIMEOUT", "REDIS_TIMEOUT", "APPLICABLE_CACHE_TTL",
+	"PREVIEW_CACHE_TTL", "COUPON_EXPIRY_INTERVAL", "ACTIVE_COUPONS_INTERVAL",
+	"COUPON_CODE_CHARSET", "CHECKSUM_CODES", "ALLOW_COUPON_STACKING", "DISCOUNT_ROUNDING",
+	"STRICT_DISCOUNT_VALUES", "MAX_FIXED_DISCOUNT", "MAX_ORDER_DISCOUNT_PERCENT",
+}
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// setEnv clears every variable Load reads, sets a valid JWT_SECRET, then
+// applies vars.
+func setEnv(t *testing.T, vars map[string]string) {
+	t.Helper()
+	for _, name := range variables {
+		t.Setenv(name, "")
+	}
+	t.Setenv("JWT_SECRET", testSecret)
+	for name, value := range vars {
+		t.Setenv(name, value)
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	setEnv(t, nil)
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"Port", cfg.Port, "8080"},
+		{"RequestTimeout", cfg.RequestTimeout, 10 * time.Second},
+		{"MaxRequestBytes", cfg.MaxRequestBytes, 1 << 20},
+		{"MaxCartItems", cfg.MaxCartItems, 200},
+		{"MaxOpenConns", cfg.MaxOpenConns, 25},
+		{"CacheEnabled", cfg.CacheEnabled, true},
+		{"RedisAddr", cfg.RedisAddr, "localhost:6379"},
+		{"ApplicableCacheTTL", cfg.ApplicableCacheTTL, 60 * time.Second},
+		{"ChecksumCodes", cfg.ChecksumCodes, false},
+		{"DiscountRounding", cfg.DiscountRounding, models.RoundNearest},
+		{"MaxFixedDiscount", cfg.MaxFixedDiscount.String(), "0"},
+		{"JWTSecret", cfg.JWTSecret, testSecret},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadOverrides(t *testing.T) {
+	setEnv(t, map[string]string{
+		"PORT":                       "9090",
+		"REQUEST_TIMEOUT":            "2s",
+		"CACHE_ENABLED":              "false",
+		"DISCOUNT_ROUNDING":          "floor",
+		"MAX_ORDER_DISCOUNT_PERCENT": "12.5",
+	})
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Port != "9090" || cfg.RequestTimeout != 2*time.Second || cfg.CacheEnabled ||
+		cfg.DiscountRounding != models.RoundFloor || !cfg.MaxOrderDiscountPct.Equal(decimal.RequireFromString("12.5")) {
+		t.Errorf("overrides not applied: %+v", cfg)
+	}
+}
+
+func TestLoadRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{"PORT", "70000", `PORT="70000" is not a port number`},
+		{"PORT", "http", `PORT="http" is not a port number`},
+		{"REQUEST_TIMEOUT", "10", `REQUEST_TIMEOUT="10" is not a positive duration`},
+		{"REQUEST_TIMEOUT", "-1s", `REQUEST_TIMEOUT="-1s" is not a positive duration`},
+		{"MAX_CART_ITEMS", "0", `MAX_CART_ITEMS="0" is not a positive integer`},
+		{"DB_MAX_OPEN_CONNS", "many", `DB_MAX_OPEN_CONNS="many" is not a positive integer`},
+		{"CACHE_ENABLED", "yes", `CACHE_ENABLED="yes" is not true or false`},
+		{"DISCOUNT_ROUNDING", "up", `DISCOUNT_ROUNDING="up" is not nearest, floor or ceil`},
+		{"MAX_FIXED_DISCOUNT", "-5", `MAX_FIXED_DISCOUNT="-5" is not a non-negative amount`},
+		{"MAX_ORDER_DISCOUNT_PERCENT", "101", `MAX_ORDER_DISCOUNT_PERCENT="101" is not a percentage between 0 and 100`},
+		{"JWT_SECRET", "short", "JWT_SECRET must be set to at least"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			setEnv(t, map[string]string{tt.name: tt.value})
+			cfg, err := Load()
+			if err == nil {
+				t.Fatalf("Load succeeded: %+v", cfg)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	setEnv(t, map[string]string{
+		"JWT_SECRET":      "hunter2",
+		"PORT":            "0",
+		"REQUEST_TIMEOUT": "soon",
+		"CHECKSUM_CODES":  "maybe",
+	})
+	_, err := Load()
+	if err == nil {
+		t.Fatal("Load succeeded")
+	}
+	for _, want := range []string{"PORT=", "REQUEST_TIMEOUT=", "CHECKSUM_CODES=", "JWT_SECRET must be set"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Error("error echoes the JWT secret")
+	}
+}
@@ -0,0 +1,81 @@
+package featureflag
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"coupon-system/internal/logging"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ApplicableCoupons gates POST /coupons/applicable and POST /coupons/best.
+const ApplicableCoupons = "applicable_coupons"
+
+// cacheTTL is how long a flag read from Redis is trusted before re-reading it.
+const cacheTTL = 5 * time.Second
+
+type cachedFlag struct {
+	disabled  bool
+	expiresAt time.Time
+}
+
+// Store answers whether a feature has been switched off. A feature is
+// disabled when the environment variable FEATURE_DISABLE_<NAME> is "true",
+// or when the Redis key "feature:disabled:<name>" is "1" or "true". The Redis
+// key can be flipped at runtime; changes are picked up within cacheTTL.
+type Store struct {
+	redis *redis.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedFlag
+}
+
+func NewStore(redisClient *redis.Client) *Store {
+	return &Store{
+		redis: redisClient,
+		cache: make(map[string]cachedFlag),
+	}
+}
+
+// IsDisabled reports whether the named feature is switched off. Redis errors
+// fail open so an unavailable cache never takes a feature down.
+func (s *Store) IsDisabled(ctx context.Context, name string) bool {
+	if isTrue(os.Getenv("FEATURE_DISABLE_" + strings.ToUpper(name))) {
+		return true
+	}
+	if s.redis == nil {
+		return false
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	cached, ok := s.cache[name]
+	s.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.disabled
+	}
+
+	// On Redis errors fail open, and remember that for cacheTTL so an outage
+	// does not add a failing round trip to every request
+	value, err := s.redis.Get(ctx, "feature:disabled:"+name).Result()
+	if err != nil && err != redis.Nil {
+		logging.FromContext(ctx).Warn("feature flag lookup failed", "flag", name, "error", err)
+		value = ""
+	}
+	disabled := isTrue(value)
+
+	s.mu.Lock()
+	s.cache[name] = cachedFlag{disabled: disabled, expiresAt: now.Add(cacheTTL)}
+	s.mu.Unlock()
+
+	return disabled
+}
+
+func isTrue(value string) bool {
+	value = strings.TrimSpace(value)
+	return value == "1" || strings.EqualFold(value, "true")
+}
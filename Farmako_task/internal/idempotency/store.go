@@ -0,0 +1,112 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	keyPrefix = "idempotency:"
+
+	// pendingTTL bounds how long a crashed request can block retries of the
+	// same key.
+	pendingTTL = 30 * time.Second
+
+	// ResultTTL is how long a completed response is replayed for.
+	ResultTTL = 24 * time.Hour
+)
+
+// ErrInProgress is returned by Begin when another request holding the same
+// key has not finished yet.
+var ErrInProgress = errors.New("a request with this idempotency key is already in progress")
+
+// ErrKeyReused is returned by Begin when the key was first used for a request
+// with a different body.
+var ErrKeyReused = errors.New("idempotency key was already used with a different request body")
+
+// Response is a recorded HTTP response, replayed verbatim for retries.
+// Fingerprint identifies the request body that produced it.
+type Response struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// pendingPrefix marks a key whose request is still executing; the request's
+// fingerprint follows it.
+const pendingPrefix = "pending:"
+
+// Store maps idempotency keys to the response of the first request that used
+// them, in Redis.
+type Store struct {
+	redis *redis.Client
+}
+
+// NewStore returns a store backed by redisClient, or nil when redisClient is
+// nil; callers treat a nil store as idempotency being unavailable.
+func NewStore(redisClient *redis.Client) *Store {
+	if redisClient == nil {
+		return nil
+	}
+	return &Store{redis: redisClient}
+}
+
+// Begin claims key for a new request whose body has the given fingerprint.
+// If the key already completed, its recorded response is returned and the
+// caller must replay it instead of executing. If it is claimed but not
+// completed, ErrInProgress is returned. Either way, a key first used with a
+// different fingerprint yields ErrKeyReused instead.
+func (s *Store) Begin(ctx context.Context, key, fingerprint string) (*Response, error) {
+	claimed, err := s.redis.SetNX(ctx, keyPrefix+key, pendingPrefix+fingerprint, pendingTTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if claimed {
+		return nil, nil
+	}
+
+	value, err := s.redis.Get(ctx, keyPrefix+key).Result()
+	if errors.Is(err, redis.Nil) {
+		// The claim expired between the two calls; let the client retry.
+		return nil, ErrInProgress
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claimedBy, ok := strings.CutPrefix(value, pendingPrefix); ok {
+		if claimedBy != fingerprint {
+			return nil, ErrKeyReused
+		}
+		return nil, ErrInProgress
+	}
+
+	var resp Response
+	if err := json.Unmarshal([]byte(value), &resp); err != nil {
+		return nil, err
+	}
+	if resp.Fingerprint != fingerprint {
+		return nil, ErrKeyReused
+	}
+	return &resp, nil
+}
+
+// Complete records the response for a key claimed with Begin.
+func (s *Store) Complete(ctx context.Context, key string, resp Response) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return s.redis.Set(ctx, keyPrefix+key, data, ResultTTL).Err()
+}
+
+// Release drops the claim on key without recording a response, so the
+// request can be retried.
+func (s *Store) Release(ctx context.Context, key string) error {
+	return s.redis.Del(ctx, keyPrefix+key).Err()
+}
@@ -0,0 +1,35 @@
+package jobs
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"coupon-system/internal/metrics"
+	"coupon-system/internal/service"
+)
+
+// RefreshActiveCoupons sets the active-coupon gauge every interval until ctx
+// is cancelled, starting immediately. Failed counts leave the previous value
+// in place.
+func RefreshActiveCoupons(ctx context.Context, couponService *service.CouponService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := couponService.CountActive(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("active coupon count failed", "error", err)
+			}
+		} else {
+			metrics.ActiveCoupons.Set(float64(n))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"coupon-system/internal/repository"
+	"coupon-system/internal/service"
+)
+
+// ExpireCoupons deactivates expired coupons every interval until ctx is
+// cancelled. It runs once immediately so a freshly started instance does not
+// wait a full interval. When several replicas run it, a run that finds
+// another replica mid-cleanup is skipped.
+func ExpireCoupons(ctx context.Context, couponService *service.CouponService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := couponService.DeactivateExpired(ctx)
+		if errors.Is(err, repository.ErrJobLocked) {
+			slog.Debug("expired coupon cleanup skipped; running on another instance")
+		} else if err != nil {
+			slog.Error("expired coupon cleanup failed", "error", err)
+		} else if n > 0 {
+			slog.Info("deactivated expired coupons", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Result labels used alongside the validation reason codes.
+const (
+	ResultValid = "VALID"
+	ResultError = "ERROR"
+)
+
+// Result labels for CacheLookups.
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+var (
+	// CouponValidations counts validations by outcome: ResultValid,
+	// ResultError, or one of the service's fixed reason codes. Raw messages
+	// are never used as labels so cardinality stays bounded.
+	CouponValidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coupon_validations_total",
+		Help: "Coupon validations by result.",
+	}, []string{"result"})
+
+	// CouponRedemptions counts successfully recorded coupon usages.
+	CouponRedemptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "coupon_redemptions_total",
+		Help: "Coupon redemptions recorded.",
+	})
+
+	// ValidateLatency observes the HTTP latency of POST /coupons/validate.
+	ValidateLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "coupon_validate_duration_seconds",
+		Help:    "Latency of coupon validation requests.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// ActiveCoupons is the number of active, unexpired coupons, refreshed
+	// periodically rather than on every change.
+	ActiveCoupons = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "coupons_active",
+		Help: "Active, unexpired coupons.",
+	})
+
+	// CacheLookups counts applicable-coupon cache reads by result: CacheHit
+	// or CacheMiss. Reads skipped or failed because Redis is down are misses.
+	CacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coupon_cache_lookups_total",
+		Help: "Applicable-coupon cache lookups by result.",
+	}, []string{"result"})
+)
+
+// Register adds every collector in this package to reg.
+func Register(reg prometheus.Registerer) {
+	reg.MustRegister(
+		CouponValidations,
+		CouponRedemptions,
+		ValidateLatency,
+		ActiveCoupons,
+		CacheLookups,
+	)
+}
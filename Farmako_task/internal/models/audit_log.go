@@ -0,0 +1,63 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditAction names an admin mutation recorded in the audit log.
+type AuditAction string
+
+const (
+	AuditCreate     AuditAction = "create"
+	AuditUpdate     AuditAction = "update"
+	AuditDeactivate AuditAction = "deactivate"
+)
+
+// AuditLog records one mutation of a coupon: who made it, what it was, and
+// the coupon's state before and after. ActorID is nil for changes made by the
+// system, such as the expiry job.
+type AuditLog struct {
+	ID        uuid.UUID    `gorm:"type:uuid;primary_key" json:"id"`
+	CouponID  uuid.UUID    `gorm:"type:uuid;not null;index" json:"coupon_id"`
+	ActorID   *uuid.UUID   `gorm:"type:uuid" json:"actor_id,omitempty"`
+	Action    AuditAction  `gorm:"type:varchar(32);not null" json:"action"`
+	Before    JSONSnapshot `gorm:"type:jsonb" json:"before,omitempty"`
+	After     JSONSnapshot `gorm:"type:jsonb" json:"after,omitempty"`
+	CreatedAt time.Time    `gorm:"not null;index" json:"created_at"`
+}
+
+// JSONSnapshot is raw JSON stored in a JSONB column and returned verbatim in
+// API responses.
+type JSONSnapshot []byte
+
+func (j JSONSnapshot) Value() (driver.Value, error) {
+	if len(j) == 0 {
+		return nil, nil
+	}
+	return string(j), nil
+}
+
+func (j *JSONSnapshot) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*j = nil
+	case []byte:
+		*j = append((*j)[:0], v...)
+	case string:
+		*j = JSONSnapshot(v)
+	default:
+		return fmt.Errorf("cannot scan %T into JSONSnapshot", value)
+	}
+	return nil
+}
+
+func (j JSONSnapshot) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+	return j, nil
+}
@@ -1,104 +1,755 @@
-package models
-
-import (
-	"time"
-
-	"github.com/google/uuid"
-	"gorm.io/gorm"
-)
-
-type UsageType string
-type DiscountType string
-
-const (
-	OneTime   UsageType = "one_time"
-	MultiUse  UsageType = "multi_use"
-	TimeBased UsageType = "time_based"
-
-	PercentageDiscount DiscountType = "percentage"
-	FixedDiscount      DiscountType = "fixed"
-)
-
-type Coupon struct {
-	ID                 uuid.UUID      `gorm:"type:uuid;primary_key" json:"id"`
-	Code               string         `gorm:"uniqueIndex;not null" json:"code" validate:"required"`
-	ExpiryDate         time.Time      `gorm:"not null" json:"expiry_date" validate:"required,gt=now"`
-	UsageType          UsageType      `gorm:"not null" json:"usage_type" validate:"required,oneof=one_time multi_use time_based"`
-	DiscountType       DiscountType   `gorm:"not null" json:"discount_type" validate:"required,oneof=percentage fixed"`
-	DiscountValue      float64        `gorm:"not null" json:"discount_value" validate:"required,gt=0"`
-	MinOrderValue      float64        `gorm:"not null" json:"min_order_value" validate:"gte=0"`
-	MaxUsagePerUser    int            `gorm:"not null" json:"max_usage_per_user" validate:"required,gte=1"`
-	ValidTimeWindow    *TimeWindow    `gorm:"embedded" json:"valid_time_window,omitempty"`
-	TermsAndConditions string         `gorm:"type:text" json:"terms_and_conditions"`
-	IsActive           bool           `gorm:"default:true" json:"is_active"`
-	CreatedAt          time.Time      `json:"created_at"`
-	UpdatedAt          time.Time      `json:"updated_at"`
-	DeletedAt          gorm.DeletedAt `gorm:"index" json:"-"`
-
-	// Relations
-	ApplicableMedicines  []Medicine    `gorm:"many2many:coupon_medicines;" json:"applicable_medicines,omitempty"`
-	ApplicableCategories []Category    `gorm:"many2many:coupon_categories;" json:"applicable_categories,omitempty"`
-	Usages               []CouponUsage `gorm:"foreignKey:CouponID" json:"-"`
-}
-
-type TimeWindow struct {
-	StartTime time.Time `json:"start_time,omitempty"`
-	EndTime   time.Time `json:"end_time,omitempty"`
-}
-
-type Medicine struct {
-	ID       uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
-	Name     string    `json:"name"`
-	Category string    `json:"category"`
-	Price    float64   `json:"price"`
-}
-
-type Category struct {
-	ID   uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
-	Name string    `json:"name"`
-}
-
-type CouponUsage struct {
-	ID        uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
-	CouponID  uuid.UUID `gorm:"type:uuid;not null" json:"coupon_id"`
-	UserID    uuid.UUID `gorm:"type:uuid;not null" json:"user_id"`
-	OrderID   uuid.UUID `gorm:"type:uuid;not null" json:"order_id"`
-	UsedAt    time.Time `gorm:"not null" json:"used_at"`
-	CreatedAt time.Time `json:"created_at"`
-}
-
-func (c *Coupon) BeforeCreate(tx *gorm.DB) error {
-	if c.ID == uuid.Nil {
-		c.ID = uuid.New()
-	}
-	return nil
-}
-
-func (c *Coupon) IsValid(orderTotal float64, currentTime time.Time) bool {
-	if !c.IsActive {
-		return false
-	}
-
-	if currentTime.After(c.ExpiryDate) {
-		return false
-	}
-
-	if orderTotal < c.MinOrderValue {
-		return false
-	}
-
-	if c.ValidTimeWindow != nil {
-		if currentTime.Before(c.ValidTimeWindow.StartTime) || currentTime.After(c.ValidTimeWindow.EndTime) {
-			return false
-		}
-	}
-
-	return true
-}
-
-func (c *Coupon) CalculateDiscount(orderTotal float64) float64 {
-	if c.DiscountType == PercentageDiscount {
-		return orderTotal * (c.DiscountValue / 100)
-	}
-	return c.DiscountValue
-}
+package models
+
+import (
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+type UsageType string
+type DiscountType string
+type DiscountScope string
+type CustomerSegment string
+type LinkOp string
+
+const (
+	OneTime   UsageType = "one_time"
+	MultiUse  UsageType = "multi_use"
+	TimeBased UsageType = "time_based"
+
+	PercentageDiscount DiscountType = "percentage"
+	FixedDiscount      DiscountType = "fixed"
+
+	// OrderScope discounts the whole order, or for restricted coupons the
+	// eligible subtotal. The item scopes discount a single eligible line.
+	OrderScope             DiscountScope = "order"
+	CheapestItemScope      DiscountScope = "cheapest_item"
+	MostExpensiveItemScope DiscountScope = "most_expensive_item"
+
+	// AllCustomers coupons are open to everyone; FirstCouponCustomers coupons
+	// only to users who have not redeemed a coupon on an earlier order,
+	// RepeatCouponCustomers coupons only to users who have. Orders placed
+	// without a coupon are not recorded here, so these are not new and
+	// returning customers.
+	AllCustomers          CustomerSegment = "all"
+	FirstCouponCustomers  CustomerSegment = "first_coupon"
+	RepeatCouponCustomers CustomerSegment = "repeat_coupon"
+
+	// Link operations change a coupon's medicine or category associations:
+	// add links, remove links, or replace the whole set.
+	LinkAdd     LinkOp = "add"
+	LinkRemove  LinkOp = "remove"
+	LinkReplace LinkOp = "replace"
+)
+
+// DefaultCurrency is the currency of coupons and orders that do not name one.
+const DefaultCurrency = "INR"
+
+var hundred = decimal.NewFromInt(100)
+
+type Coupon struct {
+	ID                     uuid.UUID       `gorm:"type:uuid;primary_key" json:"id"`
+	Code                   string          `gorm:"uniqueIndex;index:idx_coupons_code_prefix,expression:lower(code) text_pattern_ops;not null" json:"code" validate:"required"`
+	StartDate              time.Time       `json:"start_date,omitempty"`
+	ExpiryDate             time.Time       `gorm:"not null" json:"expiry_date" validate:"required,gt=now"`
+	UsageType              UsageType       `gorm:"not null" json:"usage_type" validate:"required,oneof=one_time multi_use time_based"`
+	DiscountType           DiscountType    `gorm:"not null" json:"discount_type" validate:"required,oneof=percentage fixed"`
+	DiscountValue          decimal.Decimal `gorm:"type:numeric(12,2);not null" json:"discount_value" validate:"required"`
+	SecondaryDiscountType  DiscountType    `gorm:"type:varchar(16);not null;default:''" json:"secondary_discount_type,omitempty" validate:"omitempty,oneof=percentage fixed"`
+	SecondaryDiscountValue decimal.Decimal `gorm:"type:numeric(12,2);not null;default:0" json:"secondary_discount_value"`
+	Currency               string          `gorm:"type:varchar(3);not null;default:'INR'" json:"currency"`
+	DiscountScope          DiscountScope   `gorm:"not null;default:order" json:"discount_scope"`
+	CustomerSegment        CustomerSegment `gorm:"not null;default:all" json:"customer_segment"`
+	MinDiscountAmount      decimal.Decimal `gorm:"type:numeric(12,2);not null;default:0" json:"min_discount_amount"`
+	MaxDiscountAmount      decimal.Decimal `gorm:"type:numeric(12,2);not null;default:0" json:"max_discount_amount"`
+	MinOrderValue          decimal.Decimal `gorm:"type:numeric(12,2);not null" json:"min_order_value"`
+	MinOrderTiers          MinOrderTiers   `gorm:"type:jsonb" json:"min_order_tiers,omitempty"`
+	DiscountTiers          DiscountTiers   `gorm:"type:jsonb" json:"discount_tiers,omitempty"`
+	MinOnApplicableItems   bool            `gorm:"not null;default:false" json:"min_on_applicable_items"`
+	// MinOrderIncludesCharges counts the delivery charge and taxes towards
+	// the minimum order value.
+	MinOrderIncludesCharges bool            `gorm:"not null;default:false" json:"min_order_includes_charges"`
+	MaxOrderValue           decimal.Decimal `gorm:"type:numeric(12,2);not null;default:0" json:"max_order_value"`
+	AssignedUserID          *uuid.UUID      `gorm:"type:uuid;index" json:"assigned_user_id,omitempty"`
+	MaxUsagePerUser         int             `gorm:"not null" json:"max_usage_per_user" validate:"required,gte=1"`
+	MaxUsagePerUserDay      int             `gorm:"not null;default:0" json:"max_usage_per_user_per_day,omitempty" validate:"gte=0"`
+	MaxTotalUsage           int64           `gorm:"not null;default:0" json:"max_total_usage,omitempty" validate:"gte=0"`
+	RolloutPercentage       int             `gorm:"not null;default:100" json:"rollout_percentage" validate:"gte=1,lte=100"`
+	MinItemCount            int             `gorm:"not null;default:0" json:"min_item_count" validate:"gte=0"`
+	ValidTimeWindow         *TimeWindow     `gorm:"embedded" json:"valid_time_window,omitempty"`
+	DailyWindow             *DailyWindow    `gorm:"type:jsonb" json:"daily_window,omitempty"`
+	PaymentMethods          PaymentMethods  `gorm:"type:jsonb" json:"payment_methods,omitempty"`
+	TermsAndConditions      string          `gorm:"type:text" json:"terms_and_conditions"`
+	IsActive                bool            `gorm:"default:true" json:"is_active"`
+	TimesUsed               int64           `gorm:"not null;default:0" json:"times_used"`
+	Version                 int             `gorm:"not null;default:1" json:"version"`
+	CreatedAt               time.Time       `json:"created_at"`
+	UpdatedAt               time.Time       `json:"updated_at"`
+	DeletedAt               gorm.DeletedAt  `gorm:"index" json:"-"`
+
+	// Relations
+	ApplicableMedicines  []Medicine    `gorm:"many2many:coupon_medicines;" json:"applicable_medicines,omitempty"`
+	ApplicableCategories []Category    `gorm:"many2many:coupon_categories;" json:"applicable_categories,omitempty"`
+	Usages               []CouponUsage `gorm:"foreignKey:CouponID" json:"-"`
+}
+
+// TimeWindow limits a coupon to a span of time. When a request carries a
+// window, binding requires both bounds, with EndTime after StartTime, so an
+// empty or zero-valued window is rejected rather than stored.
+type TimeWindow struct {
+	StartTime time.Time `json:"start_time,omitempty" binding:"required"`
+	EndTime   time.Time `json:"end_time,omitempty" binding:"required,gtfield=StartTime"`
+}
+
+// IsZero reports whether neither bound of the window is set. GORM stores a nil
+// embedded window as NULL columns and reloads them as a zero-value window, so
+// a zero window means "no window".
+func (w *TimeWindow) IsZero() bool {
+	return w == nil || (w.StartTime.IsZero() && w.EndTime.IsZero())
+}
+
+type Medicine struct {
+	ID       uuid.UUID       `gorm:"type:uuid;primary_key" json:"id"`
+	Name     string          `json:"name"`
+	Category string          `json:"category"`
+	Price    decimal.Decimal `gorm:"type:numeric(12,2)" json:"price"`
+	Quantity int             `gorm:"-" json:"quantity,omitempty"`
+}
+
+// Units returns how many units the cart line is for. A line without a
+// quantity is a single unit.
+func (m Medicine) Units() int {
+	if m.Quantity > 0 {
+		return m.Quantity
+	}
+	return 1
+}
+
+// LineTotal is the price of the whole cart line: the unit price times Units.
+func (m Medicine) LineTotal() decimal.Decimal {
+	return m.Price.Mul(decimal.NewFromInt(int64(m.Units())))
+}
+
+// ItemCount totals the units in a cart.
+func ItemCount(cartItems []Medicine) int {
+	count := 0
+	for _, item := range cartItems {
+		count += item.Units()
+	}
+	return count
+}
+
+type Category struct {
+	ID   uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	Name string    `json:"name"`
+}
+
+type CouponUsage struct {
+	ID              uuid.UUID       `gorm:"type:uuid;primary_key;index:idx_coupon_usages_used_at_id,priority:2" json:"id"`
+	CouponID        uuid.UUID       `gorm:"type:uuid;not null;uniqueIndex:idx_coupon_usages_order_coupon,priority:2" json:"coupon_id"`
+	UserID          uuid.UUID       `gorm:"type:uuid;not null" json:"user_id"`
+	OrderID         uuid.UUID       `gorm:"type:uuid;not null;uniqueIndex:idx_coupon_usages_order_coupon,priority:1" json:"order_id"`
+	DiscountApplied decimal.Decimal `gorm:"type:numeric(12,2);not null;default:0" json:"discount_applied"`
+	OrderTotal      decimal.Decimal `gorm:"type:numeric(12,2);not null;default:0" json:"order_total"`
+	UsedAt          time.Time       `gorm:"not null;index:idx_coupon_usages_used_at_id,priority:1" json:"used_at"`
+	CreatedAt       time.Time       `json:"created_at"`
+}
+
+// CouponStats summarises the redemptions of a single coupon.
+type CouponStats struct {
+	CouponID             uuid.UUID       `json:"coupon_id"`
+	TotalRedemptions     int64           `json:"total_redemptions"`
+	UniqueUsers          int64           `json:"unique_users"`
+	TotalDiscountGranted decimal.Decimal `json:"total_discount_granted"`
+	FirstUsedAt          *time.Time      `json:"first_used_at,omitempty"`
+	LastUsedAt           *time.Time      `json:"last_used_at,omitempty"`
+}
+
+// UsageReconciliation is the outcome of recounting a coupon's redemptions:
+// the TimesUsed counter before and after the correction.
+type UsageReconciliation struct {
+	CouponID  uuid.UUID `json:"coupon_id"`
+	Before    int64     `json:"before"`
+	After     int64     `json:"after"`
+	Corrected bool      `json:"corrected"`
+}
+
+// CouponSearchResult is the subset of a coupon returned by code search.
+type CouponSearchResult struct {
+	ID            uuid.UUID       `json:"id"`
+	Code          string          `json:"code"`
+	DiscountType  DiscountType    `json:"discount_type"`
+	DiscountValue decimal.Decimal `json:"discount_value"`
+	IsActive      bool            `json:"is_active"`
+	ExpiryDate    time.Time       `json:"expiry_date"`
+}
+
+// CouponOffer is the subset of a coupon shown to shoppers, e.g. on a product
+// page.
+type CouponOffer struct {
+	ID                uuid.UUID       `json:"id"`
+	Code              string          `json:"code"`
+	DiscountType      DiscountType    `json:"discount_type"`
+	DiscountValue     decimal.Decimal `json:"discount_value"`
+	MinOrderValue     decimal.Decimal `json:"min_order_value"`
+	MaxDiscountAmount decimal.Decimal `json:"max_discount_amount"`
+	DailyWindow       *DailyWindow    `json:"daily_window,omitempty"`
+	ExpiryDate        time.Time       `json:"expiry_date"`
+}
+
+// CouponTerms is the customer-facing description of a coupon's rules. It
+// deliberately leaves out internal fields such as usage limits and counts and
+// the discount cap.
+type CouponTerms struct {
+	Code                 string          `json:"code"`
+	Summary              string          `json:"summary"`
+	MinOrderValue        decimal.Decimal `json:"min_order_value"`
+	Currency             string          `json:"currency"`
+	ExpiryDate           time.Time       `json:"expiry_date"`
+	DailyWindow          *DailyWindow    `json:"daily_window,omitempty"`
+	PaymentMethods       PaymentMethods  `json:"payment_methods,omitempty"`
+	ApplicableMedicines  []string        `json:"applicable_medicines,omitempty"`
+	ApplicableCategories []string        `json:"applicable_categories,omitempty"`
+	TermsAndConditions   string          `json:"terms_and_conditions,omitempty"`
+}
+
+// Terms builds the customer-facing description of c. The applicable
+// medicines and categories must be loaded.
+func (c *Coupon) Terms() CouponTerms {
+	terms := CouponTerms{
+		Code:               c.Code,
+		Summary:            c.DiscountSummary(),
+		MinOrderValue:      c.MinOrderValue,
+		Currency:           NormalizeCurrency(c.Currency),
+		ExpiryDate:         c.ExpiryDate,
+		DailyWindow:        c.DailyWindow,
+		PaymentMethods:     c.PaymentMethods,
+		TermsAndConditions: c.TermsAndConditions,
+	}
+	for _, m := range c.ApplicableMedicines {
+		terms.ApplicableMedicines = append(terms.ApplicableMedicines, m.Name)
+	}
+	for _, cat := range c.ApplicableCategories {
+		terms.ApplicableCategories = append(terms.ApplicableCategories, cat.Name)
+	}
+	return terms
+}
+
+// DiscountSummary describes the discount in words, e.g. "20% off your
+// order", "50.00 off your cheapest item" or, for tiered coupons, "up to 15%
+// off your order".
+func (c *Coupon) DiscountSummary() string {
+	value, prefix := c.DiscountValue, ""
+	if len(c.DiscountTiers) > 0 {
+		for _, tier := range c.DiscountTiers {
+			value = decimal.Max(value, tier.DiscountValue)
+		}
+		prefix = "up to "
+	}
+
+	amount := prefix + formatDiscount(c.DiscountType, value) + " off"
+	if c.HasSecondaryDiscount() {
+		amount += " + " + formatDiscount(c.SecondaryDiscountType, c.SecondaryDiscountValue) + " extra"
+	}
+
+	switch c.DiscountScope {
+	case CheapestItemScope:
+		return amount + " your cheapest item"
+	case MostExpensiveItemScope:
+		return amount + " your most expensive item"
+	}
+	if c.IsRestricted() {
+		return amount + " eligible items"
+	}
+	return amount + " your order"
+}
+
+func formatDiscount(discountType DiscountType, value decimal.Decimal) string {
+	if discountType == PercentageDiscount {
+		return value.String() + "%"
+	}
+	return value.StringFixed(2)
+}
+
+// UserUsageSummary totals a user's redemptions across all coupons.
+type UserUsageSummary struct {
+	UserID                uuid.UUID       `json:"user_id"`
+	TotalRedemptions      int64           `json:"total_redemptions"`
+	TotalDiscountReceived decimal.Decimal `json:"total_discount_received"`
+}
+
+func (c *Coupon) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return nil
+}
+
+// AfterFind restores a nil ValidTimeWindow for coupons stored without one.
+func (c *Coupon) AfterFind(tx *gorm.DB) error {
+	if c.ValidTimeWindow.IsZero() {
+		c.ValidTimeWindow = nil
+	}
+	return nil
+}
+
+func (c *Coupon) IsValid(cartItems []Medicine, order OrderContext, currentTime time.Time) bool {
+	return c.IsValidForUser(cartItems, order, 0, currentTime)
+}
+
+// IsValidForUser is IsValid with the minimum order value adjusted for a user
+// with priorOrders earlier coupon orders (see EffectiveMinOrderValue).
+func (c *Coupon) IsValidForUser(cartItems []Medicine, order OrderContext, priorOrders int, currentTime time.Time) bool {
+	if !c.IsActive {
+		return false
+	}
+
+	if !c.HasStarted(currentTime) {
+		return false
+	}
+
+	if currentTime.After(c.ExpiryDate) {
+		return false
+	}
+
+	if c.MinOrderBase(cartItems, order).LessThan(c.EffectiveMinOrderValue(priorOrders)) {
+		return false
+	}
+
+	if c.ExceedsMaxOrderValue(order.ItemsTotal) {
+		return false
+	}
+
+	if !c.ValidTimeWindow.IsZero() {
+		if currentTime.Before(c.ValidTimeWindow.StartTime) || currentTime.After(c.ValidTimeWindow.EndTime) {
+			return false
+		}
+	}
+
+	if !c.DailyWindow.Contains(currentTime) {
+		return false
+	}
+
+	return true
+}
+
+// EffectiveMinOrderValue is the minimum order value for a user with
+// priorOrders earlier coupon orders: the matching tier's value if any tier
+// applies, otherwise MinOrderValue.
+func (c *Coupon) EffectiveMinOrderValue(priorOrders int) decimal.Decimal {
+	if tier, ok := c.MinOrderTiers.For(priorOrders); ok {
+		return tier.MinOrderValue
+	}
+	return c.MinOrderValue
+}
+
+// MinOrderBase returns the amount the minimum order value is checked against:
+// the eligible subtotal for restricted coupons with MinOnApplicableItems set,
+// otherwise the items total, plus the order's delivery charge and taxes when
+// MinOrderIncludesCharges is set.
+func (c *Coupon) MinOrderBase(cartItems []Medicine, order OrderContext) decimal.Decimal {
+	base := order.ItemsTotal
+	if c.MinOnApplicableItems && c.IsRestricted() {
+		base = c.EligibleSubtotal(cartItems)
+	}
+	if c.MinOrderIncludesCharges {
+		base = base.Add(order.Charges())
+	}
+	return base
+}
+
+// ExceedsMaxOrderValue reports whether orderTotal is above the coupon's
+// MaxOrderValue. A zero MaxOrderValue means no ceiling.
+func (c *Coupon) ExceedsMaxOrderValue(orderTotal decimal.Decimal) bool {
+	return c.MaxOrderValue.IsPositive() && orderTotal.GreaterThan(c.MaxOrderValue)
+}
+
+// InRollout reports whether userID falls within the coupon's
+// RolloutPercentage. Users are bucketed by a hash of the coupon and user IDs,
+// so a user is consistently in or out of a given coupon's rollout, and
+// independently for each coupon.
+func (c *Coupon) InRollout(userID uuid.UUID) bool {
+	if c.RolloutPercentage <= 0 || c.RolloutPercentage >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write(c.ID[:])
+	h.Write(userID[:])
+	return int(h.Sum32()%100) < c.RolloutPercentage
+}
+
+// FullyRedeemed reports whether the coupon has reached its MaxTotalUsage
+// across all users. A zero MaxTotalUsage means no global cap.
+func (c *Coupon) FullyRedeemed() bool {
+	return c.MaxTotalUsage > 0 && c.TimesUsed >= c.MaxTotalUsage
+}
+
+// NormalizeCurrency returns currency as an upper-case ISO 4217 code, or
+// DefaultCurrency when it is empty.
+func NormalizeCurrency(currency string) string {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency == "" {
+		return DefaultCurrency
+	}
+	return currency
+}
+
+// IsCurrencySpecific reports whether the coupon involves amounts of money: a
+// fixed discount, or a minimum or maximum order value or discount amount.
+// Percentage coupons without any of those apply in every currency.
+func (c *Coupon) IsCurrencySpecific() bool {
+	return c.DiscountType == FixedDiscount ||
+		(c.HasSecondaryDiscount() && c.SecondaryDiscountType == FixedDiscount) ||
+		c.MinOrderValue.IsPositive() ||
+		c.MaxOrderValue.IsPositive() ||
+		c.MinDiscountAmount.IsPositive() ||
+		c.MaxDiscountAmount.IsPositive() ||
+		len(c.MinOrderTiers) > 0
+}
+
+// AcceptsCurrency reports whether the coupon can be applied to an order
+// priced in currency.
+func (c *Coupon) AcceptsCurrency(currency string) bool {
+	return !c.IsCurrencySpecific() || NormalizeCurrency(currency) == NormalizeCurrency(c.Currency)
+}
+
+// NormalizeCode returns the canonical form of a coupon code: trimmed and
+// upper-cased. Codes are stored in this form and every lookup normalizes its
+// input, so "summer10" and " SUMMER10 " find the same coupon.
+func NormalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// InSegment reports whether a user with priorOrders earlier coupon orders
+// belongs to the coupon's customer segment. An empty segment means
+// AllCustomers.
+func (c *Coupon) InSegment(priorOrders int) bool {
+	switch c.CustomerSegment {
+	case FirstCouponCustomers:
+		return priorOrders == 0
+	case RepeatCouponCustomers:
+		return priorOrders > 0
+	}
+	return true
+}
+
+// IsAssignedTo reports whether userID may use the coupon: it is unassigned or
+// assigned to that user.
+func (c *Coupon) IsAssignedTo(userID uuid.UUID) bool {
+	return c.AssignedUserID == nil || *c.AssignedUserID == userID
+}
+
+// HasStarted reports whether the coupon's scheduled activation has passed. A
+// zero StartDate means the coupon is active immediately.
+func (c *Coupon) HasStarted(currentTime time.Time) bool {
+	return c.StartDate.IsZero() || !currentTime.Before(c.StartDate)
+}
+
+// IsRestricted reports whether the coupon is limited to specific medicines or
+// categories.
+func (c *Coupon) IsRestricted() bool {
+	return len(c.ApplicableMedicines) > 0 || len(c.ApplicableCategories) > 0
+}
+
+// EligibleSubtotal sums the line totals of the cart items the coupon applies
+// to. An item that matches several restrictions (e.g. both a medicine and a
+// category) is counted once.
+func (c *Coupon) EligibleSubtotal(cartItems []Medicine) decimal.Decimal {
+	targets := c.targets()
+	subtotal := decimal.Zero
+	for _, item := range cartItems {
+		if targets.appliesTo(item) {
+			subtotal = subtotal.Add(item.LineTotal())
+		}
+	}
+	return subtotal
+}
+
+// AppliesTo reports whether the coupon applies to at least one item in the
+// cart. Unrestricted coupons apply to every cart.
+func (c *Coupon) AppliesTo(cartItems []Medicine) bool {
+	if !c.IsRestricted() {
+		return true
+	}
+
+	targets := c.targets()
+	for _, item := range cartItems {
+		if targets.appliesTo(item) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchedItem is a cart item a restricted coupon applies to, and why.
+type MatchedItem struct {
+	MedicineID uuid.UUID `json:"medicine_id"`
+	Name       string    `json:"name,omitempty"`
+	// Category is set when the item matched through one of the coupon's
+	// categories rather than by medicine.
+	Category string `json:"category,omitempty"`
+}
+
+// LineDiscount is the share of a coupon's items discount allocated to one
+// cart line.
+type LineDiscount struct {
+	MedicineID uuid.UUID       `json:"medicine_id"`
+	Amount     decimal.Decimal `json:"amount"`
+}
+
+// AllocateDiscount distributes discount across the cart lines the coupon
+// applies to, in proportion to their line totals. Shares are rounded down to
+// the paisa and the remainder goes to the most expensive line, so the amounts
+// always sum to exactly discount. It returns nil when no line has a price.
+func (c *Coupon) AllocateDiscount(cartItems []Medicine, discount decimal.Decimal) []LineDiscount {
+	targets := c.targets()
+	var eligible []Medicine
+	subtotal := decimal.Zero
+	largest := 0
+	for _, item := range cartItems {
+		if !targets.appliesTo(item) || !item.Price.IsPositive() {
+			continue
+		}
+		if len(eligible) > 0 && item.LineTotal().GreaterThan(eligible[largest].LineTotal()) {
+			largest = len(eligible)
+		}
+		eligible = append(eligible, item)
+		subtotal = subtotal.Add(item.LineTotal())
+	}
+	if len(eligible) == 0 {
+		return nil
+	}
+
+	lines := make([]LineDiscount, len(eligible))
+	allocated := decimal.Zero
+	for i, item := range eligible {
+		share := discount.Mul(item.LineTotal()).Div(subtotal).RoundDown(2)
+		lines[i] = LineDiscount{MedicineID: item.ID, Amount: share}
+		allocated = allocated.Add(share)
+	}
+	lines[largest].Amount = lines[largest].Amount.Add(discount.Sub(allocated))
+	return lines
+}
+
+// MatchedItems lists the cart items that make a restricted coupon apply, in
+// cart order. It returns nil for unrestricted coupons, which apply to the
+// whole order rather than to particular items.
+func (c *Coupon) MatchedItems(cartItems []Medicine) []MatchedItem {
+	if !c.IsRestricted() {
+		return nil
+	}
+
+	targets := c.targets()
+	matched := []MatchedItem{}
+	for _, item := range cartItems {
+		if targets.matchesMedicine(item) {
+			matched = append(matched, MatchedItem{MedicineID: item.ID, Name: item.Name})
+			continue
+		}
+		if category, ok := targets.category(item); ok {
+			matched = append(matched, MatchedItem{MedicineID: item.ID, Name: item.Name, Category: category})
+		}
+	}
+	return matched
+}
+
+// couponTargets indexes a coupon's medicine and category restrictions, so
+// that matching a cart takes one lookup per item rather than a scan of every
+// restriction.
+type couponTargets struct {
+	restricted bool
+	medicines  map[uuid.UUID]struct{}
+	// categories maps each category's categoryKey to its name as stored on
+	// the coupon, keeping the first of names that differ only in case.
+	categories map[string]string
+}
+
+func (c *Coupon) targets() couponTargets {
+	t := couponTargets{
+		restricted: c.IsRestricted(),
+		medicines:  make(map[uuid.UUID]struct{}, len(c.ApplicableMedicines)),
+		categories: make(map[string]string, len(c.ApplicableCategories)),
+	}
+	for _, medicine := range c.ApplicableMedicines {
+		t.medicines[medicine.ID] = struct{}{}
+	}
+	for _, category := range c.ApplicableCategories {
+		key := categoryKey(category.Name)
+		if _, ok := t.categories[key]; !ok {
+			t.categories[key] = category.Name
+		}
+	}
+	return t
+}
+
+func (t couponTargets) matchesMedicine(item Medicine) bool {
+	_, ok := t.medicines[item.ID]
+	return ok
+}
+
+// category returns the name of the coupon category item belongs to.
+func (t couponTargets) category(item Medicine) (string, bool) {
+	name, ok := t.categories[categoryKey(item.Category)]
+	return name, ok
+}
+
+func (t couponTargets) appliesTo(item Medicine) bool {
+	if !t.restricted || t.matchesMedicine(item) {
+		return true
+	}
+	_, ok := t.category(item)
+	return ok
+}
+
+// SameCategory compares category names ignoring case and surrounding
+// whitespace, since cart items and coupon restrictions are entered by
+// different systems.
+func SameCategory(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// categoryKey folds a category name so that names SameCategory considers
+// equal share a key.
+func categoryKey(name string) string {
+	return strings.ToLower(strings.ToUpper(strings.TrimSpace(name)))
+}
+
+// CalculateItemsDiscount computes the discount the coupon grants on a cart.
+// Item-scoped coupons discount only the eligible line with the cheapest or
+// most expensive unit price, all of its units. Otherwise restricted coupons
+// discount only the line items they apply to (see EligibleSubtotal) and
+// unrestricted coupons discount the whole order total. The discount tier, if
+// any, is always chosen by the order total.
+func (c *Coupon) CalculateItemsDiscount(cartItems []Medicine, orderTotal decimal.Decimal) decimal.Decimal {
+	value := c.DiscountValueFor(orderTotal)
+	switch c.DiscountScope {
+	case CheapestItemScope, MostExpensiveItemScope:
+		item, ok := c.scopedItem(cartItems)
+		if !ok {
+			return decimal.Zero
+		}
+		return c.discountOn(item.LineTotal(), value)
+	}
+
+	if c.IsRestricted() {
+		return c.discountOn(c.EligibleSubtotal(cartItems), value)
+	}
+	return c.discountOn(orderTotal, value)
+}
+
+// DiscountValueFor returns the discount value that applies to an order of
+// orderTotal: that of the highest DiscountTiers entry the order reaches, or
+// DiscountValue below the first tier and for coupons without tiers.
+func (c *Coupon) DiscountValueFor(orderTotal decimal.Decimal) decimal.Decimal {
+	if tier, ok := c.DiscountTiers.For(orderTotal); ok {
+		return tier.DiscountValue
+	}
+	return c.DiscountValue
+}
+
+// scopedItem picks the eligible cart line an item-scoped coupon discounts,
+// comparing unit prices. Ties go to the line that appears first in the cart.
+func (c *Coupon) scopedItem(cartItems []Medicine) (Medicine, bool) {
+	targets := c.targets()
+	var chosen Medicine
+	found := false
+	for _, item := range cartItems {
+		if !targets.appliesTo(item) {
+			continue
+		}
+		if !found ||
+			(c.DiscountScope == CheapestItemScope && item.Price.LessThan(chosen.Price)) ||
+			(c.DiscountScope == MostExpensiveItemScope && item.Price.GreaterThan(chosen.Price)) {
+			chosen = item
+			found = true
+		}
+	}
+	return chosen, found
+}
+
+// MaxDiscountPerUse returns the largest discount one redemption can grant.
+// It is unbounded (false) when a percentage discount, primary or secondary,
+// has no MaxDiscountAmount, since it scales with the order.
+func (c *Coupon) MaxDiscountPerUse() (decimal.Decimal, bool) {
+	secondaryFixed := !c.HasSecondaryDiscount() || c.SecondaryDiscountType == FixedDiscount
+	switch {
+	case c.DiscountType == FixedDiscount && secondaryFixed:
+		value := c.DiscountValue
+		for _, tier := range c.DiscountTiers {
+			value = decimal.Max(value, tier.DiscountValue)
+		}
+		if c.HasSecondaryDiscount() {
+			value = value.Add(c.SecondaryDiscountValue)
+		}
+		return decimal.Max(c.capDiscount(value), c.MinDiscountAmount), true
+	case c.MaxDiscountAmount.IsPositive():
+		return c.MaxDiscountAmount, true
+	}
+	return decimal.Zero, false
+}
+
+// MaxUsesPerUser returns how many times one user may redeem the coupon. It
+// is unbounded (false) for time-based coupons.
+func (c *Coupon) MaxUsesPerUser() (int, bool) {
+	switch c.UsageType {
+	case OneTime:
+		return 1, true
+	case MultiUse:
+		return c.MaxUsagePerUser, true
+	}
+	return 0, false
+}
+
+// CalculateDiscount applies the coupon to orderTotal, using the discount
+// tier orderTotal reaches if any. A secondary discount, if set, is added to
+// the primary one before the total is capped at MaxDiscountAmount and raised
+// to MinDiscountAmount when those are set. The result never exceeds
+// orderTotal, so a fixed discount larger than the order is clamped to the
+// order's value.
+func (c *Coupon) CalculateDiscount(orderTotal decimal.Decimal) decimal.Decimal {
+	return c.discountOn(orderTotal, c.DiscountValueFor(orderTotal))
+}
+
+// HasSecondaryDiscount reports whether the coupon stacks a second discount,
+// SecondaryDiscountType and SecondaryDiscountValue, on top of its primary
+// one, e.g. 50 off plus 5% extra.
+func (c *Coupon) HasSecondaryDiscount() bool {
+	return c.SecondaryDiscountType != "" && c.SecondaryDiscountValue.IsPositive()
+}
+
+// discountOn applies a discount of value, interpreted with DiscountType, to
+// base, adds the secondary discount if any, and applies the caps and floor
+// described on CalculateDiscount.
+func (c *Coupon) discountOn(base, value decimal.Decimal) decimal.Decimal {
+	discount := amountOff(c.DiscountType, base, value)
+	if c.HasSecondaryDiscount() {
+		discount = discount.Add(amountOff(c.SecondaryDiscountType, base, c.SecondaryDiscountValue))
+	}
+	discount = c.capDiscount(discount)
+
+	if discount.LessThan(c.MinDiscountAmount) {
+		discount = c.MinDiscountAmount
+	}
+	return decimal.Min(discount, base)
+}
+
+// amountOff is the uncapped amount a discount of value, interpreted with
+// discountType, takes off base.
+func amountOff(discountType DiscountType, base, value decimal.Decimal) decimal.Decimal {
+	if discountType == PercentageDiscount {
+		return base.Mul(value).Div(hundred)
+	}
+	return value
+}
+
+func (c *Coupon) capDiscount(discount decimal.Decimal) decimal.Decimal {
+	if c.MaxDiscountAmount.IsPositive() && discount.GreaterThan(c.MaxDiscountAmount) {
+		return c.MaxDiscountAmount
+	}
+	return discount
+}
@@ -0,0 +1,258 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func price(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+func TestItemCount(t *testing.T) {
+	tests := []struct {
+		name string
+		cart []Medicine
+		want int
+	}{
+		{"empty", nil, 0},
+		{"lines without quantity count once", []Medicine{{}, {}}, 2},
+		{"quantities are summed", []Medicine{{Quantity: 2}, {Quantity: 3}}, 5},
+		{"mixed", []Medicine{{Quantity: 4}, {}}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ItemCount(tt.cart); got != tt.want {
+				t.Errorf("ItemCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEligibleSubtotalCountsQuantity(t *testing.T) {
+	coupon := &Coupon{ApplicableCategories: []Category{{Name: "Vitamins"}}}
+	tests := []struct {
+		name string
+		cart []Medicine
+		want string
+	}{
+		{"single unit", []Medicine{{ID: uuid.New(), Category: "vitamins", Price: price("120")}}, "120"},
+		{"quantity multiplies price", []Medicine{{ID: uuid.New(), Category: "Vitamins", Price: price("120"), Quantity: 3}}, "360"},
+		{"other categories ignored", []Medicine{
+			{ID: uuid.New(), Category: "Vitamins", Price: price("50"), Quantity: 2},
+			{ID: uuid.New(), Category: "Antibiotics", Price: price("500"), Quantity: 4},
+		}, "100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coupon.EligibleSubtotal(tt.cart); !got.Equal(price(tt.want)) {
+				t.Errorf("EligibleSubtotal() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocateDiscountWeighsQuantity(t *testing.T) {
+	a, b := uuid.New(), uuid.New()
+	coupon := &Coupon{}
+	cart := []Medicine{
+		{ID: a, Price: price("100"), Quantity: 3},
+		{ID: b, Price: price("150")},
+	}
+
+	lines := coupon.AllocateDiscount(cart, price("45"))
+	want := map[uuid.UUID]string{a: "30", b: "15"}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for _, line := range lines {
+		if !line.Amount.Equal(price(want[line.MedicineID])) {
+			t.Errorf("line %s = %s, want %s", line.MedicineID, line.Amount, want[line.MedicineID])
+		}
+	}
+}
+
+func TestScopedDiscountCoversWholeLine(t *testing.T) {
+	coupon := &Coupon{
+		DiscountType:  PercentageDiscount,
+		DiscountValue: price("10"),
+		DiscountScope: CheapestItemScope,
+	}
+	cart := []Medicine{
+		{ID: uuid.New(), Price: price("40"), Quantity: 5},
+		{ID: uuid.New(), Price: price("90")},
+	}
+
+	if got := coupon.CalculateItemsDiscount(cart, price("290")); !got.Equal(price("20")) {
+		t.Errorf("CalculateItemsDiscount() = %s, want 20", got)
+	}
+}
+
+func TestIsAssignedTo(t *testing.T) {
+	owner, other := uuid.New(), uuid.New()
+	tests := []struct {
+		name     string
+		assigned *uuid.UUID
+		user     uuid.UUID
+		want     bool
+	}{
+		{"unassigned coupon is open to anyone", nil, other, true},
+		{"owner", &owner, owner, true},
+		{"another user", &owner, other, false},
+		{"anonymous", &owner, uuid.Nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Coupon{AssignedUserID: tt.assigned}
+			if got := c.IsAssignedTo(tt.user); got != tt.want {
+				t.Errorf("IsAssignedTo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInRollout(t *testing.T) {
+	// Fixed IDs keep the bucket counts, and so the test, deterministic
+	couponID := uuid.NewSHA1(uuid.NameSpaceOID, []byte("rollout-coupon"))
+	users := make([]uuid.UUID, 10000)
+	for i := range users {
+		users[i] = uuid.NewSHA1(uuid.NameSpaceOID, []byte{byte(i >> 8), byte(i)})
+	}
+
+	tests := []struct {
+		percentage int
+		min, max   int
+	}{
+		{0, 10000, 10000},
+		{10, 900, 1100},
+		{50, 4800, 5200},
+		{100, 10000, 10000},
+	}
+	for _, tt := range tests {
+		c := &Coupon{ID: couponID, RolloutPercentage: tt.percentage}
+		in := 0
+		for _, user := range users {
+			got := c.InRollout(user)
+			if got != c.InRollout(user) {
+				t.Fatalf("%d%%: InRollout(%s) changed between calls", tt.percentage, user)
+			}
+			if got {
+				in++
+			}
+		}
+		if in < tt.min || in > tt.max {
+			t.Errorf("%d%%: %d of %d users in rollout, want %d to %d", tt.percentage, in, len(users), tt.min, tt.max)
+		}
+	}
+}
+
+func TestInRolloutGrowsWithPercentage(t *testing.T) {
+	c := &Coupon{ID: uuid.New()}
+	for i := 0; i < 1000; i++ {
+		user := uuid.New()
+		wasIn := false
+		for p := 1; p < 100; p++ {
+			c.RolloutPercentage = p
+			in := c.InRollout(user)
+			if wasIn && !in {
+				t.Fatalf("user %s left the rollout when it grew to %d%%", user, p)
+			}
+			wasIn = in
+		}
+	}
+}
+
+func TestDailyWindowContains(t *testing.T) {
+	// 2024-03-04 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+	ist := time.FixedZone("IST", 5*60*60+30*60)
+	happyHour := &DailyWindow{StartHour: 18, EndHour: 21}
+	overnight := &DailyWindow{StartHour: 22, EndHour: 2}
+	mondayNights := &DailyWindow{StartHour: 22, EndHour: 2, Weekdays: []time.Weekday{time.Monday}}
+
+	tests := []struct {
+		name   string
+		window *DailyWindow
+		t      time.Time
+		want   bool
+	}{
+		{"no window", nil, at(4, 3, 0), true},
+		{"start minute is inside", happyHour, at(4, 18, 0), true},
+		{"minute before the start", happyHour, at(4, 17, 59), false},
+		{"last minute is inside", happyHour, at(4, 20, 59), true},
+		{"end minute is outside", happyHour, at(4, 21, 0), false},
+		{"wrapping window before midnight", overnight, at(4, 23, 59), true},
+		{"wrapping window at midnight", overnight, at(5, 0, 0), true},
+		{"wrapping window at its end", overnight, at(5, 2, 0), false},
+		{"wrapping window before its start", overnight, at(4, 21, 59), false},
+		{"weekday of the opening night", mondayNights, at(4, 23, 0), true},
+		{"tail belongs to the day it opened", mondayNights, at(5, 1, 0), true},
+		{"tail of the night before", mondayNights, at(4, 1, 0), false},
+		{"hours are read in the time's location", happyHour, time.Date(2024, 3, 4, 19, 30, 0, 0, ist), true},
+		{"same instant in UTC", happyHour, time.Date(2024, 3, 4, 19, 30, 0, 0, ist).UTC(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.Contains(tt.t); got != tt.want {
+				t.Errorf("Contains(%s) = %v, want %v", tt.t.Format(time.RFC3339), got, tt.want)
+			}
+		})
+	}
+}
+
+// appliesToByScan is AppliesTo as it was before restrictions were indexed:
+// every cart item is compared with every restricted medicine and category.
+func appliesToByScan(c *Coupon, cartItems []Medicine) bool {
+	if !c.IsRestricted() {
+		return true
+	}
+	for _, item := range cartItems {
+		for _, medicine := range c.ApplicableMedicines {
+			if medicine.ID == item.ID {
+				return true
+			}
+		}
+		for _, category := range c.ApplicableCategories {
+			if SameCategory(category.Name, item.Category) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func BenchmarkAppliesTo(b *testing.B) {
+	// A large coupon against a large cart it does not apply to, so both
+	// versions have to look at everything
+	coupon := &Coupon{}
+	for i := 0; i < 1000; i++ {
+		coupon.ApplicableMedicines = append(coupon.ApplicableMedicines, Medicine{ID: uuid.New()})
+	}
+	for i := 0; i < 100; i++ {
+		coupon.ApplicableCategories = append(coupon.ApplicableCategories, Category{ID: uuid.New(), Name: fmt.Sprintf("Category %d", i)})
+	}
+	cart := make([]Medicine, 200)
+	for i := range cart {
+		cart[i] = Medicine{ID: uuid.New(), Category: fmt.Sprintf("other %d", i)}
+	}
+	if coupon.AppliesTo(cart) != appliesToByScan(coupon, cart) {
+		b.Fatal("AppliesTo and appliesToByScan disagree")
+	}
+
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			appliesToByScan(coupon, cart)
+		}
+	})
+	b.Run("lookup", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			coupon.AppliesTo(cart)
+		}
+	})
+}
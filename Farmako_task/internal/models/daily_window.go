@@ -0,0 +1,78 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// DailyWindow limits a coupon to the same hours every day, e.g. a 18-21
+// happy hour, optionally only on some weekdays. Hours are whole hours in the
+// server's local time; the window covers [StartHour:00, EndHour:00). A
+// window with StartHour after EndHour wraps past midnight, so 22-2 runs from
+// 22:00 to 01:59, and its weekday is the day it opens on.
+type DailyWindow struct {
+	StartHour int            `json:"start_hour" binding:"gte=0,lte=23"`
+	EndHour   int            `json:"end_hour" binding:"gte=0,lte=23,nefield=StartHour"`
+	Weekdays  []time.Weekday `json:"weekdays,omitempty" binding:"dive,gte=0,lte=6"`
+}
+
+// Contains reports whether t falls inside the window. A nil window contains
+// every time.
+func (w *DailyWindow) Contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+
+	hour, day := t.Hour(), t.Weekday()
+	switch {
+	case w.StartHour < w.EndHour:
+		if hour < w.StartHour || hour >= w.EndHour {
+			return false
+		}
+	case hour >= w.StartHour:
+	case hour < w.EndHour:
+		// Early-morning tail of a window that opened the previous day
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range w.Weekdays {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// DailyWindow is stored as a JSONB column on the coupon.
+func (w DailyWindow) Value() (driver.Value, error) {
+	b, err := json.Marshal(w)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (w *DailyWindow) Scan(value interface{}) error {
+	if value == nil {
+		*w = DailyWindow{}
+		return nil
+	}
+
+	var b []byte
+	switch v := value.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into DailyWindow", value)
+	}
+	return json.Unmarshal(b, w)
+}
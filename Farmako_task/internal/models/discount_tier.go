@@ -0,0 +1,76 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// DiscountTier raises (or lowers) a coupon's discount value for orders whose
+// total is at least MinOrderTotal, e.g. 10% over 500 and 15% over 1000. The
+// value is interpreted with the coupon's DiscountType.
+type DiscountTier struct {
+	MinOrderTotal decimal.Decimal `json:"min_order_total"`
+	DiscountValue decimal.Decimal `json:"discount_value"`
+}
+
+// DiscountTiers is stored as a JSONB column on the coupon. Tiers are kept in
+// ascending MinOrderTotal order.
+type DiscountTiers []DiscountTier
+
+func (t DiscountTiers) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (t *DiscountTiers) Scan(value interface{}) error {
+	if value == nil {
+		*t = nil
+		return nil
+	}
+
+	var b []byte
+	switch v := value.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into DiscountTiers", value)
+	}
+	return json.Unmarshal(b, t)
+}
+
+// For returns the tier that applies to orderTotal: the one with the highest
+// MinOrderTotal not above it.
+func (t DiscountTiers) For(orderTotal decimal.Decimal) (DiscountTier, bool) {
+	var chosen DiscountTier
+	found := false
+	for _, tier := range t {
+		if orderTotal.GreaterThanOrEqual(tier.MinOrderTotal) &&
+			(!found || tier.MinOrderTotal.GreaterThan(chosen.MinOrderTotal)) {
+			chosen = tier
+			found = true
+		}
+	}
+	return chosen, found
+}
+
+// IsAscending reports whether the tiers' thresholds strictly increase, so no
+// two tiers compete for the same order total.
+func (t DiscountTiers) IsAscending() bool {
+	for i := 1; i < len(t); i++ {
+		if !t[i].MinOrderTotal.GreaterThan(t[i-1].MinOrderTotal) {
+			return false
+		}
+	}
+	return true
+}
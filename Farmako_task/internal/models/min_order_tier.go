@@ -0,0 +1,66 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// MinOrderTier lowers (or raises) a coupon's minimum order value for users
+// who redeemed a coupon on at least MinPriorOrders earlier orders.
+type MinOrderTier struct {
+	MinPriorOrders int             `json:"min_prior_orders" binding:"gte=0"`
+	MinOrderValue  decimal.Decimal `json:"min_order_value"`
+}
+
+// MinOrderTiers is stored as a JSONB column on the coupon.
+type MinOrderTiers []MinOrderTier
+
+func (t MinOrderTiers) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (t *MinOrderTiers) Scan(value interface{}) error {
+	if value == nil {
+		*t = nil
+		return nil
+	}
+
+	var b []byte
+	switch v := value.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into MinOrderTiers", value)
+	}
+	return json.Unmarshal(b, t)
+}
+
+// For returns the tier that applies to a user with priorOrders earlier coupon
+// orders: the one with the highest MinPriorOrders not above priorOrders.
+func (t MinOrderTiers) For(priorOrders int) (MinOrderTier, bool) {
+	sorted := make(MinOrderTiers, len(t))
+	copy(sorted, t)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].MinPriorOrders > sorted[j].MinPriorOrders
+	})
+
+	for _, tier := range sorted {
+		if priorOrders >= tier.MinPriorOrders {
+			return tier, true
+		}
+	}
+	return MinOrderTier{}, false
+}
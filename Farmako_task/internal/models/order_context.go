@@ -0,0 +1,22 @@
+package models
+
+import "github.com/shopspring/decimal"
+
+// OrderContext is the price breakdown of an order a coupon is checked
+// against. ItemsTotal is the cart subtotal; the delivery charge and taxes are
+// billed on top of it.
+type OrderContext struct {
+	ItemsTotal     decimal.Decimal
+	DeliveryCharge decimal.Decimal
+	Taxes          decimal.Decimal
+}
+
+// Charges returns everything billed on top of the items: delivery and taxes.
+func (o OrderContext) Charges() decimal.Decimal {
+	return o.DeliveryCharge.Add(o.Taxes)
+}
+
+// Total returns the full amount of the order before any discount.
+func (o OrderContext) Total() decimal.Decimal {
+	return o.ItemsTotal.Add(o.Charges())
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// PaymentMethods restricts a coupon to orders paid with one of the listed
+// methods, e.g. "upi" or "card". It is stored as a JSONB column on the coupon;
+// an empty list allows every method.
+type PaymentMethods []string
+
+func (p PaymentMethods) Value() (driver.Value, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (p *PaymentMethods) Scan(value interface{}) error {
+	if value == nil {
+		*p = nil
+		return nil
+	}
+
+	var b []byte
+	switch v := value.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into PaymentMethods", value)
+	}
+	return json.Unmarshal(b, p)
+}
+
+// Allows reports whether method is one of the listed methods, ignoring case
+// and surrounding space. An empty list allows any method, including none.
+func (p PaymentMethods) Allows(method string) bool {
+	if len(p) == 0 {
+		return true
+	}
+	method = strings.TrimSpace(method)
+	for _, allowed := range p {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize returns the methods trimmed, lower-cased and without empty
+// entries or duplicates, preserving their order.
+func (p PaymentMethods) Normalize() PaymentMethods {
+	var out PaymentMethods
+	seen := make(map[string]bool)
+	for _, method := range p {
+		method = strings.ToLower(strings.TrimSpace(method))
+		if method == "" || seen[method] {
+			continue
+		}
+		seen[method] = true
+		out = append(out, method)
+	}
+	return out
+}
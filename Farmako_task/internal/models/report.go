@@ -0,0 +1,55 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// LiabilityReport estimates the outstanding discount exposure of all active,
+// unexpired coupons.
+//
+// Most coupons carry no global redemption cap (MaxTotalUsage), so total
+// liability grows with the number of customers and cannot be bounded. The
+// report therefore gives the upper bound per customer: for every coupon whose
+// discount per redemption and redemptions per user are both bounded, maximum
+// discount per use times maximum uses per user, summed across coupons. Coupons for which either
+// factor is unbounded (percentage discounts without a maximum discount
+// amount, time-based usage) are listed in UnboundedCoupons and excluded from
+// the sum.
+type LiabilityReport struct {
+	ActiveCoupons       int               `json:"active_coupons"`
+	PerCustomerExposure decimal.Decimal   `json:"per_customer_exposure"`
+	UnboundedCoupons    []string          `json:"unbounded_coupons"`
+	Coupons             []CouponLiability `json:"coupons"`
+}
+
+// CouponLiability is one coupon's contribution to a LiabilityReport. Nil
+// fields are unbounded.
+type CouponLiability struct {
+	CouponID            uuid.UUID        `json:"coupon_id"`
+	Code                string           `json:"code"`
+	MaxDiscountPerUse   *decimal.Decimal `json:"max_discount_per_use"`
+	MaxUsesPerUser      *int             `json:"max_uses_per_user"`
+	PerCustomerExposure *decimal.Decimal `json:"per_customer_exposure"`
+}
+
+// PerformanceSort is the metric a coupon performance report ranks by.
+type PerformanceSort string
+
+const (
+	SortByRedemptions PerformanceSort = "redemptions"
+	SortByDiscount    PerformanceSort = "discount"
+)
+
+// IsValid reports whether s is a known sort metric.
+func (s PerformanceSort) IsValid() bool {
+	return s == SortByRedemptions || s == SortByDiscount
+}
+
+// CouponPerformance is one coupon's redemptions within a reporting window.
+type CouponPerformance struct {
+	CouponID      uuid.UUID       `json:"coupon_id"`
+	Code          string          `json:"code"`
+	Redemptions   int64           `json:"redemptions"`
+	TotalDiscount decimal.Decimal `json:"total_discount"`
+}
@@ -0,0 +1,34 @@
+package models
+
+import "github.com/shopspring/decimal"
+
+// RoundingMode controls how computed discounts are rounded to minor currency
+// units (paisa/cents).
+type RoundingMode string
+
+const (
+	RoundNearest RoundingMode = "nearest"
+	RoundFloor   RoundingMode = "floor"
+	RoundCeil    RoundingMode = "ceil"
+)
+
+// IsValid reports whether m is a known rounding mode.
+func (m RoundingMode) IsValid() bool {
+	switch m {
+	case RoundNearest, RoundFloor, RoundCeil:
+		return true
+	}
+	return false
+}
+
+// Round rounds amount to two decimal places according to m. Unknown modes
+// round to nearest.
+func (m RoundingMode) Round(amount decimal.Decimal) decimal.Decimal {
+	switch m {
+	case RoundFloor:
+		return amount.RoundFloor(2)
+	case RoundCeil:
+		return amount.RoundCeil(2)
+	}
+	return amount.Round(2)
+}
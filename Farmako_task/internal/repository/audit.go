@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"coupon-system/internal/models"
+	"coupon-system/internal/retry"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type actorKey struct{}
+
+// WithActor returns a context whose coupon mutations are attributed to
+// actorID in the audit log.
+func WithActor(ctx context.Context, actorID uuid.UUID) context.Context {
+	return context.WithValue(ctx, actorKey{}, actorID)
+}
+
+// actorFrom returns the actor set by WithActor, or nil for system changes.
+func actorFrom(ctx context.Context) *uuid.UUID {
+	if id, ok := ctx.Value(actorKey{}).(uuid.UUID); ok && id != uuid.Nil {
+		return &id
+	}
+	return nil
+}
+
+// writeAudit records a coupon mutation in tx, so the entry commits or rolls
+// back together with the change itself. before and after are stored as JSON;
+// either may be nil.
+func writeAudit(ctx context.Context, tx *gorm.DB, action models.AuditAction, couponID uuid.UUID, before, after interface{}) error {
+	entry := models.AuditLog{
+		ID:        uuid.New(),
+		CouponID:  couponID,
+		ActorID:   actorFrom(ctx),
+		Action:    action,
+		CreatedAt: time.Now(),
+	}
+	var err error
+	if entry.Before, err = snapshot(before); err != nil {
+		return err
+	}
+	if entry.After, err = snapshot(after); err != nil {
+		return err
+	}
+	return tx.Create(&entry).Error
+}
+
+func snapshot(v interface{}) (models.JSONSnapshot, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// ListAuditLog returns the audit trail of a coupon, oldest first.
+func (r *CouponRepository) ListAuditLog(ctx context.Context, couponID uuid.UUID) ([]models.AuditLog, error) {
+	entries := []models.AuditLog{}
+	err := retry.Do(ctx, func() error {
+		entries = entries[:0]
+		return r.db.WithContext(ctx).
+			Where("coupon_id = ?", couponID).
+			Order("created_at, id").
+			Find(&entries).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
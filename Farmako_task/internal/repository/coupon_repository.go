@@ -1,138 +1,1023 @@
-package repository
-
-import (
-	"context"
-	"errors"
-	"time"
-
-	"coupon-system/internal/models"
-
-	"github.com/google/uuid"
-	"gorm.io/gorm"
-)
-
-type CouponRepository struct {
-	db *gorm.DB
-}
-
-func NewCouponRepository(db *gorm.DB) *CouponRepository {
-	return &CouponRepository{db: db}
-}
-
-func (r *CouponRepository) Create(ctx context.Context, coupon *models.Coupon) error {
-	return r.db.WithContext(ctx).Create(coupon).Error
-}
-
-func (r *CouponRepository) GetByCode(ctx context.Context, code string) (*models.Coupon, error) {
-	var coupon models.Coupon
-	err := r.db.WithContext(ctx).
-		Preload("ApplicableMedicines").
-		Preload("ApplicableCategories").
-		Where("code = ? AND is_active = true", code).
-		First(&coupon).Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	return &coupon, nil
-}
-
-func (r *CouponRepository) GetApplicableCoupons(ctx context.Context, cartItems []models.Medicine, orderTotal float64) ([]models.Coupon, error) {
-	var coupons []models.Coupon
-	now := time.Now()
-
-	// Get all active coupons that haven't expired and meet the minimum order value
-	query := r.db.WithContext(ctx).
-		Preload("ApplicableMedicines").
-		Preload("ApplicableCategories").
-		Where("is_active = true AND expiry_date > ? AND min_order_value <= ?", now, orderTotal)
-
-	err := query.Find(&coupons).Error
-	if err != nil {
-		return nil, err
-	}
-
-	// Filter coupons based on medicine and category restrictions
-	var applicableCoupons []models.Coupon
-	for _, coupon := range coupons {
-		if isApplicableToCoupon(coupon, cartItems) {
-			applicableCoupons = append(applicableCoupons, coupon)
-		}
-	}
-
-	return applicableCoupons, nil
-}
-
-func (r *CouponRepository) GetUserCouponUsage(ctx context.Context, couponID, userID uuid.UUID) (int, error) {
-	var count int64
-	err := r.db.WithContext(ctx).Model(&models.CouponUsage{}).
-		Where("coupon_id = ? AND user_id = ?", couponID, userID).
-		Count(&count).Error
-	return int(count), err
-}
-
-func (r *CouponRepository) RecordCouponUsage(ctx context.Context, usage *models.CouponUsage) error {
-	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-		// Check if the coupon is still valid
-		var coupon models.Coupon
-		if err := tx.WithContext(ctx).Where("id = ? AND is_active = true", usage.CouponID).First(&coupon).Error; err != nil {
-			return err
-		}
-
-		// For one-time use coupons, check if it's been used before
-		if coupon.UsageType == models.OneTime {
-			var count int64
-			if err := tx.WithContext(ctx).Model(&models.CouponUsage{}).
-				Where("coupon_id = ? AND user_id = ?", usage.CouponID, usage.UserID).
-				Count(&count).Error; err != nil {
-				return err
-			}
-			if count > 0 {
-				return errors.New("one-time coupon already used")
-			}
-		}
-
-		// For multi-use coupons, check usage limit
-		if coupon.UsageType == models.MultiUse {
-			var count int64
-			if err := tx.WithContext(ctx).Model(&models.CouponUsage{}).
-				Where("coupon_id = ? AND user_id = ?", usage.CouponID, usage.UserID).
-				Count(&count).Error; err != nil {
-				return err
-			}
-			if int(count) >= coupon.MaxUsagePerUser {
-				return errors.New("coupon usage limit exceeded")
-			}
-		}
-
-		// Record the usage
-		return tx.WithContext(ctx).Create(usage).Error
-	})
-}
-
-func isApplicableToCoupon(coupon models.Coupon, cartItems []models.Medicine) bool {
-	if len(coupon.ApplicableMedicines) == 0 && len(coupon.ApplicableCategories) == 0 {
-		return true
-	}
-
-	// Check if any cart item matches the coupon's medicine restrictions
-	for _, item := range cartItems {
-		// Check direct medicine match
-		for _, medicine := range coupon.ApplicableMedicines {
-			if item.ID == medicine.ID {
-				return true
-			}
-		}
-
-		// Check category match
-		for _, category := range coupon.ApplicableCategories {
-			if item.Category == category.Name {
-				return true
-			}
-		}
-	}
-
-	return false
-}
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"coupon-system/internal/logging"
+	"coupon-system/internal/models"
+	"coupon-system/internal/retry"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrDuplicateCode is returned by Create when the coupon code is already taken.
+var ErrDuplicateCode = errors.New("coupon code already exists")
+
+// ErrJobLocked is returned by DeactivateExpired when another instance is
+// already running the cleanup.
+var ErrJobLocked = errors.New("job is already running elsewhere")
+
+// UsageRecord is a coupon redemption joined with the code of the coupon used.
+type UsageRecord struct {
+	models.CouponUsage
+	CouponCode string `json:"coupon_code"`
+}
+
+// ErrVersionConflict is returned by Update when the coupon was modified since
+// the caller read it.
+var ErrVersionConflict = errors.New("coupon was modified concurrently; reload and retry")
+
+// ErrCouponAlreadyUsed and ErrUsageLimitExceeded are returned by
+// RecordCouponUsage when the user may no longer redeem the coupon;
+// ErrOrderHasCoupon when the order already has a coupon applied.
+var (
+	ErrCouponAlreadyUsed  = errors.New("one-time coupon already used")
+	ErrUsageLimitExceeded = errors.New("coupon usage limit exceeded")
+	ErrOrderHasCoupon     = errors.New("order already has a coupon applied")
+)
+
+// catalogUpserts omits the medicine and category rows from association saves
+// so that linking a coupon only writes the join tables.
+var catalogUpserts = []string{"ApplicableMedicines.*", "ApplicableCategories.*"}
+
+type CouponRepository struct {
+	db *gorm.DB
+}
+
+func NewCouponRepository(db *gorm.DB) *CouponRepository {
+	return &CouponRepository{db: db}
+}
+
+// Create inserts the coupon and links it to its applicable medicines and
+// categories by ID. The catalog rows themselves are never inserted or updated.
+// The creation is audited in the same transaction.
+func (r *CouponRepository) Create(ctx context.Context, coupon *models.Coupon) error {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(catalogUpserts...).Create(coupon).Error; err != nil {
+			return err
+		}
+		return writeAudit(ctx, tx, models.AuditCreate, coupon.ID, nil, coupon)
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrDuplicateCode
+	}
+	return err
+}
+
+// CreateBatch inserts coupons in a single transaction, each as Create would.
+// Every insert runs under its own savepoint, so a coupon whose code is taken
+// is skipped and reported as ErrDuplicateCode at its index in errs while the
+// others are still committed. Any other failure rolls back the whole batch.
+func (r *CouponRepository) CreateBatch(ctx context.Context, coupons []*models.Coupon) (errs []error, err error) {
+	errs = make([]error, len(coupons))
+	err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i, coupon := range coupons {
+			savepoint := fmt.Sprintf("coupon_%d", i)
+			if err := tx.SavePoint(savepoint).Error; err != nil {
+				return err
+			}
+
+			err := tx.Omit(catalogUpserts...).Create(coupon).Error
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				if err := tx.RollbackTo(savepoint).Error; err != nil {
+					return err
+				}
+				errs[i] = ErrDuplicateCode
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := writeAudit(ctx, tx, models.AuditCreate, coupon.ID, nil, coupon); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// Update overwrites the coupon's definition and its medicine and category
+// associations, provided its stored version still equals expectedVersion. On
+// success coupon.Version is advanced and the change is audited with the
+// coupon's previous state; otherwise ErrVersionConflict is returned and
+// nothing is written.
+func (r *CouponRepository) Update(ctx context.Context, coupon *models.Coupon, expectedVersion int) error {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var before models.Coupon
+		if err := tx.Preload("ApplicableMedicines").Preload("ApplicableCategories").
+			Where("id = ?", coupon.ID).First(&before).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrVersionConflict
+			}
+			return err
+		}
+
+		coupon.Version = expectedVersion + 1
+		res := tx.Model(coupon).
+			Where("version = ?", expectedVersion).
+			Select("*").
+			Omit("ID", "CreatedAt", "DeletedAt", "IsActive", "TimesUsed", clause.Associations).
+			Updates(coupon)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrVersionConflict
+		}
+
+		links := tx.Omit(catalogUpserts...).Model(coupon)
+		if err := links.Association("ApplicableMedicines").Replace(coupon.ApplicableMedicines); err != nil {
+			return err
+		}
+		if err := links.Association("ApplicableCategories").Replace(coupon.ApplicableCategories); err != nil {
+			return err
+		}
+		return writeAudit(ctx, tx, models.AuditUpdate, coupon.ID, &before, coupon)
+	})
+	if err != nil {
+		coupon.Version = expectedVersion
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrDuplicateCode
+	}
+	return err
+}
+
+// UpdateLinks applies op to one of the coupon's catalog associations,
+// "ApplicableMedicines" or "ApplicableCategories", with refs a slice of
+// ID-only medicines or categories. The coupon's version is advanced and the
+// change audited in the same transaction. It returns gorm.ErrRecordNotFound
+// if the coupon does not exist.
+func (r *CouponRepository) UpdateLinks(ctx context.Context, couponID uuid.UUID, association string, op models.LinkOp, refs interface{}) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var before models.Coupon
+		if err := tx.Preload("ApplicableMedicines").Preload("ApplicableCategories").
+			Where("id = ?", couponID).First(&before).Error; err != nil {
+			return err
+		}
+
+		// The association API rewrites the model's field, so work on a copy
+		// to keep before intact for the audit entry
+		target := models.Coupon{ID: couponID}
+		links := tx.Omit(catalogUpserts...).Model(&target).Association(association)
+		var err error
+		switch op {
+		case models.LinkAdd:
+			err = links.Append(refs)
+		case models.LinkRemove:
+			err = links.Delete(refs)
+		default:
+			err = links.Replace(refs)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&models.Coupon{}).Where("id = ?", couponID).Updates(map[string]interface{}{
+			"version":    gorm.Expr("version + 1"),
+			"updated_at": time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		var after models.Coupon
+		if err := tx.Preload("ApplicableMedicines").Preload("ApplicableCategories").
+			Where("id = ?", couponID).First(&after).Error; err != nil {
+			return err
+		}
+		return writeAudit(ctx, tx, models.AuditUpdate, couponID, &before, &after)
+	})
+}
+
+// GetByCode returns the active coupon with the given code, or nil if there is
+// none. It backs customer-facing validation; admin lookups use
+// GetByCodeIncludingInactive.
+func (r *CouponRepository) GetByCode(ctx context.Context, code string) (*models.Coupon, error) {
+	return r.getByCode(ctx, code, true)
+}
+
+// GetByCodeIncludingInactive is GetByCode for admins: deactivated coupons are
+// returned too. Soft-deleted coupons stay hidden.
+func (r *CouponRepository) GetByCodeIncludingInactive(ctx context.Context, code string) (*models.Coupon, error) {
+	return r.getByCode(ctx, code, false)
+}
+
+// GetByCodes is GetByCode for several codes in one query. The result is keyed
+// by normalized code (see models.NormalizeCode); codes with no active coupon
+// are absent from it.
+func (r *CouponRepository) GetByCodes(ctx context.Context, codes []string) (map[string]*models.Coupon, error) {
+	found := make(map[string]*models.Coupon, len(codes))
+	if len(codes) == 0 {
+		return found, nil
+	}
+
+	normalized := make([]string, len(codes))
+	for i, code := range codes {
+		normalized[i] = models.NormalizeCode(code)
+	}
+
+	var coupons []models.Coupon
+	err := retry.Do(ctx, func() error {
+		coupons = nil
+		return r.db.WithContext(ctx).
+			Preload("ApplicableMedicines").
+			Preload("ApplicableCategories").
+			Where("code IN ? AND is_active = true", normalized).
+			Find(&coupons).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range coupons {
+		found[coupons[i].Code] = &coupons[i]
+	}
+	return found, nil
+}
+
+func (r *CouponRepository) getByCode(ctx context.Context, code string, activeOnly bool) (*models.Coupon, error) {
+	var coupon models.Coupon
+	err := retry.Do(ctx, func() error {
+		query := r.db.WithContext(ctx).
+			Preload("ApplicableMedicines").
+			Preload("ApplicableCategories").
+			Where("code = ?", models.NormalizeCode(code))
+		if activeOnly {
+			query = query.Where("is_active = true")
+		}
+		return query.First(&coupon).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+// MissingReferences returns the medicine and category IDs among medicineIDs
+// and categoryIDs that have no matching catalog row.
+func (r *CouponRepository) MissingReferences(ctx context.Context, medicineIDs, categoryIDs []uuid.UUID) (missingMedicines, missingCategories []uuid.UUID, err error) {
+	missingMedicines, err = r.missingIDs(ctx, &models.Medicine{}, medicineIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	missingCategories, err = r.missingIDs(ctx, &models.Category{}, categoryIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return missingMedicines, missingCategories, nil
+}
+
+func (r *CouponRepository) missingIDs(ctx context.Context, model interface{}, ids []uuid.UUID) ([]uuid.UUID, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var found []uuid.UUID
+	err := retry.Do(ctx, func() error {
+		found = nil
+		return r.db.WithContext(ctx).Model(model).Where("id IN ?", ids).Pluck("id", &found).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[uuid.UUID]bool, len(found))
+	for _, id := range found {
+		exists[id] = true
+	}
+
+	var missing []uuid.UUID
+	for _, id := range ids {
+		if !exists[id] {
+			missing = append(missing, id)
+			exists[id] = true
+		}
+	}
+	return missing, nil
+}
+
+// SearchByCodePrefix returns up to limit coupons, active or not, whose code
+// starts with prefix ignoring case, ordered by code. The lower(code) index
+// (idx_coupons_code_prefix) serves the query.
+func (r *CouponRepository) SearchByCodePrefix(ctx context.Context, prefix string, limit int) ([]models.CouponSearchResult, error) {
+	pattern := likeEscaper.Replace(strings.ToLower(prefix)) + "%"
+
+	results := []models.CouponSearchResult{}
+	err := retry.Do(ctx, func() error {
+		results = results[:0]
+		return r.db.WithContext(ctx).Model(&models.Coupon{}).
+			Select("id, code, discount_type, discount_value, is_active, expiry_date").
+			Where("lower(code) LIKE ?", pattern).
+			Order("code").
+			Limit(limit).
+			Scan(&results).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// TopCoupons ranks coupons by their redemptions with used_at in [from, to),
+// best first, and returns at most limit of them. Ties on the chosen metric
+// are broken by the other metric, then by code.
+func (r *CouponRepository) TopCoupons(ctx context.Context, from, to time.Time, sortBy models.PerformanceSort, limit int) ([]models.CouponPerformance, error) {
+	order := "redemptions DESC, total_discount DESC, coupons.code"
+	if sortBy == models.SortByDiscount {
+		order = "total_discount DESC, redemptions DESC, coupons.code"
+	}
+
+	results := []models.CouponPerformance{}
+	err := retry.Do(ctx, func() error {
+		results = results[:0]
+		return r.db.WithContext(ctx).Model(&models.CouponUsage{}).
+			Select(`coupon_usages.coupon_id,
+				coupons.code,
+				COUNT(*) AS redemptions,
+				COALESCE(SUM(coupon_usages.discount_applied), 0) AS total_discount`).
+			Joins("JOIN coupons ON coupons.id = coupon_usages.coupon_id").
+			Where("coupon_usages.used_at >= ? AND coupon_usages.used_at < ?", from, to).
+			Group("coupon_usages.coupon_id, coupons.code").
+			Order(order).
+			Limit(limit).
+			Scan(&results).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// likeEscaper escapes LIKE wildcards so user input matches literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// GetByID returns the coupon with the given ID regardless of whether it is
+// active, or nil if it does not exist.
+func (r *CouponRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Coupon, error) {
+	var coupon models.Coupon
+	err := retry.Do(ctx, func() error {
+		return r.db.WithContext(ctx).
+			Preload("ApplicableMedicines").
+			Preload("ApplicableCategories").
+			Where("id = ?", id).
+			First(&coupon).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+// GetApplicableCoupons returns the active coupons userID may apply to the cart
+// for some order total in [minTotal, maxTotal]. Coupons assigned to other
+// users are excluded.
+func (r *CouponRepository) GetApplicableCoupons(ctx context.Context, userID uuid.UUID, cartItems []models.Medicine, minTotal, maxTotal decimal.Decimal) ([]models.Coupon, error) {
+	var coupons []models.Coupon
+	now := time.Now()
+
+	medicineIDs := make([]uuid.UUID, 0, len(cartItems))
+	categoryNames := make([]string, 0, len(cartItems))
+	for _, item := range cartItems {
+		medicineIDs = append(medicineIDs, item.ID)
+		categoryNames = append(categoryNames, strings.ToLower(strings.TrimSpace(item.Category)))
+	}
+
+	// Get all active coupons that haven't expired, whose order value range
+	// overlaps [minTotal, maxTotal] and that are either unrestricted or
+	// restricted to something in the cart. Tiered minimums depend on the
+	// user's history and some minimums count delivery and taxes, neither of
+	// which is known here, so those coupons are left to the caller
+	query := r.db.WithContext(ctx).
+		Preload("ApplicableMedicines").
+		Preload("ApplicableCategories").
+		Where("is_active = true AND expiry_date > ?", now).
+		Where("min_order_value <= ? OR min_order_includes_charges OR min_order_tiers IS NOT NULL", maxTotal).
+		Where("max_order_value = 0 OR max_order_value >= ?", minTotal).
+		Where("assigned_user_id IS NULL OR assigned_user_id = ?", userID).
+		Where("start_date IS NULL OR start_date <= ?", now).
+		Where(`(
+			NOT EXISTS (SELECT 1 FROM coupon_medicines cm WHERE cm.coupon_id = coupons.id)
+			AND NOT EXISTS (SELECT 1 FROM coupon_categories cc WHERE cc.coupon_id = coupons.id)
+		) OR EXISTS (
+			SELECT 1 FROM coupon_medicines cm
+			WHERE cm.coupon_id = coupons.id AND cm.medicine_id IN ?
+		) OR EXISTS (
+			SELECT 1 FROM coupon_categories cc
+			JOIN categories ON categories.id = cc.category_id
+			WHERE cc.coupon_id = coupons.id AND LOWER(TRIM(categories.name)) IN ?
+		)`, medicineIDs, categoryNames)
+
+	err := retry.Do(ctx, func() error {
+		coupons = nil
+		return query.Session(&gorm.Session{}).Find(&coupons).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The query above already applied the medicine and category restrictions;
+	// re-check in Go as a safeguard against the two drifting apart
+	var applicableCoupons []models.Coupon
+	for _, coupon := range coupons {
+		if coupon.AppliesTo(cartItems) && coupon.IsAssignedTo(userID) {
+			applicableCoupons = append(applicableCoupons, coupon)
+		}
+	}
+
+	return applicableCoupons, nil
+}
+
+// ListOffersForMedicine returns the active, started, unexpired coupons that
+// could apply to the medicine: those restricted to it, to its category, or
+// not restricted at all. Coupons assigned to a user are left out.
+func (r *CouponRepository) ListOffersForMedicine(ctx context.Context, medicineID uuid.UUID, now time.Time) ([]models.CouponOffer, error) {
+	offers := []models.CouponOffer{}
+	err := retry.Do(ctx, func() error {
+		offers = offers[:0]
+		return r.db.WithContext(ctx).Model(&models.Coupon{}).
+			Select("id, code, discount_type, discount_value, min_order_value, max_discount_amount, daily_window, expiry_date").
+			Where("is_active = true AND expiry_date > ?", now).
+			Where("start_date IS NULL OR start_date <= ?", now).
+			Where("assigned_user_id IS NULL").
+			Where(`(
+				NOT EXISTS (SELECT 1 FROM coupon_medicines cm WHERE cm.coupon_id = coupons.id)
+				AND NOT EXISTS (SELECT 1 FROM coupon_categories cc WHERE cc.coupon_id = coupons.id)
+			) OR EXISTS (
+				SELECT 1 FROM coupon_medicines cm
+				WHERE cm.coupon_id = coupons.id AND cm.medicine_id = ?
+			) OR EXISTS (
+				SELECT 1 FROM coupon_categories cc
+				JOIN categories ON categories.id = cc.category_id
+				JOIN medicines ON LOWER(TRIM(medicines.category)) = LOWER(TRIM(categories.name))
+				WHERE cc.coupon_id = coupons.id AND medicines.id = ?
+			)`, medicineID, medicineID).
+			Order("code").
+			Scan(&offers).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return offers, nil
+}
+
+// CountActive counts the active coupons that have not expired as of now.
+func (r *CouponRepository) CountActive(ctx context.Context, now time.Time) (int64, error) {
+	var count int64
+	err := retry.Do(ctx, func() error {
+		return r.db.WithContext(ctx).Model(&models.Coupon{}).
+			Where("is_active = true AND expiry_date > ?", now).
+			Count(&count).Error
+	})
+	return count, err
+}
+
+// ListActive returns all active coupons that have not expired as of now.
+func (r *CouponRepository) ListActive(ctx context.Context, now time.Time) ([]models.Coupon, error) {
+	var coupons []models.Coupon
+	err := retry.Do(ctx, func() error {
+		coupons = nil
+		return r.db.WithContext(ctx).
+			Where("is_active = true AND expiry_date > ?", now).
+			Order("code").
+			Find(&coupons).Error
+	})
+	return coupons, err
+}
+
+// DeactivateExpired marks every active coupon whose expiry has passed as
+// inactive and returns how many were changed. Replicas running the cleanup
+// concurrently are serialized with a transaction-scoped advisory lock: a
+// caller that finds it held returns ErrJobLocked without doing anything. The
+// lock is released on commit, or by Postgres if the holder's connection dies.
+func (r *CouponRepository) DeactivateExpired(ctx context.Context) (int64, error) {
+	var affected int64
+	err := retry.Do(ctx, func() error {
+		return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			var locked bool
+			if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", expiryJobLockKey).Scan(&locked).Error; err != nil {
+				return err
+			}
+			if !locked {
+				return ErrJobLocked
+			}
+
+			var err error
+			affected, err = deactivateIn(ctx, tx, "expiry_date < ?", time.Now())
+			return err
+		})
+	})
+	return affected, err
+}
+
+// DeactivateByPrefix deactivates every active coupon whose code starts with
+// prefix, case-insensitively, and returns how many were deactivated.
+func (r *CouponRepository) DeactivateByPrefix(ctx context.Context, prefix string) (int64, error) {
+	pattern := likeEscaper.Replace(strings.ToLower(prefix)) + "%"
+	return r.deactivateWhere(ctx, "lower(code) LIKE ?", pattern)
+}
+
+// DeactivateByCodes deactivates the active coupons with the given codes and
+// returns how many were deactivated. Unknown codes are ignored.
+func (r *CouponRepository) DeactivateByCodes(ctx context.Context, codes []string) (int64, error) {
+	normalized := make([]string, len(codes))
+	for i, code := range codes {
+		normalized[i] = models.NormalizeCode(code)
+	}
+	return r.deactivateWhere(ctx, "code IN ?", normalized)
+}
+
+// deactivateWhere flips the matching active coupons off in a single UPDATE,
+// so a partial failure never leaves part of a campaign live, and audits each
+// deactivated coupon in the same transaction.
+func (r *CouponRepository) deactivateWhere(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	var affected int64
+	err := retry.Do(ctx, func() error {
+		return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			var err error
+			affected, err = deactivateIn(ctx, tx, query, args...)
+			return err
+		})
+	})
+	return affected, err
+}
+
+// deactivateIn is the body of deactivateWhere, run in the caller's
+// transaction.
+func deactivateIn(ctx context.Context, tx *gorm.DB, query string, args ...interface{}) (int64, error) {
+	var deactivated []models.Coupon
+	res := tx.Model(&deactivated).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}}}).
+		Where("is_active = true").
+		Where(query, args...).
+		Update("is_active", false)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+
+	for _, coupon := range deactivated {
+		err := writeAudit(ctx, tx, models.AuditDeactivate, coupon.ID,
+			map[string]bool{"is_active": true}, map[string]bool{"is_active": false})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return res.RowsAffected, nil
+}
+
+// GetUserCouponUsage counts the user's redemptions of the coupon made at or
+// after since; a zero since counts them all.
+func (r *CouponRepository) GetUserCouponUsage(ctx context.Context, couponID, userID uuid.UUID, since time.Time) (int, error) {
+	var count int64
+	err := retry.Do(ctx, func() error {
+		query := r.db.WithContext(ctx).Model(&models.CouponUsage{}).
+			Where("coupon_id = ? AND user_id = ?", couponID, userID)
+		if !since.IsZero() {
+			query = query.Where("used_at >= ?", since)
+		}
+		return query.Count(&count).Error
+	})
+	return int(count), err
+}
+
+// CountCouponOrders counts the distinct orders, other than excludeOrderID, on
+// which the user has redeemed a coupon. Orders placed without a coupon never
+// reach this service, so it is a lower bound on the user's order history.
+func (r *CouponRepository) CountCouponOrders(ctx context.Context, userID, excludeOrderID uuid.UUID) (int, error) {
+	var count int64
+	err := retry.Do(ctx, func() error {
+		return r.db.WithContext(ctx).Model(&models.CouponUsage{}).
+			Where("user_id = ? AND order_id <> ?", userID, excludeOrderID).
+			Distinct("order_id").
+			Count(&count).Error
+	})
+	return int(count), err
+}
+
+// GetCouponStats aggregates the redemptions of a coupon in SQL.
+func (r *CouponRepository) GetCouponStats(ctx context.Context, couponID uuid.UUID) (*models.CouponStats, error) {
+	stats := models.CouponStats{CouponID: couponID}
+	err := retry.Do(ctx, func() error {
+		return r.db.WithContext(ctx).Model(&models.CouponUsage{}).
+			Select(`COUNT(*) AS total_redemptions,
+				COUNT(DISTINCT user_id) AS unique_users,
+				COALESCE(SUM(discount_applied), 0) AS total_discount_granted,
+				MIN(used_at) AS first_used_at,
+				MAX(used_at) AS last_used_at`).
+			Where("coupon_id = ?", couponID).
+			Group("coupon_id").
+			Scan(&stats).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// ReconcileUsage recounts the coupon's usage rows and, if its TimesUsed
+// counter disagrees, overwrites the counter and audits the correction. The
+// coupon row is locked for the duration so no redemption can interleave. It
+// returns nil if the coupon does not exist.
+func (r *CouponRepository) ReconcileUsage(ctx context.Context, couponID uuid.UUID) (*models.UsageReconciliation, error) {
+	var result *models.UsageReconciliation
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var coupon models.Coupon
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "times_used").
+			Where("id = ?", couponID).
+			First(&coupon).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&models.CouponUsage{}).Where("coupon_id = ?", couponID).Count(&count).Error; err != nil {
+			return err
+		}
+
+		result = &models.UsageReconciliation{
+			CouponID:  couponID,
+			Before:    coupon.TimesUsed,
+			After:     count,
+			Corrected: count != coupon.TimesUsed,
+		}
+		if !result.Corrected {
+			return nil
+		}
+
+		if err := tx.Model(&models.Coupon{}).Where("id = ?", couponID).
+			UpdateColumn("times_used", count).Error; err != nil {
+			return err
+		}
+		return writeAudit(ctx, tx, models.AuditUpdate, couponID,
+			map[string]int64{"times_used": coupon.TimesUsed}, map[string]int64{"times_used": count})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CountOrderUsages returns how many coupons, and how many uses of couponID
+// specifically, have been recorded against an order.
+func (r *CouponRepository) CountOrderUsages(ctx context.Context, orderID, couponID uuid.UUID) (total, sameCoupon int, err error) {
+	var counts struct {
+		Total      int64
+		SameCoupon int64
+	}
+	err = retry.Do(ctx, func() error {
+		return r.db.WithContext(ctx).Model(&models.CouponUsage{}).
+			Select("COUNT(*) AS total, COUNT(*) FILTER (WHERE coupon_id = ?) AS same_coupon", couponID).
+			Where("order_id = ?", orderID).
+			Scan(&counts).Error
+	})
+	return int(counts.Total), int(counts.SameCoupon), err
+}
+
+// SumOrderDiscount returns the total discount already granted to an order by
+// the coupons recorded against it.
+func (r *CouponRepository) SumOrderDiscount(ctx context.Context, orderID uuid.UUID) (decimal.Decimal, error) {
+	var total decimal.Decimal
+	err := retry.Do(ctx, func() error {
+		return r.db.WithContext(ctx).Model(&models.CouponUsage{}).
+			Select("COALESCE(SUM(discount_applied), 0)").
+			Where("order_id = ?", orderID).
+			Scan(&total).Error
+	})
+	return total, err
+}
+
+// RecordCouponUsage inserts usage after re-checking, inside a transaction, that
+// the coupon is active, that the user has uses left, and that the order does
+// not already carry this coupon (or, unless allowStacking, any coupon).
+// Concurrent redemptions of the same coupon by the same user are serialized
+// with a transaction-scoped advisory lock, so the usage counts cannot race;
+// without stacking, so are concurrent redemptions for the same order.
+func (r *CouponRepository) RecordCouponUsage(ctx context.Context, usage *models.CouponUsage, allowStacking bool) error {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// The unique index only covers (order_id, coupon_id), so two
+		// different coupons could otherwise both find the order empty. The
+		// order lock is always taken first, so the two locks cannot deadlock
+		if !allowStacking {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", orderLockKey(usage.OrderID)).Error; err != nil {
+				return err
+			}
+		}
+
+		// Under READ COMMITTED two transactions could both count N-1 prior
+		// uses and both insert; holding the lock until commit makes the second
+		// one count after the first has committed
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", redemptionLockKey(usage.CouponID, usage.UserID)).Error; err != nil {
+			return err
+		}
+
+		// Check if the coupon is still valid
+		var coupon models.Coupon
+		if err := tx.WithContext(ctx).Where("id = ? AND is_active = true", usage.CouponID).First(&coupon).Error; err != nil {
+			return err
+		}
+
+		// Enforce one coupon per order unless stacking is allowed; the same
+		// coupon can never be applied to an order twice
+		var orderUsages int64
+		query := tx.WithContext(ctx).Model(&models.CouponUsage{}).Where("order_id = ?", usage.OrderID)
+		if allowStacking {
+			query = query.Where("coupon_id = ?", usage.CouponID)
+		}
+		if err := query.Count(&orderUsages).Error; err != nil {
+			return err
+		}
+		if orderUsages > 0 {
+			return ErrOrderHasCoupon
+		}
+
+		// For one-time use coupons, check if it's been used before
+		if coupon.UsageType == models.OneTime {
+			var count int64
+			if err := tx.WithContext(ctx).Model(&models.CouponUsage{}).
+				Where("coupon_id = ? AND user_id = ?", usage.CouponID, usage.UserID).
+				Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				logging.FromContext(ctx).Warn("rejected redemption of used one-time coupon",
+					"coupon_id", usage.CouponID,
+					"user_id", usage.UserID,
+				)
+				return ErrCouponAlreadyUsed
+			}
+		}
+
+		// For multi-use coupons, check usage limit
+		if coupon.UsageType == models.MultiUse {
+			var count int64
+			if err := tx.WithContext(ctx).Model(&models.CouponUsage{}).
+				Where("coupon_id = ? AND user_id = ?", usage.CouponID, usage.UserID).
+				Count(&count).Error; err != nil {
+				return err
+			}
+			if int(count) >= coupon.MaxUsagePerUser {
+				logging.FromContext(ctx).Warn("rejected redemption over usage limit",
+					"coupon_id", usage.CouponID,
+					"user_id", usage.UserID,
+					"usage_count", count,
+				)
+				return ErrUsageLimitExceeded
+			}
+		}
+
+		// Enforce the rolling daily cap, whatever the usage type
+		if coupon.MaxUsagePerUserDay > 0 {
+			var count int64
+			if err := tx.WithContext(ctx).Model(&models.CouponUsage{}).
+				Where("coupon_id = ? AND user_id = ? AND used_at >= ?", usage.CouponID, usage.UserID, usage.UsedAt.Add(-24*time.Hour)).
+				Count(&count).Error; err != nil {
+				return err
+			}
+			if int(count) >= coupon.MaxUsagePerUserDay {
+				logging.FromContext(ctx).Warn("rejected redemption over daily usage limit",
+					"coupon_id", usage.CouponID,
+					"user_id", usage.UserID,
+					"usage_count", count,
+				)
+				return ErrUsageLimitExceeded
+			}
+		}
+
+		// Record the usage
+		if err := tx.WithContext(ctx).Create(usage).Error; err != nil {
+			return err
+		}
+
+		// Count it against the global cap. The increment is conditional and
+		// atomic in the database, so concurrent redemptions cannot overshoot
+		// the cap; if none is left, the transaction rolls back the usage.
+		result := tx.Model(&models.Coupon{}).
+			Where("id = ? AND (max_total_usage = 0 OR times_used < max_total_usage)", usage.CouponID).
+			UpdateColumn("times_used", gorm.Expr("times_used + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			logging.FromContext(ctx).Warn("rejected redemption of fully redeemed coupon",
+				"coupon_id", usage.CouponID,
+				"user_id", usage.UserID,
+			)
+			return ErrUsageLimitExceeded
+		}
+		return nil
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrOrderHasCoupon
+	}
+	return err
+}
+
+// expiryJobLockKey is the advisory lock key held while DeactivateExpired runs.
+var expiryJobLockKey = func() int64 {
+	h := fnv.New64a()
+	h.Write([]byte("coupons:expire"))
+	return int64(h.Sum64())
+}()
+
+// redemptionLockKey maps a coupon and user to the advisory lock key guarding
+// their redemptions. Distinct pairs may collide, which only costs some
+// unnecessary serialization.
+func redemptionLockKey(couponID, userID uuid.UUID) int64 {
+	h := fnv.New64a()
+	h.Write(couponID[:])
+	h.Write(userID[:])
+	return int64(h.Sum64())
+}
+
+// orderLockKey maps an order to the advisory lock key guarding the coupons
+// applied to it.
+func orderLockKey(orderID uuid.UUID) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("order:"))
+	h.Write(orderID[:])
+	return int64(h.Sum64())
+}
+
+// ListUsage streams every coupon redemption with used_at in [from, to) to fn,
+// ordered by used_at and id. Rows are scanned one at a time so large ranges are never
+// held in memory; iteration stops at the first error returned by fn.
+func (r *CouponRepository) ListUsage(ctx context.Context, from, to time.Time, fn func(UsageRecord) error) error {
+	rows, err := r.db.WithContext(ctx).
+		Table("coupon_usages").
+		Select("coupon_usages.*, coupons.code AS coupon_code").
+		Joins("JOIN coupons ON coupons.id = coupon_usages.coupon_id").
+		Where("coupon_usages.used_at >= ? AND coupon_usages.used_at < ?", from, to).
+		Order("coupon_usages.used_at, coupon_usages.id").
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record UsageRecord
+		if err := r.db.ScanRows(rows, &record); err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ListUsageAfter returns up to limit redemptions that come after cursor in
+// (used_at, id) order. Seeking by key instead of skipping an offset keeps
+// every page as cheap as the first, however deep a client pages.
+func (r *CouponRepository) ListUsageAfter(ctx context.Context, cursor UsageCursor, limit int) ([]UsageRecord, error) {
+	records := []UsageRecord{}
+	err := retry.Do(ctx, func() error {
+		records = records[:0]
+		return r.db.WithContext(ctx).
+			Table("coupon_usages").
+			Select("coupon_usages.*, coupons.code AS coupon_code").
+			Joins("JOIN coupons ON coupons.id = coupon_usages.coupon_id").
+			Where("(coupon_usages.used_at, coupon_usages.id) > (?, ?)", cursor.UsedAt, cursor.ID).
+			Order("coupon_usages.used_at, coupon_usages.id").
+			Limit(limit).
+			Scan(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// usagePurgeBatchSize is how many usage rows PurgeUsage deletes per
+// statement, keeping each delete's locks short.
+const usagePurgeBatchSize = 1000
+
+// PurgeUsage deletes redemptions made before before, in batches, and returns
+// how many were deleted. Only redemptions of coupons that can no longer be
+// redeemed (inactive, expired at now, or deleted) are purged: per-user limits
+// count usage rows, so purging those of a live coupon would hand its users
+// their uses back. The coupons' times_used counters are left as they are, so
+// reconciling a purged coupon afterwards would undercount it.
+func (r *CouponRepository) PurgeUsage(ctx context.Context, before, now time.Time) (int64, error) {
+	var purged int64
+	for {
+		res := r.db.WithContext(ctx).Exec(`DELETE FROM coupon_usages WHERE id IN (
+			SELECT u.id FROM coupon_usages u
+			JOIN coupons c ON c.id = u.coupon_id
+			WHERE u.used_at < ?
+			AND (c.is_active = false OR c.expiry_date <= ? OR c.deleted_at IS NOT NULL)
+			LIMIT ?
+		)`, before, now, usagePurgeBatchSize)
+		if res.Error != nil {
+			return purged, res.Error
+		}
+		purged += res.RowsAffected
+		if res.RowsAffected < usagePurgeBatchSize {
+			return purged, nil
+		}
+	}
+}
+
+// ListUsageByUser returns up to limit of userID's redemptions, most recent
+// first, skipping the first offset.
+func (r *CouponRepository) ListUsageByUser(ctx context.Context, userID uuid.UUID, limit, offset int) ([]UsageRecord, error) {
+	records := []UsageRecord{}
+	err := retry.Do(ctx, func() error {
+		records = records[:0]
+		return r.db.WithContext(ctx).
+			Table("coupon_usages").
+			Select("coupon_usages.*, coupons.code AS coupon_code").
+			Joins("JOIN coupons ON coupons.id = coupon_usages.coupon_id").
+			Where("coupon_usages.user_id = ?", userID).
+			Order("coupon_usages.used_at DESC, coupon_usages.id").
+			Limit(limit).
+			Offset(offset).
+			Scan(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// GetUserUsageSummary totals every redemption made by userID.
+func (r *CouponRepository) GetUserUsageSummary(ctx context.Context, userID uuid.UUID) (*models.UserUsageSummary, error) {
+	summary := models.UserUsageSummary{UserID: userID}
+	err := retry.Do(ctx, func() error {
+		return r.db.WithContext(ctx).Model(&models.CouponUsage{}).
+			Select(`COUNT(*) AS total_redemptions,
+				COALESCE(SUM(discount_applied), 0) AS total_discount_received`).
+			Where("user_id = ?", userID).
+			Scan(&summary).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// GetCategoryMatrix maps each of categoryIDs to the codes of the active,
+// unexpired coupons that apply to it. A coupon applies to a category when it is
+// explicitly linked to it, or when it has no medicine or category restrictions
+// at all. Every requested category is present in the result, possibly with an
+// empty slice.
+func (r *CouponRepository) GetCategoryMatrix(ctx context.Context, categoryIDs []uuid.UUID) (map[uuid.UUID][]string, error) {
+	var rows []struct {
+		CategoryID uuid.UUID
+		Code       string
+	}
+	err := retry.Do(ctx, func() error {
+		rows = nil
+		return r.db.WithContext(ctx).
+			Table("categories").
+			Select("categories.id AS category_id, coupons.code").
+			Joins(`JOIN coupons ON coupons.is_active = true
+				AND coupons.deleted_at IS NULL
+				AND coupons.expiry_date > ?
+				AND (
+					EXISTS (SELECT 1 FROM coupon_categories cc WHERE cc.coupon_id = coupons.id AND cc.category_id = categories.id)
+					OR (
+						NOT EXISTS (SELECT 1 FROM coupon_categories cc WHERE cc.coupon_id = coupons.id)
+						AND NOT EXISTS (SELECT 1 FROM coupon_medicines cm WHERE cm.coupon_id = coupons.id)
+					)
+				)`, time.Now()).
+			Where("categories.id IN ?", categoryIDs).
+			Order("coupons.code").
+			Scan(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matrix := make(map[uuid.UUID][]string, len(categoryIDs))
+	for _, id := range categoryIDs {
+		matrix[id] = []string{}
+	}
+	for _, row := range rows {
+		matrix[row.CategoryID] = append(matrix[row.CategoryID], row.Code)
+	}
+	return matrix, nil
+}
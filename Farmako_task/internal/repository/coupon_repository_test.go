@@ -0,0 +1,466 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"coupon-system/internal/models"
+	"coupon-system/internal/testdb"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func testCoupon(code string) *models.Coupon {
+	return &models.Coupon{
+		ID:                uuid.New(),
+		Code:              code,
+		ExpiryDate:        time.Now().Add(24 * time.Hour),
+		UsageType:         models.MultiUse,
+		DiscountType:      models.PercentageDiscount,
+		DiscountValue:     decimal.NewFromInt(10),
+		MinOrderValue:     decimal.Zero,
+		MaxUsagePerUser:   3,
+		RolloutPercentage: 100,
+		IsActive:          true,
+		Version:           1,
+	}
+}
+
+func TestCreateBatch(t *testing.T) {
+	repo := NewCouponRepository(testdb.Open(t))
+	ctx := context.Background()
+
+	if err := repo.Create(ctx, testCoupon("TAKEN")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	batch := []*models.Coupon{testCoupon("FIRST"), testCoupon("TAKEN"), testCoupon("THIRD")}
+	errs, err := repo.CreateBatch(ctx, batch)
+	if err != nil {
+		t.Fatalf("CreateBatch: %v", err)
+	}
+
+	tests := []struct {
+		code    string
+		wantErr error
+	}{
+		{"FIRST", nil},
+		{"TAKEN", ErrDuplicateCode},
+		{"THIRD", nil},
+	}
+	for i, tt := range tests {
+		if !errors.Is(errs[i], tt.wantErr) {
+			t.Errorf("errs[%d] (%s) = %v, want %v", i, tt.code, errs[i], tt.wantErr)
+		}
+		if tt.wantErr != nil {
+			continue
+		}
+		got, err := repo.GetByID(ctx, batch[i].ID)
+		if err != nil || got == nil {
+			t.Errorf("coupon %s was not committed: %v", tt.code, err)
+		}
+	}
+
+	var taken int64
+	repo.db.Model(&models.Coupon{}).Where("code = ?", "TAKEN").Count(&taken)
+	if taken != 1 {
+		t.Errorf("%d coupons with code TAKEN, want 1", taken)
+	}
+}
+
+func TestCountCouponOrders(t *testing.T) {
+	repo := NewCouponRepository(testdb.Open(t))
+	ctx := context.Background()
+
+	first, second := testCoupon("FIRST"), testCoupon("SECOND")
+	for _, c := range []*models.Coupon{first, second} {
+		if err := repo.Create(ctx, c); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	user, other := uuid.New(), uuid.New()
+	orderA, orderB, current := uuid.New(), uuid.New(), uuid.New()
+	usages := []models.CouponUsage{
+		{CouponID: first.ID, UserID: user, OrderID: orderA},
+		{CouponID: second.ID, UserID: user, OrderID: orderA},
+		{CouponID: first.ID, UserID: user, OrderID: orderB},
+		{CouponID: first.ID, UserID: user, OrderID: current},
+		{CouponID: first.ID, UserID: other, OrderID: uuid.New()},
+	}
+	for i := range usages {
+		usages[i].ID = uuid.New()
+		usages[i].UsedAt = time.Now()
+	}
+	if err := repo.db.Create(&usages).Error; err != nil {
+		t.Fatalf("create usages: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		userID  uuid.UUID
+		exclude uuid.UUID
+		want    int
+	}{
+		{"orders with several coupons count once", user, uuid.Nil, 3},
+		{"the order being placed is excluded", user, current, 2},
+		{"user without redemptions", uuid.New(), uuid.Nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := repo.CountCouponOrders(ctx, tt.userID, tt.exclude)
+			if err != nil {
+				t.Fatalf("CountCouponOrders: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("CountCouponOrders() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordCouponUsageOneCouponPerOrder(t *testing.T) {
+	repo := NewCouponRepository(testdb.Open(t))
+	ctx := context.Background()
+
+	const racers = 8
+	coupons := make([]*models.Coupon, racers)
+	for i := range coupons {
+		coupons[i] = testCoupon(fmt.Sprintf("RACE%d", i))
+		if err := repo.Create(ctx, coupons[i]); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	userID, orderID := uuid.New(), uuid.New()
+	errs := make([]error, racers)
+	var wg sync.WaitGroup
+	for i, coupon := range coupons {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = repo.RecordCouponUsage(ctx, &models.CouponUsage{
+				ID:       uuid.New(),
+				CouponID: coupon.ID,
+				UserID:   userID,
+				OrderID:  orderID,
+				UsedAt:   time.Now(),
+			}, false)
+		}()
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, ErrOrderHasCoupon):
+			t.Errorf("coupon %d: unexpected error %v", i, err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d redemptions succeeded, want 1", succeeded)
+	}
+
+	var rows int64
+	repo.db.Model(&models.CouponUsage{}).Where("order_id = ?", orderID).Count(&rows)
+	if rows != 1 {
+		t.Errorf("%d usages recorded for the order, want 1", rows)
+	}
+}
+
+func TestUpdateVersionConflict(t *testing.T) {
+	repo := NewCouponRepository(testdb.Open(t))
+	ctx := context.Background()
+
+	coupon := testCoupon("RACE")
+	if err := repo.Create(ctx, coupon); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// Two admins loaded version 1 and save different edits at once
+	edits := []string{"20", "30"}
+	errs := make([]error, len(edits))
+	var wg sync.WaitGroup
+	for i, value := range edits {
+		edit := *coupon
+		edit.DiscountValue = decimal.RequireFromString(value)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = repo.Update(ctx, &edit, 1)
+		}()
+	}
+	wg.Wait()
+
+	var won int
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			won = i
+		case !errors.Is(err, ErrVersionConflict):
+			t.Fatalf("edit %d: unexpected error %v", i, err)
+		}
+	}
+	if errs[0] == nil && errs[1] == nil || errs[0] != nil && errs[1] != nil {
+		t.Fatalf("errs = %v, want exactly one ErrVersionConflict", errs)
+	}
+
+	got, err := repo.GetByID(ctx, coupon.ID)
+	if err != nil {
+		t.Fatalf("GetByID: %v", err)
+	}
+	if got.Version != 2 {
+		t.Errorf("version = %d, want 2", got.Version)
+	}
+	if !got.DiscountValue.Equal(decimal.RequireFromString(edits[won])) {
+		t.Errorf("discount_value = %s, want the winning edit %s", got.DiscountValue, edits[won])
+	}
+
+	// A retry with the stale version still fails; with the new one it succeeds
+	tests := []struct {
+		name    string
+		version int
+		wantErr error
+	}{
+		{"stale version", 1, ErrVersionConflict},
+		{"current version", 2, nil},
+	}
+	for _, tt := range tests {
+		edit := *got
+		if err := repo.Update(ctx, &edit, tt.version); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: Update() = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	repo := NewCouponRepository(testdb.Open(t))
+	creator, editor := uuid.New(), uuid.New()
+
+	coupon := testCoupon("AUDITED")
+	if err := repo.Create(WithActor(context.Background(), creator), coupon); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	edit := *coupon
+	edit.DiscountValue = decimal.NewFromInt(25)
+	if err := repo.Update(WithActor(context.Background(), editor), &edit, coupon.Version); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, err := repo.DeactivateByCodes(WithActor(context.Background(), editor), []string{"AUDITED"}); err != nil {
+		t.Fatalf("DeactivateByCodes: %v", err)
+	}
+
+	// Changes made without an actor, such as the expiry job's, are the system's
+	system := testCoupon("SYSTEM")
+	if err := repo.Create(context.Background(), system); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	tests := []struct {
+		coupon     uuid.UUID
+		want       []models.AuditAction
+		wantActors []*uuid.UUID
+	}{
+		{coupon.ID, []models.AuditAction{models.AuditCreate, models.AuditUpdate, models.AuditDeactivate}, []*uuid.UUID{&creator, &editor, &editor}},
+		{system.ID, []models.AuditAction{models.AuditCreate}, []*uuid.UUID{nil}},
+	}
+	for _, tt := range tests {
+		entries, err := repo.ListAuditLog(context.Background(), tt.coupon)
+		if err != nil {
+			t.Fatalf("ListAuditLog: %v", err)
+		}
+		if len(entries) != len(tt.want) {
+			t.Fatalf("coupon %s: %d audit entries, want %d", tt.coupon, len(entries), len(tt.want))
+		}
+		for i, entry := range entries {
+			if entry.Action != tt.want[i] {
+				t.Errorf("entry %d: action = %s, want %s", i, entry.Action, tt.want[i])
+			}
+			switch want := tt.wantActors[i]; {
+			case want == nil && entry.ActorID != nil:
+				t.Errorf("entry %d: actor = %s, want none", i, entry.ActorID)
+			case want != nil && (entry.ActorID == nil || *entry.ActorID != *want):
+				t.Errorf("entry %d: actor = %v, want %s", i, entry.ActorID, want)
+			}
+		}
+	}
+}
+
+func TestGetUserCouponUsageSince(t *testing.T) {
+	repo := NewCouponRepository(testdb.Open(t))
+	ctx := context.Background()
+
+	coupon := testCoupon("DAILY")
+	if err := repo.Create(ctx, coupon); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	userID := uuid.New()
+	for _, age := range []time.Duration{25 * time.Hour, 24 * time.Hour, 23 * time.Hour, time.Hour} {
+		usage := models.CouponUsage{ID: uuid.New(), CouponID: coupon.ID, UserID: userID, OrderID: uuid.New(), UsedAt: now.Add(-age)}
+		if err := repo.db.Create(&usage).Error; err != nil {
+			t.Fatalf("create usage: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		since time.Time
+		want  int
+	}{
+		{"zero since counts every usage", time.Time{}, 4},
+		{"a usage exactly at the window start counts", now.Add(-24 * time.Hour), 3},
+		{"a second later it has left the window", now.Add(-24*time.Hour + time.Second), 2},
+		{"nothing after the latest usage", now, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := repo.GetUserCouponUsage(ctx, coupon.ID, userID, tt.since)
+			if err != nil {
+				t.Fatalf("GetUserCouponUsage: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("GetUserCouponUsage() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordCouponUsageConcurrentLimit(t *testing.T) {
+	repo := NewCouponRepository(testdb.Open(t))
+	ctx := context.Background()
+
+	coupon := testCoupon("THREE")
+	coupon.MaxUsagePerUser = 3
+	if err := repo.Create(ctx, coupon); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	const attempts = 12
+	userID := uuid.New()
+	errs := make([]error, attempts)
+	var wg sync.WaitGroup
+	for i := range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = repo.RecordCouponUsage(ctx, &models.CouponUsage{
+				ID:       uuid.New(),
+				CouponID: coupon.ID,
+				UserID:   userID,
+				OrderID:  uuid.New(),
+				UsedAt:   time.Now(),
+			}, false)
+		}()
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, ErrUsageLimitExceeded):
+			t.Errorf("attempt %d: unexpected error %v", i, err)
+		}
+	}
+	if succeeded != 3 {
+		t.Errorf("%d redemptions succeeded, want 3", succeeded)
+	}
+
+	var rows int64
+	repo.db.Model(&models.CouponUsage{}).Where("coupon_id = ?", coupon.ID).Count(&rows)
+	if rows != 3 {
+		t.Errorf("%d usages recorded, want 3", rows)
+	}
+	got, err := repo.GetByID(ctx, coupon.ID)
+	if err != nil {
+		t.Fatalf("GetByID: %v", err)
+	}
+	if got.TimesUsed != 3 {
+		t.Errorf("times_used = %d, want 3", got.TimesUsed)
+	}
+}
+
+// BenchmarkGetApplicableCoupons compares matching the cart against coupon
+// restrictions in SQL with loading every active coupon and matching in Go.
+func BenchmarkGetApplicableCoupons(b *testing.B) {
+	db := testdb.Open(b)
+	repo := NewCouponRepository(db)
+	ctx := context.Background()
+
+	categories := make([]models.Category, 20)
+	for i := range categories {
+		categories[i] = models.Category{ID: uuid.New(), Name: fmt.Sprintf("category-%d", i)}
+	}
+	medicines := make([]models.Medicine, 500)
+	for i := range medicines {
+		medicines[i] = models.Medicine{
+			ID:       uuid.New(),
+			Name:     fmt.Sprintf("medicine-%d", i),
+			Category: categories[i%len(categories)].Name,
+			Price:    decimal.NewFromInt(50),
+		}
+	}
+	if err := db.Create(&categories).Error; err != nil {
+		b.Fatalf("create categories: %v", err)
+	}
+	if err := db.Create(&medicines).Error; err != nil {
+		b.Fatalf("create medicines: %v", err)
+	}
+
+	// One coupon in ten is unrestricted; the rest are restricted to three
+	// medicines or to a category, so few of them match a small cart
+	coupons := make([]*models.Coupon, 1000)
+	for i := range coupons {
+		c := testCoupon(fmt.Sprintf("BENCH%d", i))
+		switch {
+		case i%10 == 0:
+		case i%2 == 0:
+			c.ApplicableCategories = []models.Category{categories[i%len(categories)]}
+		default:
+			for j := 0; j < 3; j++ {
+				c.ApplicableMedicines = append(c.ApplicableMedicines, medicines[(i*3+j)%len(medicines)])
+			}
+		}
+		coupons[i] = c
+	}
+	if _, err := repo.CreateBatch(ctx, coupons); err != nil {
+		b.Fatalf("CreateBatch: %v", err)
+	}
+
+	cart := medicines[:5]
+	user := uuid.New()
+	b.Run("sql", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := repo.GetApplicableCoupons(ctx, user, cart, decimal.Zero, decimal.NewFromInt(1000)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("go", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var all []models.Coupon
+			err := db.Preload("ApplicableMedicines").Preload("ApplicableCategories").
+				Where("is_active = true AND expiry_date > ?", time.Now()).
+				Find(&all).Error
+			if err != nil {
+				b.Fatal(err)
+			}
+			var applicable []models.Coupon
+			for _, c := range all {
+				if c.AppliesTo(cart) {
+					applicable = append(applicable, c)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidCursor is returned by DecodeUsageCursor for a token that was not
+// produced by UsageCursor.Encode.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// UsageCursor is a position in the (used_at, id) order of redemptions. The
+// zero cursor lies before the first redemption.
+type UsageCursor struct {
+	UsedAt time.Time
+	ID     uuid.UUID
+}
+
+// Encode returns the cursor as an opaque token for clients to send back.
+func (c UsageCursor) Encode() string {
+	raw := c.UsedAt.UTC().Format(time.RFC3339Nano) + "," + c.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeUsageCursor parses a token returned by UsageCursor.Encode. An empty
+// token is the zero cursor.
+func DecodeUsageCursor(token string) (UsageCursor, error) {
+	if token == "" {
+		return UsageCursor{}, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return UsageCursor{}, ErrInvalidCursor
+	}
+	usedAt, id, ok := strings.Cut(string(raw), ",")
+	if !ok {
+		return UsageCursor{}, ErrInvalidCursor
+	}
+
+	var c UsageCursor
+	if c.UsedAt, err = time.Parse(time.RFC3339Nano, usedAt); err != nil {
+		return UsageCursor{}, ErrInvalidCursor
+	}
+	if c.ID, err = uuid.Parse(id); err != nil {
+		return UsageCursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
@@ -0,0 +1,88 @@
+package retry
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Policy configures exponential backoff with full jitter: before retry n the
+// caller sleeps a random duration in [0, min(MaxDelay, BaseDelay*2^n)).
+type Policy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// Default suits short request-path calls: three attempts within roughly a
+// quarter of a second.
+var Default = Policy{
+	Attempts:  3,
+	BaseDelay: 50 * time.Millisecond,
+	MaxDelay:  200 * time.Millisecond,
+}
+
+// Do calls fn with the Default policy.
+func Do(ctx context.Context, fn func() error) error {
+	return Default.Do(ctx, fn)
+}
+
+// Do calls fn until it succeeds, returns an error that is not transient (see
+// IsTransient), the attempts are exhausted, or ctx is done. It returns fn's
+// last error. Only wrap calls that are safe to repeat: reads and idempotent
+// writes.
+func (p Policy) Do(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < p.Attempts; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(p.backoff(attempt - 1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+
+		err = fn()
+		if err == nil || !IsTransient(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (p Policy) backoff(n int) time.Duration {
+	ceiling := p.BaseDelay << n
+	if ceiling <= 0 || ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// IsTransient reports whether err looks like a dropped or refused connection
+// rather than a logical failure. Context cancellation is never transient.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
@@ -0,0 +1,110 @@
+package retry
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var errNotFound = errors.New("record not found")
+
+// flaky returns fn failing with err for its first failures calls and
+// succeeding after that, and a pointer to how often it was called.
+func flaky(failures int, err error) (func() error, *int) {
+	calls := 0
+	return func() error {
+		calls++
+		if calls <= failures {
+			return err
+		}
+		return nil
+	}, &calls
+}
+
+func TestPolicyDo(t *testing.T) {
+	policy := Policy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+	reset := fmt.Errorf("read: %w", syscall.ECONNRESET)
+
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		wantErr   error
+		wantCalls int
+	}{
+		{"succeeds at once", 0, reset, nil, 1},
+		{"succeeds after transient failures", 2, reset, nil, 3},
+		{"gives up after the last attempt", 5, reset, syscall.ECONNRESET, 3},
+		{"bad connection is transient", 1, driver.ErrBadConn, nil, 2},
+		{"logical errors are not retried", 5, errNotFound, errNotFound, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn, calls := flaky(tt.failures, tt.err)
+			err := policy.Do(context.Background(), fn)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Do() error = %v, want %v", err, tt.wantErr)
+			}
+			if *calls != tt.wantCalls {
+				t.Errorf("fn called %d times, want %d", *calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestPolicyDoStopsWhenContextEnds(t *testing.T) {
+	// Backing off for an hour would hang the test if cancellation were ignored
+	policy := Policy{Attempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	fn, calls := flaky(5, syscall.ECONNREFUSED)
+	start := time.Now()
+	err := policy.Do(ctx, fn)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("Do() error = %v, want the last failure", err)
+	}
+	if *calls != 1 {
+		t.Errorf("fn called %d times, want 1", *calls)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Do() returned after %s, want it to stop when the context ended", elapsed)
+	}
+}
+
+func TestPolicyDoCancelledDuringCall(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := Policy{Attempts: 3}.Do(ctx, func() error {
+		calls++
+		cancel()
+		return syscall.ECONNRESET
+	})
+	if !errors.Is(err, syscall.ECONNRESET) || calls != 1 {
+		t.Errorf("Do() = %v after %d calls, want ECONNRESET after 1", err, calls)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errNotFound, false},
+		{context.Canceled, false},
+		{fmt.Errorf("query: %w", context.DeadlineExceeded), false},
+		{driver.ErrBadConn, true},
+		{fmt.Errorf("dial: %w", syscall.ECONNREFUSED), true},
+		{syscall.EPIPE, true},
+	}
+	for _, tt := range tests {
+		if got := IsTransient(tt.err); got != tt.want {
+			t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
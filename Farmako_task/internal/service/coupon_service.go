@@ -1,174 +1,1798 @@
-package service
-
-import (
-	"context"
-	"time"
-
-	"coupon-system/internal/models"
-	"coupon-system/internal/repository"
-
-	"github.com/google/uuid"
-)
-
-type CouponService struct {
-	repo *repository.CouponRepository
-}
-
-func NewCouponService(repo *repository.CouponRepository) *CouponService {
-	return &CouponService{repo: repo}
-}
-
-type CreateCouponInput struct {
-	Code                 string
-	ExpiryDate           time.Time
-	UsageType            models.UsageType
-	DiscountType         models.DiscountType
-	DiscountValue        float64
-	MinOrderValue        float64
-	MaxUsagePerUser      int
-	ValidTimeWindow      *models.TimeWindow
-	TermsAndConditions   string
-	ApplicableMedicines  []models.Medicine
-	ApplicableCategories []models.Category
-}
-
-func (s *CouponService) CreateCoupon(ctx context.Context, input CreateCouponInput) (*models.Coupon, error) {
-	coupon := &models.Coupon{
-		ID:                   uuid.New(),
-		Code:                 input.Code,
-		ExpiryDate:           input.ExpiryDate,
-		UsageType:            input.UsageType,
-		DiscountType:         input.DiscountType,
-		DiscountValue:        input.DiscountValue,
-		MinOrderValue:        input.MinOrderValue,
-		MaxUsagePerUser:      input.MaxUsagePerUser,
-		ValidTimeWindow:      input.ValidTimeWindow,
-		TermsAndConditions:   input.TermsAndConditions,
-		ApplicableMedicines:  input.ApplicableMedicines,
-		ApplicableCategories: input.ApplicableCategories,
-		IsActive:             true,
-	}
-
-	if err := s.repo.Create(ctx, coupon); err != nil {
-		return nil, err
-	}
-
-	return coupon, nil
-}
-
-type ValidateCouponInput struct {
-	Code       string
-	CartItems  []models.Medicine
-	OrderTotal float64
-	UserID     uuid.UUID
-	Timestamp  time.Time
-}
-
-type ValidateCouponOutput struct {
-	IsValid         bool
-	ItemsDiscount   float64
-	ChargesDiscount float64
-	Message         string
-}
-
-func (s *CouponService) ValidateCoupon(ctx context.Context, input ValidateCouponInput) (*ValidateCouponOutput, error) {
-	coupon, err := s.repo.GetByCode(ctx, input.Code)
-	if err != nil {
-		return nil, err
-	}
-
-	if coupon == nil {
-		return &ValidateCouponOutput{
-			IsValid: false,
-			Message: "coupon not found",
-		}, nil
-	}
-
-	// Basic validation
-	if !coupon.IsValid(input.OrderTotal, input.Timestamp) {
-		return &ValidateCouponOutput{
-			IsValid: false,
-			Message: "coupon is not valid for this order",
-		}, nil
-	}
-
-	// Check if the coupon is applicable to the cart items
-	if !isApplicableToCoupon(*coupon, input.CartItems) {
-		return &ValidateCouponOutput{
-			IsValid: false,
-			Message: "coupon is not applicable to any items in cart",
-		}, nil
-	}
-
-	// Check usage limits
-	usageCount, err := s.repo.GetUserCouponUsage(ctx, coupon.ID, input.UserID)
-	if err != nil {
-		return nil, err
-	}
-
-	if coupon.UsageType == models.OneTime && usageCount > 0 {
-		return &ValidateCouponOutput{
-			IsValid: false,
-			Message: "one-time coupon already used",
-		}, nil
-	}
-
-	if coupon.UsageType == models.MultiUse && usageCount >= coupon.MaxUsagePerUser {
-		return &ValidateCouponOutput{
-			IsValid: false,
-			Message: "coupon usage limit exceeded",
-		}, nil
-	}
-
-	// Calculate discount
-	discount := coupon.CalculateDiscount(input.OrderTotal)
-
-	return &ValidateCouponOutput{
-		IsValid:         true,
-		ItemsDiscount:   discount,
-		ChargesDiscount: 0, // Can be extended for delivery fee discounts
-		Message:         "coupon applied successfully",
-	}, nil
-}
-
-func (s *CouponService) GetApplicableCoupons(ctx context.Context, cartItems []models.Medicine, orderTotal float64) ([]models.Coupon, error) {
-	return s.repo.GetApplicableCoupons(ctx, cartItems, orderTotal)
-}
-
-func (s *CouponService) RecordCouponUsage(ctx context.Context, couponID, userID, orderID uuid.UUID) error {
-	usage := &models.CouponUsage{
-		ID:        uuid.New(),
-		CouponID:  couponID,
-		UserID:    userID,
-		OrderID:   orderID,
-		UsedAt:    time.Now(),
-		CreatedAt: time.Now(),
-	}
-
-	return s.repo.RecordCouponUsage(ctx, usage)
-}
-
-// Helper function to check if a coupon is applicable to cart items
-func isApplicableToCoupon(coupon models.Coupon, cartItems []models.Medicine) bool {
-	if len(coupon.ApplicableMedicines) == 0 && len(coupon.ApplicableCategories) == 0 {
-		return true
-	}
-
-	for _, item := range cartItems {
-		// Check direct medicine match
-		for _, medicine := range coupon.ApplicableMedicines {
-			if item.ID == medicine.ID {
-				return true
-			}
-		}
-
-		// Check category match
-		for _, category := range coupon.ApplicableCategories {
-			if item.Category == category.Name {
-				return true
-			}
-		}
-	}
-
-	return false
-}
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"coupon-system/internal/cache"
+	"coupon-system/internal/codec"
+	"coupon-system/internal/logging"
+	"coupon-system/internal/metrics"
+	"coupon-system/internal/models"
+	"coupon-system/internal/repository"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// ErrMedicineNotFound is returned when an operation targets a medicine ID
+// that does not exist.
+var ErrMedicineNotFound = errors.New("medicine not found")
+
+// ErrInvalidTimeWindow is returned when a coupon's valid time window is
+// incomplete or ends before it starts.
+var ErrInvalidTimeWindow = errors.New("valid_time_window requires start_time before end_time")
+
+// ErrInvalidDiscountBand is returned when a coupon's minimum discount amount
+// exceeds its maximum.
+var ErrInvalidDiscountBand = errors.New("min_discount_amount must not exceed max_discount_amount")
+
+// ErrCouponNotFound is returned when an operation targets a coupon ID that
+// does not exist.
+var ErrCouponNotFound = errors.New("coupon not found")
+
+// ErrInvalidStartDate is returned when a coupon is scheduled to start at or
+// after its expiry.
+var ErrInvalidStartDate = errors.New("start_date must be before expiry_date")
+
+// ErrInvalidOrderValueRange is returned when a coupon's minimum order value
+// exceeds its maximum.
+var ErrInvalidOrderValueRange = errors.New("min_order_value must not exceed max_order_value")
+
+// ErrInvalidAmount is returned when a coupon's discount value is not positive
+// or one of its other amounts is negative.
+var ErrInvalidAmount = errors.New("discount_value must be positive and amounts must not be negative")
+
+// ErrExpiryNotInFuture is returned when a new coupon would already be expired.
+var ErrExpiryNotInFuture = errors.New("expiry_date must be in the future")
+
+// ErrTimeWindowAfterExpiry is returned when a coupon's valid time window ends
+// after the coupon expires.
+var ErrTimeWindowAfterExpiry = errors.New("valid_time_window must end by expiry_date")
+
+// ErrInvalidCurrency is returned when a coupon's currency is not a
+// three-letter ISO 4217 code.
+var ErrInvalidCurrency = errors.New("currency must be a three-letter ISO 4217 code")
+
+// ErrInvalidRollout is returned when a coupon's rollout percentage is outside
+// 1 to 100.
+var ErrInvalidRollout = errors.New("rollout_percentage must be between 1 and 100")
+
+// ErrInvalidCodeChecksum is returned, when checksummed codes are enabled,
+// for a coupon code whose last character is not its check character.
+var ErrInvalidCodeChecksum = errors.New("code does not end in a valid check character")
+
+// ErrInvalidDiscountTiers is returned when a coupon's discount tiers are not
+// in strictly ascending order of min_order_total.
+var ErrInvalidDiscountTiers = errors.New("discount_tiers must be sorted by strictly increasing min_order_total")
+
+// ErrInvalidSecondaryDiscount is returned when a coupon sets only one of
+// secondary_discount_type and secondary_discount_value, or an unknown type.
+var ErrInvalidSecondaryDiscount = errors.New("secondary_discount_type must be percentage or fixed and secondary_discount_value positive, or both unset")
+
+// SuspiciousDiscountError is returned in strict mode when a new coupon's
+// discount values look like data-entry mistakes (see DiscountWarnings).
+type SuspiciousDiscountError struct {
+	Warnings []string
+}
+
+func (e *SuspiciousDiscountError) Error() string {
+	return "suspicious discount values: " + strings.Join(e.Warnings, "; ")
+}
+
+// UnknownReferencesError is returned when a coupon is restricted to medicines
+// or categories that do not exist in the catalog.
+type UnknownReferencesError struct {
+	MedicineIDs []uuid.UUID
+	CategoryIDs []uuid.UUID
+}
+
+func (e *UnknownReferencesError) Error() string {
+	var parts []string
+	if len(e.MedicineIDs) > 0 {
+		parts = append(parts, "unknown medicine ids: "+joinIDs(e.MedicineIDs))
+	}
+	if len(e.CategoryIDs) > 0 {
+		parts = append(parts, "unknown category ids: "+joinIDs(e.CategoryIDs))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func joinIDs(ids []uuid.UUID) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// DefaultCodeCharset omits characters that are easily confused when read
+// aloud or printed (0/O, 1/I/L).
+const DefaultCodeCharset = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// maxCodeAttempts bounds retries when a generated code collides with an
+// existing one.
+const maxCodeAttempts = 5
+
+type CouponService struct {
+	repo          *repository.CouponRepository
+	cache         *cache.CouponCache
+	codeCharset   string
+	allowStacking bool
+	rounding      models.RoundingMode
+
+	// checksumCodes requires every code to end in a codec check character,
+	// and lets validation reject codes that do not without a lookup.
+	checksumCodes bool
+
+	// strictDiscounts turns DiscountWarnings into rejections; maxFixed, when
+	// positive, is the largest fixed discount not considered suspicious.
+	strictDiscounts bool
+	maxFixed        decimal.Decimal
+
+	// maxOrderDiscountPct, when positive, caps the combined discount of all
+	// coupons on an order at this percentage of the order total.
+	maxOrderDiscountPct decimal.Decimal
+
+	// maxScanCartItems bounds the carts GetApplicableCoupons will scan.
+	maxScanCartItems int
+}
+
+// NewCouponService creates the coupon service. couponCache may be nil to
+// disable caching.
+func NewCouponService(repo *repository.CouponRepository, couponCache *cache.CouponCache) *CouponService {
+	return &CouponService{
+		repo:             repo,
+		cache:            couponCache,
+		codeCharset:      DefaultCodeCharset,
+		rounding:         models.RoundNearest,
+		maxScanCartItems: DefaultMaxScanCartItems,
+	}
+}
+
+// DefaultMaxScanCartItems is the largest cart GetApplicableCoupons scans
+// unless SetMaxScanCartItems overrides it.
+const DefaultMaxScanCartItems = 50
+
+// ErrCartTooLargeToScan is returned by GetApplicableCoupons and GetBestCoupon
+// for carts with more items than they will scan.
+var ErrCartTooLargeToScan = errors.New("cart has too many items to search for coupons; validate a specific coupon code instead")
+
+// SetMaxScanCartItems sets the largest cart GetApplicableCoupons scans.
+// Unlike validating a known code, listing applicable coupons matches every
+// active coupon against every item, so it gets a tighter cap than carts in
+// general.
+func (s *CouponService) SetMaxScanCartItems(n int) {
+	if n > 0 {
+		s.maxScanCartItems = n
+	}
+}
+
+// SetAllowStacking controls whether an order may carry more than one coupon.
+// It is off by default.
+func (s *CouponService) SetAllowStacking(allow bool) {
+	s.allowStacking = allow
+}
+
+// SetChecksumCodes turns on checksummed codes: generated codes get a check
+// character appended, created or updated coupons must carry a valid one, and
+// validation rejects codes with a bad check character before looking them
+// up. Enable it only once every live code is checksummed.
+func (s *CouponService) SetChecksumCodes(enabled bool) {
+	s.checksumCodes = enabled
+}
+
+// checkCode enforces SetChecksumCodes on an admin-supplied code.
+func (s *CouponService) checkCode(code string) error {
+	if s.checksumCodes && !codec.Validate(code) {
+		return ErrInvalidCodeChecksum
+	}
+	return nil
+}
+
+// SetRoundingMode sets how computed discounts are rounded to minor currency
+// units. The default is RoundNearest; unknown modes are ignored.
+func (s *CouponService) SetRoundingMode(mode models.RoundingMode) {
+	if mode.IsValid() {
+		s.rounding = mode
+	}
+}
+
+// SetOrderDiscountCap caps the combined discount of every coupon on an order
+// at percent of the order total. Zero, the default, disables the cap.
+func (s *CouponService) SetOrderDiscountCap(percent decimal.Decimal) {
+	s.maxOrderDiscountPct = percent
+}
+
+// SetDiscountSanity configures DiscountWarnings: fixed discounts above
+// maxFixed are flagged when maxFixed is positive, and with strict set
+// suspicious values are rejected on create instead of merely reported.
+func (s *CouponService) SetDiscountSanity(strict bool, maxFixed decimal.Decimal) {
+	s.strictDiscounts = strict
+	s.maxFixed = maxFixed
+}
+
+// DiscountWarnings lists discount values in input that are valid but likely
+// data-entry mistakes: percentages below 1 (0.5 is half a percent, not
+// half) and fixed amounts above the configured maximum.
+func (s *CouponService) DiscountWarnings(input CreateCouponInput) []string {
+	values := []decimal.Decimal{input.DiscountValue}
+	for _, tier := range input.DiscountTiers {
+		values = append(values, tier.DiscountValue)
+	}
+
+	var warnings []string
+	for _, value := range values {
+		warnings = s.appendDiscountWarning(warnings, "discount_value", input.DiscountType, value)
+	}
+	if input.SecondaryDiscountType != "" {
+		warnings = s.appendDiscountWarning(warnings, "secondary_discount_value", input.SecondaryDiscountType, input.SecondaryDiscountValue)
+	}
+	return warnings
+}
+
+func (s *CouponService) appendDiscountWarning(warnings []string, field string, discountType models.DiscountType, value decimal.Decimal) []string {
+	switch {
+	case discountType == models.PercentageDiscount && value.LessThan(decimal.NewFromInt(1)):
+		warnings = append(warnings, fmt.Sprintf("percentage %s %s is below 1%%", field, value))
+	case discountType == models.FixedDiscount && s.maxFixed.IsPositive() && value.GreaterThan(s.maxFixed):
+		warnings = append(warnings, fmt.Sprintf("fixed %s %s exceeds %s", field, value, s.maxFixed))
+	}
+	return warnings
+}
+
+// checkDiscountSanity rejects suspicious discount values in strict mode.
+func (s *CouponService) checkDiscountSanity(input CreateCouponInput) error {
+	if !s.strictDiscounts {
+		return nil
+	}
+	if warnings := s.DiscountWarnings(input); len(warnings) > 0 {
+		return &SuspiciousDiscountError{Warnings: warnings}
+	}
+	return nil
+}
+
+// roundDiscount rounds a computed discount per the configured mode, never
+// letting rounding push it above orderTotal.
+func (s *CouponService) roundDiscount(discount, orderTotal decimal.Decimal) decimal.Decimal {
+	return decimal.Min(s.rounding.Round(discount), orderTotal)
+}
+
+// SetCodeCharset overrides the characters used when generating coupon codes.
+func (s *CouponService) SetCodeCharset(charset string) {
+	if charset != "" {
+		s.codeCharset = charset
+	}
+}
+
+type CreateCouponInput struct {
+	Code                    string
+	StartDate               time.Time
+	ExpiryDate              time.Time
+	UsageType               models.UsageType
+	DiscountType            models.DiscountType
+	DiscountValue           decimal.Decimal
+	SecondaryDiscountType   models.DiscountType
+	SecondaryDiscountValue  decimal.Decimal
+	Currency                string
+	DiscountScope           models.DiscountScope
+	CustomerSegment         models.CustomerSegment
+	MinDiscountAmount       decimal.Decimal
+	MaxDiscountAmount       decimal.Decimal
+	MinOrderValue           decimal.Decimal
+	MinOrderTiers           models.MinOrderTiers
+	DiscountTiers           models.DiscountTiers
+	MinOnApplicableItems    bool
+	MinOrderIncludesCharges bool
+	MaxOrderValue           decimal.Decimal
+	AssignedUserID          *uuid.UUID
+	MaxUsagePerUser         int
+	MaxUsagePerUserDay      int
+	MaxTotalUsage           int64
+	RolloutPercentage       int
+	MinItemCount            int
+	ValidTimeWindow         *models.TimeWindow
+	DailyWindow             *models.DailyWindow
+	PaymentMethods          models.PaymentMethods
+	TermsAndConditions      string
+	// ApplicableMedicineIDs and ApplicableCategoryIDs restrict the coupon to
+	// existing catalog entries; the catalog rows themselves are never written.
+	ApplicableMedicineIDs []uuid.UUID
+	ApplicableCategoryIDs []uuid.UUID
+}
+
+func (s *CouponService) CreateCoupon(ctx context.Context, input CreateCouponInput) (*models.Coupon, error) {
+	if err := s.checkNewCoupon(&input, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := s.checkReferences(ctx, input); err != nil {
+		return nil, err
+	}
+
+	coupon := newCoupon(input)
+
+	if err := s.repo.Create(ctx, coupon); err != nil {
+		return nil, err
+	}
+	s.cache.InvalidateApplicable(ctx)
+
+	// Reload so the response carries the linked catalog rows rather than the
+	// ID-only references.
+	return s.repo.GetByID(ctx, coupon.ID)
+}
+
+// checkNewCoupon normalizes input and runs the checks a coupon must pass
+// before it is created, other than checkReferences. Every error it returns
+// is a problem with input.
+func (s *CouponService) checkNewCoupon(input *CreateCouponInput, now time.Time) error {
+	if err := validateNewCouponInput(input, now); err != nil {
+		return err
+	}
+	if err := s.checkCode(input.Code); err != nil {
+		return err
+	}
+	return s.checkDiscountSanity(*input)
+}
+
+// ImportRow is a coupon definition read from line Line of an import file.
+type ImportRow struct {
+	Line  int
+	Input CreateCouponInput
+}
+
+// ImportResult is the outcome of one ImportRow: the ID of the coupon created
+// for it, or the error that rejected it.
+type ImportResult struct {
+	Line     int
+	Code     string
+	CouponID uuid.UUID
+	Err      error
+}
+
+// errDuplicateImportCode rejects every row after the first that uses a code.
+var errDuplicateImportCode = errors.New("coupon code appears earlier in the import")
+
+// ImportCoupons creates a coupon for every row that passes the same checks as
+// CreateCoupon, inserting them all in one transaction, and reports the
+// outcome of each row in order. Rows with invalid input or a taken code are
+// rejected individually; the error return is reserved for failures that
+// stop the whole import.
+func (s *CouponService) ImportCoupons(ctx context.Context, rows []ImportRow) ([]ImportResult, error) {
+	results := make([]ImportResult, len(rows))
+	coupons := make([]*models.Coupon, 0, len(rows))
+	pending := make([]int, 0, len(rows))
+	seen := make(map[string]bool)
+	now := time.Now()
+
+	for i, row := range rows {
+		input := row.Input
+		err := s.checkNewCoupon(&input, now)
+		if err == nil {
+			var unknownRefs *UnknownReferencesError
+			err = s.checkReferences(ctx, input)
+			if err != nil && !errors.As(err, &unknownRefs) {
+				return nil, err
+			}
+		}
+		results[i] = ImportResult{Line: row.Line, Code: input.Code, Err: err}
+
+		if err != nil {
+			continue
+		}
+		if seen[input.Code] {
+			results[i].Err = errDuplicateImportCode
+			continue
+		}
+		seen[input.Code] = true
+		coupons = append(coupons, newCoupon(input))
+		pending = append(pending, i)
+	}
+	if len(coupons) == 0 {
+		return results, nil
+	}
+
+	errs, err := s.repo.CreateBatch(ctx, coupons)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.InvalidateApplicable(ctx)
+
+	for j, i := range pending {
+		if errs[j] != nil {
+			results[i].Err = errs[j]
+			continue
+		}
+		results[i].CouponID = coupons[j].ID
+	}
+	return results, nil
+}
+
+// UpdateCoupon replaces the definition of coupon id with input, provided
+// version is still current. The coupon's active flag and creation time are
+// preserved.
+func (s *CouponService) UpdateCoupon(ctx context.Context, id uuid.UUID, version int, input CreateCouponInput) (*models.Coupon, error) {
+	if err := validateCouponInput(&input); err != nil {
+		return nil, err
+	}
+	if err := s.checkCode(input.Code); err != nil {
+		return nil, err
+	}
+	if err := s.checkReferences(ctx, input); err != nil {
+		return nil, err
+	}
+
+	existing, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, ErrCouponNotFound
+	}
+
+	coupon := newCoupon(input)
+	coupon.ID = existing.ID
+	coupon.IsActive = existing.IsActive
+	coupon.CreatedAt = existing.CreatedAt
+
+	if err := s.repo.Update(ctx, coupon, version); err != nil {
+		return nil, err
+	}
+	s.cache.InvalidateApplicable(ctx)
+
+	return s.repo.GetByID(ctx, coupon.ID)
+}
+
+// GetCouponTerms returns the customer-facing terms of the active, unexpired
+// coupon with the given code, or ErrCouponNotFound.
+func (s *CouponService) GetCouponTerms(ctx context.Context, code string) (*models.CouponTerms, error) {
+	coupon, err := s.repo.GetByCode(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if coupon == nil || time.Now().After(coupon.ExpiryDate) {
+		return nil, ErrCouponNotFound
+	}
+	terms := coupon.Terms()
+	return &terms, nil
+}
+
+// GetCouponByCode returns the coupon with the given code whether or not it is
+// active, or ErrCouponNotFound.
+func (s *CouponService) GetCouponByCode(ctx context.Context, code string) (*models.Coupon, error) {
+	coupon, err := s.repo.GetByCodeIncludingInactive(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if coupon == nil {
+		return nil, ErrCouponNotFound
+	}
+	return coupon, nil
+}
+
+// UpdateCouponMedicines adds, removes or replaces the medicines coupon id is
+// restricted to. Removing every medicine and category makes the coupon apply
+// to the whole catalog again.
+func (s *CouponService) UpdateCouponMedicines(ctx context.Context, id uuid.UUID, op models.LinkOp, medicineIDs []uuid.UUID) (*models.Coupon, error) {
+	return s.updateLinks(ctx, id, "ApplicableMedicines", op, CreateCouponInput{ApplicableMedicineIDs: medicineIDs}, medicineRefs(medicineIDs))
+}
+
+// UpdateCouponCategories is UpdateCouponMedicines for categories.
+func (s *CouponService) UpdateCouponCategories(ctx context.Context, id uuid.UUID, op models.LinkOp, categoryIDs []uuid.UUID) (*models.Coupon, error) {
+	return s.updateLinks(ctx, id, "ApplicableCategories", op, CreateCouponInput{ApplicableCategoryIDs: categoryIDs}, categoryRefs(categoryIDs))
+}
+
+// updateLinks checks that coupon id exists and, unless links are being
+// removed, that the referenced catalog rows do, then applies op.
+func (s *CouponService) updateLinks(ctx context.Context, id uuid.UUID, association string, op models.LinkOp, refs CreateCouponInput, values interface{}) (*models.Coupon, error) {
+	existing, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, ErrCouponNotFound
+	}
+	if op != models.LinkRemove {
+		if err := s.checkReferences(ctx, refs); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.repo.UpdateLinks(ctx, id, association, op, values); err != nil {
+		return nil, err
+	}
+	s.cache.InvalidateApplicable(ctx)
+
+	return s.repo.GetByID(ctx, id)
+}
+
+// CloneCoupon creates a new coupon with the given code from the definition of
+// coupon id, linked to the same medicines and categories. The copy starts
+// active with no redemptions; expiryDate, when set, replaces the source's
+// expiry. The copy goes through CreateCoupon, so the usual validation applies.
+func (s *CouponService) CloneCoupon(ctx context.Context, id uuid.UUID, code string, expiryDate *time.Time) (*models.Coupon, error) {
+	source, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if source == nil {
+		return nil, ErrCouponNotFound
+	}
+
+	input := couponInput(source)
+	input.Code = code
+	if expiryDate != nil {
+		input.ExpiryDate = *expiryDate
+	}
+	return s.CreateCoupon(ctx, input)
+}
+
+type GenerateCouponsInput struct {
+	Count    int
+	Prefix   string
+	Length   int
+	Template CreateCouponInput
+}
+
+// GenerateCoupons mints Count coupons sharing the template's discount rules,
+// each with a random code, and returns the generated codes.
+func (s *CouponService) GenerateCoupons(ctx context.Context, input GenerateCouponsInput) ([]string, error) {
+	if err := validateNewCouponInput(&input.Template, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := s.checkDiscountSanity(input.Template); err != nil {
+		return nil, err
+	}
+	if err := s.checkReferences(ctx, input.Template); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, input.Count)
+	defer s.cache.InvalidateApplicable(ctx)
+	for i := 0; i < input.Count; i++ {
+		code, err := s.createWithGeneratedCode(ctx, input)
+		if err != nil {
+			return codes, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func (s *CouponService) createWithGeneratedCode(ctx context.Context, input GenerateCouponsInput) (string, error) {
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		code, err := s.generateCode(input.Prefix, input.Length)
+		if err != nil {
+			return "", err
+		}
+
+		template := input.Template
+		template.Code = code
+		err = s.repo.Create(ctx, newCoupon(template))
+		if errors.Is(err, repository.ErrDuplicateCode) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return code, nil
+	}
+	return "", errors.New("could not generate a unique coupon code")
+}
+
+// generateCode returns prefix followed by n characters drawn uniformly from
+// the configured charset using crypto/rand.
+func (s *CouponService) generateCode(prefix string, n int) (string, error) {
+	charset := []rune(s.codeCharset)
+	max := big.NewInt(int64(len(charset)))
+
+	code := make([]rune, n)
+	for i := range code {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = charset[idx.Int64()]
+	}
+	if s.checksumCodes {
+		return codec.Encode(models.NormalizeCode(prefix + string(code)))
+	}
+	return models.NormalizeCode(prefix + string(code)), nil
+}
+
+// validateCouponInput checks rules that binding tags cannot express. It
+// normalizes the code, defaults an empty discount scope to the whole order
+// and an empty currency to models.DefaultCurrency, treats a zero rollout
+// percentage as 100, and normalises an empty time window to nil so it is
+// stored as "no window".
+func validateCouponInput(input *CreateCouponInput) error {
+	input.Code = models.NormalizeCode(input.Code)
+	if input.DiscountScope == "" {
+		input.DiscountScope = models.OrderScope
+	}
+	if input.CustomerSegment == "" {
+		input.CustomerSegment = models.AllCustomers
+	}
+	input.PaymentMethods = input.PaymentMethods.Normalize()
+	input.Currency = models.NormalizeCurrency(input.Currency)
+	if input.RolloutPercentage == 0 {
+		input.RolloutPercentage = 100
+	}
+
+	if !isCurrencyCode(input.Currency) {
+		return ErrInvalidCurrency
+	}
+	if input.RolloutPercentage < 1 || input.RolloutPercentage > 100 {
+		return ErrInvalidRollout
+	}
+
+	if !input.StartDate.IsZero() && !input.StartDate.Before(input.ExpiryDate) {
+		return ErrInvalidStartDate
+	}
+
+	if !input.DiscountValue.IsPositive() ||
+		input.MinDiscountAmount.IsNegative() ||
+		input.MaxDiscountAmount.IsNegative() ||
+		input.MinOrderValue.IsNegative() ||
+		input.MaxOrderValue.IsNegative() {
+		return ErrInvalidAmount
+	}
+	for _, tier := range input.MinOrderTiers {
+		if tier.MinOrderValue.IsNegative() {
+			return ErrInvalidAmount
+		}
+	}
+	for _, tier := range input.DiscountTiers {
+		if tier.MinOrderTotal.IsNegative() || !tier.DiscountValue.IsPositive() {
+			return ErrInvalidAmount
+		}
+	}
+	if !input.DiscountTiers.IsAscending() {
+		return ErrInvalidDiscountTiers
+	}
+
+	switch input.SecondaryDiscountType {
+	case "":
+		if !input.SecondaryDiscountValue.IsZero() {
+			return ErrInvalidSecondaryDiscount
+		}
+	case models.PercentageDiscount, models.FixedDiscount:
+		if !input.SecondaryDiscountValue.IsPositive() {
+			return ErrInvalidSecondaryDiscount
+		}
+	default:
+		return ErrInvalidSecondaryDiscount
+	}
+
+	if input.MaxDiscountAmount.IsPositive() && input.MinDiscountAmount.GreaterThan(input.MaxDiscountAmount) {
+		return ErrInvalidDiscountBand
+	}
+
+	if input.MaxOrderValue.IsPositive() && input.MinOrderValue.GreaterThan(input.MaxOrderValue) {
+		return ErrInvalidOrderValueRange
+	}
+
+	if input.ValidTimeWindow.IsZero() {
+		input.ValidTimeWindow = nil
+		return nil
+	}
+
+	w := input.ValidTimeWindow
+	if w.StartTime.IsZero() || w.EndTime.IsZero() || !w.EndTime.After(w.StartTime) {
+		return ErrInvalidTimeWindow
+	}
+	if w.EndTime.After(input.ExpiryDate) {
+		return ErrTimeWindowAfterExpiry
+	}
+	return nil
+}
+
+// validateNewCouponInput is validateCouponInput plus the checks that only
+// make sense when a coupon is first created: it must not be dead on arrival.
+// Updates skip them so an expired coupon can still be edited.
+func validateNewCouponInput(input *CreateCouponInput, now time.Time) error {
+	if !input.ExpiryDate.After(now) {
+		return ErrExpiryNotInFuture
+	}
+	return validateCouponInput(input)
+}
+
+// isCurrencyCode reports whether code has the shape of an ISO 4217 code:
+// three upper-case letters.
+func isCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkReferences returns an *UnknownReferencesError if input is restricted to
+// medicines or categories that do not exist.
+func (s *CouponService) checkReferences(ctx context.Context, input CreateCouponInput) error {
+	missingMedicines, missingCategories, err := s.repo.MissingReferences(ctx, input.ApplicableMedicineIDs, input.ApplicableCategoryIDs)
+	if err != nil {
+		return err
+	}
+	if len(missingMedicines) > 0 || len(missingCategories) > 0 {
+		return &UnknownReferencesError{MedicineIDs: missingMedicines, CategoryIDs: missingCategories}
+	}
+	return nil
+}
+
+func newCoupon(input CreateCouponInput) *models.Coupon {
+	return &models.Coupon{
+		ID:                      uuid.New(),
+		Code:                    input.Code,
+		StartDate:               input.StartDate,
+		ExpiryDate:              input.ExpiryDate,
+		UsageType:               input.UsageType,
+		DiscountType:            input.DiscountType,
+		DiscountValue:           input.DiscountValue,
+		SecondaryDiscountType:   input.SecondaryDiscountType,
+		SecondaryDiscountValue:  input.SecondaryDiscountValue,
+		Currency:                input.Currency,
+		DiscountScope:           input.DiscountScope,
+		CustomerSegment:         input.CustomerSegment,
+		MinDiscountAmount:       input.MinDiscountAmount,
+		MaxDiscountAmount:       input.MaxDiscountAmount,
+		MinOrderValue:           input.MinOrderValue,
+		MinOrderTiers:           input.MinOrderTiers,
+		DiscountTiers:           input.DiscountTiers,
+		MinOnApplicableItems:    input.MinOnApplicableItems,
+		MinOrderIncludesCharges: input.MinOrderIncludesCharges,
+		MaxOrderValue:           input.MaxOrderValue,
+		AssignedUserID:          input.AssignedUserID,
+		MaxUsagePerUser:         input.MaxUsagePerUser,
+		MaxUsagePerUserDay:      input.MaxUsagePerUserDay,
+		MaxTotalUsage:           input.MaxTotalUsage,
+		RolloutPercentage:       input.RolloutPercentage,
+		MinItemCount:            input.MinItemCount,
+		ValidTimeWindow:         input.ValidTimeWindow,
+		DailyWindow:             input.DailyWindow,
+		PaymentMethods:          input.PaymentMethods,
+		TermsAndConditions:      input.TermsAndConditions,
+		ApplicableMedicines:     medicineRefs(input.ApplicableMedicineIDs),
+		ApplicableCategories:    categoryRefs(input.ApplicableCategoryIDs),
+		IsActive:                true,
+		Version:                 1,
+	}
+}
+
+// couponInput is the inverse of newCoupon: the definition of c as a
+// CreateCouponInput.
+func couponInput(c *models.Coupon) CreateCouponInput {
+	input := CreateCouponInput{
+		Code:                    c.Code,
+		StartDate:               c.StartDate,
+		ExpiryDate:              c.ExpiryDate,
+		UsageType:               c.UsageType,
+		DiscountType:            c.DiscountType,
+		DiscountValue:           c.DiscountValue,
+		SecondaryDiscountType:   c.SecondaryDiscountType,
+		SecondaryDiscountValue:  c.SecondaryDiscountValue,
+		Currency:                c.Currency,
+		DiscountScope:           c.DiscountScope,
+		CustomerSegment:         c.CustomerSegment,
+		MinDiscountAmount:       c.MinDiscountAmount,
+		MaxDiscountAmount:       c.MaxDiscountAmount,
+		MinOrderValue:           c.MinOrderValue,
+		MinOrderTiers:           c.MinOrderTiers,
+		DiscountTiers:           c.DiscountTiers,
+		MinOnApplicableItems:    c.MinOnApplicableItems,
+		MinOrderIncludesCharges: c.MinOrderIncludesCharges,
+		MaxOrderValue:           c.MaxOrderValue,
+		AssignedUserID:          c.AssignedUserID,
+		MaxUsagePerUser:         c.MaxUsagePerUser,
+		MaxUsagePerUserDay:      c.MaxUsagePerUserDay,
+		MaxTotalUsage:           c.MaxTotalUsage,
+		RolloutPercentage:       c.RolloutPercentage,
+		MinItemCount:            c.MinItemCount,
+		ValidTimeWindow:         c.ValidTimeWindow,
+		DailyWindow:             c.DailyWindow,
+		PaymentMethods:          c.PaymentMethods,
+		TermsAndConditions:      c.TermsAndConditions,
+		ApplicableMedicineIDs:   make([]uuid.UUID, len(c.ApplicableMedicines)),
+		ApplicableCategoryIDs:   make([]uuid.UUID, len(c.ApplicableCategories)),
+	}
+	for i, m := range c.ApplicableMedicines {
+		input.ApplicableMedicineIDs[i] = m.ID
+	}
+	for i, cat := range c.ApplicableCategories {
+		input.ApplicableCategoryIDs[i] = cat.ID
+	}
+	return input
+}
+
+// medicineRefs and categoryRefs build ID-only association values for linking
+// a coupon to existing catalog rows.
+func medicineRefs(ids []uuid.UUID) []models.Medicine {
+	refs := make([]models.Medicine, len(ids))
+	for i, id := range ids {
+		refs[i] = models.Medicine{ID: id}
+	}
+	return refs
+}
+
+func categoryRefs(ids []uuid.UUID) []models.Category {
+	refs := make([]models.Category, len(ids))
+	for i, id := range ids {
+		refs[i] = models.Category{ID: id}
+	}
+	return refs
+}
+
+type ValidateCouponInput struct {
+	Code      string
+	CartItems []models.Medicine
+	Order     models.OrderContext
+	// PaymentMethod is how the order will be paid, e.g. "upi". It may be
+	// empty for anonymous previews, which then skip the payment check.
+	PaymentMethod string
+	// Currency is the ISO 4217 code the order is priced in; empty means
+	// models.DefaultCurrency.
+	Currency string
+	UserID   uuid.UUID
+	// OrderID is optional for ValidateCoupon, where it enables the
+	// one-coupon-per-order check, and required for RecordCouponUsage.
+	OrderID   uuid.UUID
+	Timestamp time.Time
+	// DryRun makes RecordCouponUsage validate and price the coupon without
+	// recording a usage. ValidateCoupon never records, regardless of DryRun.
+	DryRun bool
+
+	// priorCouponOrders is how many earlier orders the user redeemed a
+	// coupon on, which decides their customer segment and tiered minimum.
+	// Orders without a coupon are not counted, since this service never sees
+	// them. It is never taken from the caller; see withCouponHistory.
+	priorCouponOrders int
+}
+
+// Reason codes returned in ValidateCouponOutput.Reason when a coupon is
+// rejected, so clients can branch without parsing Message.
+const (
+	ReasonNotFound           = "NOT_FOUND"
+	ReasonNotStarted         = "NOT_STARTED"
+	ReasonNotValid           = "NOT_VALID"
+	ReasonNotApplicable      = "NOT_APPLICABLE"
+	ReasonAlreadyUsed        = "ALREADY_USED"
+	ReasonUsageLimitExceeded = "USAGE_LIMIT_EXCEEDED"
+	ReasonDailyLimitExceeded = "DAILY_LIMIT_EXCEEDED"
+	ReasonFullyRedeemed      = "FULLY_REDEEMED"
+	ReasonTooFewItems        = "TOO_FEW_ITEMS"
+	ReasonOrderHasCoupon     = "ORDER_HAS_COUPON"
+	ReasonOrderTooLarge      = "ORDER_TOO_LARGE"
+	ReasonNotYours           = "NOT_YOURS"
+	ReasonWrongSegment       = "WRONG_SEGMENT"
+	ReasonPaymentMethod      = "PAYMENT_METHOD_NOT_ALLOWED"
+	ReasonCurrencyMismatch   = "CURRENCY_MISMATCH"
+	ReasonNotInRollout       = "NOT_IN_ROLLOUT"
+)
+
+type ValidateCouponOutput struct {
+	IsValid         bool            `json:"is_valid"`
+	ItemsDiscount   decimal.Decimal `json:"items_discount"`
+	ChargesDiscount decimal.Decimal `json:"charges_discount"`
+	// MatchedSubtotal is the total price of the cart items the coupon
+	// applies to.
+	MatchedSubtotal decimal.Decimal `json:"matched_subtotal"`
+	// TotalDiscount is ItemsDiscount plus ChargesDiscount. FinalPayable is
+	// the order total, including delivery and taxes, less TotalDiscount, never
+	// below zero; clients should charge it rather than recomputing it.
+	TotalDiscount decimal.Decimal `json:"total_discount"`
+	FinalPayable  decimal.Decimal `json:"final_payable"`
+	// OrderCapApplied reports that the discount was reduced to keep the
+	// order within the configured order-level maximum discount.
+	OrderCapApplied bool `json:"order_cap_applied"`
+	// RemainingUses is how many more times the user may redeem the coupon;
+	// after a recorded redemption it already excludes that one. It is
+	// omitted for coupons without a per-user limit and for anonymous
+	// previews.
+	RemainingUses *int `json:"remaining_uses,omitempty"`
+	// LineDiscounts splits ItemsDiscount across the cart lines the coupon
+	// applies to, for itemized receipts. The amounts sum to ItemsDiscount.
+	LineDiscounts []models.LineDiscount `json:"line_discounts,omitempty"`
+	// Suggestion, set only on request (see SuggestBetterCoupon), names a
+	// coupon that would save the user more than this one.
+	Suggestion *CouponSuggestion `json:"suggestion,omitempty"`
+	Reason     string            `json:"reason,omitempty"`
+	Message    string            `json:"message"`
+}
+
+// settle fills in TotalDiscount, FinalPayable and, for a valid coupon,
+// LineDiscounts for input's order.
+func (o *ValidateCouponOutput) settle(coupon *models.Coupon, input ValidateCouponInput) {
+	o.TotalDiscount = o.ItemsDiscount.Add(o.ChargesDiscount)
+	o.FinalPayable = decimal.Max(input.Order.Total().Sub(o.TotalDiscount), decimal.Zero)
+	if o.IsValid && coupon != nil {
+		o.LineDiscounts = coupon.AllocateDiscount(input.CartItems, o.ItemsDiscount)
+	}
+}
+
+// applyOrderCap reduces a valid output's discount so that, together with the
+// discounts already recorded against input's order, it stays within the
+// order-level cap.
+func (s *CouponService) applyOrderCap(ctx context.Context, input ValidateCouponInput, o *ValidateCouponOutput) error {
+	if !o.IsValid {
+		return nil
+	}
+	limit, capped, err := s.orderCapLimit(ctx, input)
+	if err != nil || !capped {
+		return err
+	}
+	o.capAt(limit)
+	return nil
+}
+
+// orderCapLimit returns how much more discount input's order may receive
+// under the order-level cap, and false if no cap is configured.
+func (s *CouponService) orderCapLimit(ctx context.Context, input ValidateCouponInput) (decimal.Decimal, bool, error) {
+	if !s.maxOrderDiscountPct.IsPositive() {
+		return decimal.Zero, false, nil
+	}
+
+	limit := s.rounding.Round(input.Order.ItemsTotal.Mul(s.maxOrderDiscountPct).Div(decimal.NewFromInt(100)))
+	if input.OrderID != uuid.Nil {
+		granted, err := s.repo.SumOrderDiscount(ctx, input.OrderID)
+		if err != nil {
+			return decimal.Zero, false, err
+		}
+		limit = decimal.Max(limit.Sub(granted), decimal.Zero)
+	}
+	return limit, true, nil
+}
+
+// capAt reduces the discount to at most limit, taking it from items before
+// charges.
+func (o *ValidateCouponOutput) capAt(limit decimal.Decimal) {
+	if o.ItemsDiscount.Add(o.ChargesDiscount).LessThanOrEqual(limit) {
+		return
+	}
+	o.ChargesDiscount = decimal.Min(o.ChargesDiscount, limit)
+	o.ItemsDiscount = limit.Sub(o.ChargesDiscount)
+	o.OrderCapApplied = true
+}
+
+// ValidateCoupon checks whether the coupon can be applied and computes the
+// discount. It is read-only and never records a usage; use RecordCouponUsage
+// to redeem.
+func (s *CouponService) ValidateCoupon(ctx context.Context, input ValidateCouponInput) (*ValidateCouponOutput, error) {
+	input, err := s.withCouponHistory(ctx, input)
+	if err != nil {
+		return s.finishValidation(ctx, input, nil, nil, err)
+	}
+	coupon, output, err := s.validateCoupon(ctx, input, false)
+	return s.finishValidation(ctx, input, coupon, output, err)
+}
+
+// withCouponHistory returns input with the number of earlier orders the user
+// redeemed a coupon on filled in. Clients cannot be trusted to report it,
+// since it decides segment-restricted coupons and tiered minimums.
+func (s *CouponService) withCouponHistory(ctx context.Context, input ValidateCouponInput) (ValidateCouponInput, error) {
+	if input.UserID == uuid.Nil {
+		return input, nil
+	}
+	count, err := s.repo.CountCouponOrders(ctx, input.UserID, input.OrderID)
+	if err != nil {
+		return input, err
+	}
+	input.priorCouponOrders = count
+	return input, nil
+}
+
+// finishValidation applies the order cap to the result of validating input,
+// settles it, and records it in the logs and metrics.
+func (s *CouponService) finishValidation(ctx context.Context, input ValidateCouponInput, coupon *models.Coupon, output *ValidateCouponOutput, err error) (*ValidateCouponOutput, error) {
+	if err == nil {
+		err = s.applyOrderCap(ctx, input, output)
+	}
+	if err == nil {
+		output.settle(coupon, input)
+	}
+	logValidation(ctx, "coupon validated", input, output, err)
+	metrics.CouponValidations.WithLabelValues(validationResult(output, err)).Inc()
+	return output, err
+}
+
+// RevalidatedCoupon is the result of re-validating one previously applied
+// code against an updated cart.
+type RevalidatedCoupon struct {
+	Code string `json:"code"`
+	ValidateCouponOutput
+}
+
+// RevalidateCoupons re-runs ValidateCoupon for each of codes against the
+// cart in input (whose Code is ignored), so a client can refresh every
+// applied coupon after a cart edit in one call. Results are in the order of
+// codes. The coupons are looked up together in one query. Like ValidateCoupon
+// it never records a usage.
+func (s *CouponService) RevalidateCoupons(ctx context.Context, codes []string, input ValidateCouponInput) ([]RevalidatedCoupon, error) {
+	input, err := s.withCouponHistory(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := make([]string, 0, len(codes))
+	for _, code := range codes {
+		if s.codeMayExist(code) {
+			lookup = append(lookup, code)
+		}
+	}
+	found, err := s.repo.GetByCodes(ctx, lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]RevalidatedCoupon, 0, len(codes))
+	for _, code := range codes {
+		input.Code = code
+		coupon, output, err := s.checkCoupon(ctx, found[models.NormalizeCode(code)], input, false)
+		output, err = s.finishValidation(ctx, input, coupon, output, err)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, RevalidatedCoupon{Code: code, ValidateCouponOutput: *output})
+	}
+	return results, nil
+}
+
+// CouponSuggestion is a coupon the user could use instead of the one they
+// validated, and what it would save them.
+type CouponSuggestion struct {
+	Code    string          `json:"code"`
+	Savings decimal.Decimal `json:"savings"`
+}
+
+// SuggestBetterCoupon looks for a coupon that would save the user more on
+// input's order than current, the result of validating input.Code. Only
+// coupons that pass every validation rule for the user are considered (see
+// GetApplicableCoupons), priced as ValidateCoupon would price them, with the
+// order-level cap applied. It returns nil when nothing saves more, including
+// for carts too large to search.
+func (s *CouponService) SuggestBetterCoupon(ctx context.Context, input ValidateCouponInput, current *ValidateCouponOutput) (*CouponSuggestion, error) {
+	input, err := s.withCouponHistory(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	ranked, err := s.rankApplicable(ctx, input)
+	if errors.Is(err, ErrCartTooLargeToScan) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	baseline := decimal.Zero
+	if current.IsValid {
+		baseline = current.TotalDiscount
+	}
+	code := models.NormalizeCode(input.Code)
+	for _, r := range ranked {
+		if r.coupon.Code == code {
+			continue
+		}
+		// ranked is best first, so the first other coupon is the only
+		// candidate
+		if r.output.TotalDiscount.GreaterThan(baseline) {
+			return &CouponSuggestion{Code: r.coupon.Code, Savings: r.output.TotalDiscount}, nil
+		}
+		break
+	}
+	return nil, nil
+}
+
+// PreviewCoupon is ValidateCoupon for an anonymous visitor: it runs every
+// rule that depends only on the coupon and the cart, but none of the per-user
+// redemption limits or the per-order check. input.UserID and input.OrderID
+// are ignored. A valid preview is not a promise that the code will redeem.
+func (s *CouponService) PreviewCoupon(ctx context.Context, input ValidateCouponInput) (*ValidateCouponOutput, error) {
+	input.UserID = uuid.Nil
+	input.OrderID = uuid.Nil
+
+	// Previews never depend on a user's redemptions, so identical ones can
+	// be answered from the cache until the coupon changes
+	code := models.NormalizeCode(input.Code)
+	signature := previewSignature(input)
+	var cached ValidateCouponOutput
+	if s.cache.GetPreview(ctx, code, signature, &cached) {
+		logValidation(ctx, "coupon preview served from cache", input, &cached, nil)
+		return &cached, nil
+	}
+
+	coupon, output, err := s.validateCoupon(ctx, input, true)
+	if err == nil {
+		err = s.applyOrderCap(ctx, input, output)
+	}
+	if err == nil {
+		output.settle(coupon, input)
+		s.cache.SetPreview(ctx, code, signature, output)
+	}
+	logValidation(ctx, "coupon previewed", input, output, err)
+	return output, err
+}
+
+// previewSignature hashes everything besides the code that a preview's
+// outcome depends on. The timestamp only counts to the minute, so repeated
+// previews within a minute share an entry.
+func previewSignature(input ValidateCouponInput) string {
+	data, _ := json.Marshal(struct {
+		CartItems         []models.Medicine
+		Order             models.OrderContext
+		PriorCouponOrders int
+		PaymentMethod     string
+		Currency          string
+		Minute            time.Time
+	}{
+		CartItems:         input.CartItems,
+		Order:             input.Order,
+		PriorCouponOrders: input.priorCouponOrders,
+		PaymentMethod:     strings.ToLower(strings.TrimSpace(input.PaymentMethod)),
+		Currency:          models.NormalizeCurrency(input.Currency),
+		Minute:            input.Timestamp.Truncate(time.Minute),
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validationResult maps a validation outcome onto the bounded label set of
+// metrics.CouponValidations.
+func validationResult(output *ValidateCouponOutput, err error) string {
+	switch {
+	case err != nil:
+		return metrics.ResultError
+	case output.IsValid:
+		return metrics.ResultValid
+	default:
+		return output.Reason
+	}
+}
+
+func logValidation(ctx context.Context, msg string, input ValidateCouponInput, output *ValidateCouponOutput, err error) {
+	logger := logging.FromContext(ctx).With(
+		"coupon_code", input.Code,
+		"user_id", input.UserID,
+		"order_total", input.Order.ItemsTotal,
+	)
+	if err != nil {
+		logger.Error(msg, "error", err)
+		return
+	}
+	logger.Info(msg,
+		"valid", output.IsValid,
+		"reason", output.Reason,
+		"items_discount", output.ItemsDiscount,
+	)
+}
+
+// validateCoupon looks up input.Code and runs every validation rule on it
+// (see checkCoupon).
+func (s *CouponService) validateCoupon(ctx context.Context, input ValidateCouponInput, anonymous bool) (*models.Coupon, *ValidateCouponOutput, error) {
+	var coupon *models.Coupon
+	if s.codeMayExist(input.Code) {
+		var err error
+		coupon, err = s.repo.GetByCode(ctx, input.Code)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return s.checkCoupon(ctx, coupon, input, anonymous)
+}
+
+// codeMayExist reports whether code is worth looking up: with checksummed
+// codes, a code with a bad check character cannot exist.
+func (s *CouponService) codeMayExist(code string) bool {
+	return !s.checksumCodes || codec.Validate(code)
+}
+
+// checkCoupon runs every validation rule on coupon, the active coupon with
+// input.Code or nil if there is none, and returns it along with the result.
+// With anonymous set the rules that need a known user's redemption history
+// are skipped.
+func (s *CouponService) checkCoupon(ctx context.Context, coupon *models.Coupon, input ValidateCouponInput, anonymous bool) (*models.Coupon, *ValidateCouponOutput, error) {
+	if coupon == nil {
+		return nil, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonNotFound,
+			Message: "coupon not found",
+		}, nil
+	}
+
+	if !coupon.IsAssignedTo(input.UserID) {
+		return coupon, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonNotYours,
+			Message: "coupon is assigned to another user",
+		}, nil
+	}
+
+	// Anonymous previews have no user to bucket into the rollout
+	if !anonymous && !coupon.InRollout(input.UserID) {
+		return coupon, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonNotInRollout,
+			Message: "coupon is not available to this user",
+		}, nil
+	}
+
+	// Anonymous previews have no order history to check the segment against
+	if !anonymous && !coupon.InSegment(input.priorCouponOrders) {
+		message := "coupon is only for customers who have used a coupon before"
+		if coupon.CustomerSegment == models.FirstCouponCustomers {
+			message = "coupon is only for customers using their first coupon"
+		}
+		return coupon, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonWrongSegment,
+			Message: message,
+		}, nil
+	}
+
+	if (!anonymous || input.PaymentMethod != "") && !coupon.PaymentMethods.Allows(input.PaymentMethod) {
+		return coupon, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonPaymentMethod,
+			Message: "coupon is only valid when paying with " + strings.Join(coupon.PaymentMethods, ", "),
+		}, nil
+	}
+
+	if !coupon.AcceptsCurrency(input.Currency) {
+		return coupon, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonCurrencyMismatch,
+			Message: "coupon is only valid for orders in " + models.NormalizeCurrency(coupon.Currency),
+		}, nil
+	}
+
+	if !coupon.HasStarted(input.Timestamp) {
+		return coupon, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonNotStarted,
+			Message: "coupon is not active yet",
+		}, nil
+	}
+
+	if coupon.ExceedsMaxOrderValue(input.Order.ItemsTotal) {
+		return coupon, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonOrderTooLarge,
+			Message: fmt.Sprintf("coupon is only valid for orders up to %s", coupon.MaxOrderValue.StringFixed(2)),
+		}, nil
+	}
+
+	// Basic validation
+	if !coupon.IsValidForUser(input.CartItems, input.Order, input.priorCouponOrders, input.Timestamp) {
+		return coupon, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonNotValid,
+			Message: "coupon is not valid for this order",
+		}, nil
+	}
+
+	// Check if the coupon is applicable to the cart items
+	if !coupon.AppliesTo(input.CartItems) {
+		return coupon, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonNotApplicable,
+			Message: "coupon is not applicable to any items in cart",
+		}, nil
+	}
+
+	if coupon.MinItemCount > 0 && models.ItemCount(input.CartItems) < coupon.MinItemCount {
+		return coupon, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonTooFewItems,
+			Message: fmt.Sprintf("coupon requires at least %d items in cart", coupon.MinItemCount),
+		}, nil
+	}
+
+	// The global cap reads the denormalized counter rather than counting
+	// usage rows; redemption re-checks it atomically.
+	if coupon.FullyRedeemed() {
+		return coupon, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonFullyRedeemed,
+			Message: "coupon has been fully redeemed",
+		}, nil
+	}
+
+	var remaining *int
+	if !anonymous {
+		used, rejection, err := s.checkUserUsage(ctx, coupon, input)
+		if err != nil {
+			return coupon, nil, err
+		}
+		remaining = remainingUses(coupon, used)
+		if rejection != nil {
+			rejection.RemainingUses = remaining
+			return coupon, rejection, nil
+		}
+	}
+
+	discount := s.roundDiscount(coupon.CalculateItemsDiscount(input.CartItems, input.Order.ItemsTotal), input.Order.ItemsTotal)
+
+	return coupon, &ValidateCouponOutput{
+		IsValid:         true,
+		ItemsDiscount:   discount,
+		MatchedSubtotal: coupon.EligibleSubtotal(input.CartItems),
+		ChargesDiscount: decimal.Zero, // Can be extended for delivery fee discounts
+		RemainingUses:   remaining,
+		Message:         "coupon applied successfully",
+	}, nil
+}
+
+// remainingUses is how many more times a user with used redemptions may
+// redeem coupon, or nil when the coupon has no per-user limit.
+func remainingUses(coupon *models.Coupon, used int) *int {
+	max, ok := coupon.MaxUsesPerUser()
+	if !ok {
+		return nil
+	}
+	remaining := 0
+	if used < max {
+		remaining = max - used
+	}
+	return &remaining
+}
+
+// checkUserUsage applies the redemption limits that depend on the user's
+// history and the order: per-user and daily caps, one-time reuse and the
+// one-coupon-per-order rule. It returns how many times the user has redeemed
+// the coupon and a rejection, or nil if none applies.
+func (s *CouponService) checkUserUsage(ctx context.Context, coupon *models.Coupon, input ValidateCouponInput) (used int, rejection *ValidateCouponOutput, err error) {
+	usageCount, err := s.repo.GetUserCouponUsage(ctx, coupon.ID, input.UserID, time.Time{})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if coupon.UsageType == models.OneTime && usageCount > 0 {
+		return usageCount, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonAlreadyUsed,
+			Message: "one-time coupon already used",
+		}, nil
+	}
+
+	if coupon.UsageType == models.MultiUse && usageCount >= coupon.MaxUsagePerUser {
+		return usageCount, &ValidateCouponOutput{
+			IsValid: false,
+			Reason:  ReasonUsageLimitExceeded,
+			Message: "coupon usage limit exceeded",
+		}, nil
+	}
+
+	// Daily caps count redemptions in the 24 hours before the order
+	if coupon.MaxUsagePerUserDay > 0 {
+		recent, err := s.repo.GetUserCouponUsage(ctx, coupon.ID, input.UserID, input.Timestamp.Add(-24*time.Hour))
+		if err != nil {
+			return usageCount, nil, err
+		}
+		if recent >= coupon.MaxUsagePerUserDay {
+			return usageCount, &ValidateCouponOutput{
+				IsValid: false,
+				Reason:  ReasonDailyLimitExceeded,
+				Message: fmt.Sprintf("coupon can be used at most %d times in 24 hours", coupon.MaxUsagePerUserDay),
+			}, nil
+		}
+	}
+
+	if input.OrderID != uuid.Nil {
+		total, sameCoupon, err := s.repo.CountOrderUsages(ctx, input.OrderID, coupon.ID)
+		if err != nil {
+			return usageCount, nil, err
+		}
+		if sameCoupon > 0 || (total > 0 && !s.allowStacking) {
+			return usageCount, &ValidateCouponOutput{
+				IsValid: false,
+				Reason:  ReasonOrderHasCoupon,
+				Message: "order already has a coupon applied",
+			}, nil
+		}
+	}
+
+	return usageCount, nil, nil
+}
+
+type BestCouponOutput struct {
+	Coupon  models.Coupon   `json:"coupon"`
+	Savings decimal.Decimal `json:"savings"`
+}
+
+// GetBestCoupon returns the applicable coupon granting the largest discount
+// on input's cart, or nil if none apply. Savings is the TotalDiscount that
+// ValidateCoupon would report for it, order-level cap included. Ties go to the
+// coupon expiring first, then to the lexically smallest code. input.Code is
+// ignored.
+func (s *CouponService) GetBestCoupon(ctx context.Context, input ValidateCouponInput) (*BestCouponOutput, error) {
+	input, err := s.withCouponHistory(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	ranked, err := s.rankApplicable(ctx, input)
+	if err != nil || len(ranked) == 0 {
+		return nil, err
+	}
+	return &BestCouponOutput{Coupon: ranked[0].coupon, Savings: ranked[0].output.TotalDiscount}, nil
+}
+
+func betterCoupon(a *models.Coupon, aSavings decimal.Decimal, b *models.Coupon, bSavings decimal.Decimal) bool {
+	if !aSavings.Equal(bSavings) {
+		return aSavings.GreaterThan(bSavings)
+	}
+	if !a.ExpiryDate.Equal(b.ExpiryDate) {
+		return a.ExpiryDate.Before(b.ExpiryDate)
+	}
+	return a.Code < b.Code
+}
+
+// GetApplicableCoupons returns the active coupons the user may apply to
+// input's order, ordered by the discount each grants on it, largest first
+// (ties broken as in GetBestCoupon). A coupon is applicable only if
+// ValidateCoupon would accept it: every rule, including the user's segment,
+// payment method, currency and redemption limits, is checked. input.Code is
+// ignored. Carts larger than the scan limit are rejected with
+// ErrCartTooLargeToScan.
+func (s *CouponService) GetApplicableCoupons(ctx context.Context, input ValidateCouponInput) ([]models.Coupon, error) {
+	input, err := s.withCouponHistory(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	ranked, err := s.rankApplicable(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	var applicable []models.Coupon
+	for _, r := range ranked {
+		applicable = append(applicable, r.coupon)
+	}
+	return applicable, nil
+}
+
+// rankedCoupon is a coupon that passed validation for an order, with the
+// settled result.
+type rankedCoupon struct {
+	coupon models.Coupon
+	output *ValidateCouponOutput
+}
+
+// rankApplicable validates every candidate coupon for input's order with
+// checkCoupon and returns those that pass, best first by TotalDiscount after
+// the order-level cap, as ValidateCoupon would report it. Candidates are
+// cached per cart and order-total bucket; the cached set only narrows the
+// search, so everything it cannot vouch for, such as the exact total, the
+// daily window or the user's history, is checked afresh. input must already
+// carry the user's order history.
+func (s *CouponService) rankApplicable(ctx context.Context, input ValidateCouponInput) ([]rankedCoupon, error) {
+	if len(input.CartItems) > s.maxScanCartItems {
+		return nil, ErrCartTooLargeToScan
+	}
+
+	limit, capped, err := s.orderCapLimit(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	orderTotal := input.Order.ItemsTotal
+	coupons, ok := s.cache.GetApplicable(ctx, input.UserID, input.CartItems, orderTotal)
+	if !ok {
+		coupons, err = s.repo.GetApplicableCoupons(ctx, input.UserID, input.CartItems, cache.BucketFloor(orderTotal), cache.BucketCeiling(orderTotal))
+		if err != nil {
+			return nil, err
+		}
+		s.cache.SetApplicable(ctx, input.UserID, input.CartItems, orderTotal, coupons)
+	}
+
+	var ranked []rankedCoupon
+	for i := range coupons {
+		input.Code = coupons[i].Code
+		_, output, err := s.checkCoupon(ctx, &coupons[i], input, false)
+		if err != nil {
+			return nil, err
+		}
+		if !output.IsValid {
+			continue
+		}
+		if capped {
+			output.capAt(limit)
+		}
+		output.settle(&coupons[i], input)
+		ranked = append(ranked, rankedCoupon{coupon: coupons[i], output: output})
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return betterCoupon(&ranked[i].coupon, ranked[i].output.TotalDiscount, &ranked[j].coupon, ranked[j].output.TotalDiscount)
+	})
+	return ranked, nil
+}
+
+// ListOffersForMedicine returns the coupons a shopper could use on the
+// medicine, for product pages, or ErrMedicineNotFound. Whether a coupon
+// actually applies still depends on the rest of the cart and the user.
+func (s *CouponService) ListOffersForMedicine(ctx context.Context, medicineID uuid.UUID) ([]models.CouponOffer, error) {
+	missing, _, err := s.repo.MissingReferences(ctx, []uuid.UUID{medicineID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, ErrMedicineNotFound
+	}
+	return s.repo.ListOffersForMedicine(ctx, medicineID, time.Now())
+}
+
+// ListAuditLog returns the audit trail of coupon id, oldest first, or
+// ErrCouponNotFound.
+func (s *CouponService) ListAuditLog(ctx context.Context, id uuid.UUID) ([]models.AuditLog, error) {
+	coupon, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if coupon == nil {
+		return nil, ErrCouponNotFound
+	}
+	return s.repo.ListAuditLog(ctx, id)
+}
+
+// GetCouponStats returns redemption statistics for a coupon, or
+// ErrCouponNotFound if the coupon does not exist.
+func (s *CouponService) GetCouponStats(ctx context.Context, couponID uuid.UUID) (*models.CouponStats, error) {
+	coupon, err := s.repo.GetByID(ctx, couponID)
+	if err != nil {
+		return nil, err
+	}
+	if coupon == nil {
+		return nil, ErrCouponNotFound
+	}
+	return s.repo.GetCouponStats(ctx, couponID)
+}
+
+// RecordCouponUsage re-validates the coupon for the order and, if it is still
+// valid, records the redemption together with the discount granted and the
+// order total it was computed against. The validation result is returned in
+// either case; nothing is recorded when it is not valid or when input.DryRun
+// is set. This is the only call that consumes a coupon.
+func (s *CouponService) RecordCouponUsage(ctx context.Context, input ValidateCouponInput) (*ValidateCouponOutput, error) {
+	input, err := s.withCouponHistory(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	coupon, result, err := s.validateCoupon(ctx, input, false)
+	if err == nil {
+		err = s.applyOrderCap(ctx, input, result)
+	}
+	if err == nil {
+		result.settle(coupon, input)
+	}
+	logValidation(ctx, "coupon redemption validated", input, result, err)
+	if err != nil || !result.IsValid || input.DryRun {
+		return result, err
+	}
+
+	usage := &models.CouponUsage{
+		ID:              uuid.New(),
+		CouponID:        coupon.ID,
+		UserID:          input.UserID,
+		OrderID:         input.OrderID,
+		DiscountApplied: result.TotalDiscount,
+		OrderTotal:      input.Order.ItemsTotal,
+		UsedAt:          time.Now(),
+		CreatedAt:       time.Now(),
+	}
+
+	if err := s.repo.RecordCouponUsage(ctx, usage, s.allowStacking); err != nil {
+		logging.FromContext(ctx).Error("failed to record coupon usage",
+			"coupon_code", input.Code,
+			"user_id", input.UserID,
+			"order_id", input.OrderID,
+			"error", err,
+		)
+		return nil, err
+	}
+
+	if result.RemainingUses != nil {
+		remaining := *result.RemainingUses - 1
+		result.RemainingUses = &remaining
+	}
+
+	metrics.CouponRedemptions.Inc()
+	logging.FromContext(ctx).Info("coupon redeemed",
+		"coupon_code", input.Code,
+		"user_id", input.UserID,
+		"order_id", input.OrderID,
+		"discount_applied", usage.DiscountApplied,
+	)
+	return result, nil
+}
+
+// GetLiabilityReport estimates discount exposure across active coupons. See
+// models.LiabilityReport for the estimation method.
+func (s *CouponService) GetLiabilityReport(ctx context.Context) (*models.LiabilityReport, error) {
+	coupons, err := s.repo.ListActive(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	report := &models.LiabilityReport{
+		ActiveCoupons:    len(coupons),
+		UnboundedCoupons: []string{},
+		Coupons:          make([]models.CouponLiability, 0, len(coupons)),
+	}
+	for _, coupon := range coupons {
+		entry := models.CouponLiability{
+			CouponID: coupon.ID,
+			Code:     coupon.Code,
+		}
+
+		maxDiscount, discountBounded := coupon.MaxDiscountPerUse()
+		if discountBounded {
+			entry.MaxDiscountPerUse = &maxDiscount
+		}
+		maxUses, usesBounded := coupon.MaxUsesPerUser()
+		if usesBounded {
+			entry.MaxUsesPerUser = &maxUses
+		}
+
+		if discountBounded && usesBounded {
+			exposure := maxDiscount.Mul(decimal.NewFromInt(int64(maxUses)))
+			entry.PerCustomerExposure = &exposure
+			report.PerCustomerExposure = report.PerCustomerExposure.Add(exposure)
+		} else {
+			report.UnboundedCoupons = append(report.UnboundedCoupons, coupon.Code)
+		}
+
+		report.Coupons = append(report.Coupons, entry)
+	}
+
+	return report, nil
+}
+
+// ReconcileUsage recounts coupon id's redemptions and corrects its TimesUsed
+// counter if it has drifted, returning the counter before and after. It
+// returns ErrCouponNotFound if there is no such coupon.
+func (s *CouponService) ReconcileUsage(ctx context.Context, id uuid.UUID) (*models.UsageReconciliation, error) {
+	result, err := s.repo.ReconcileUsage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, ErrCouponNotFound
+	}
+	return result, nil
+}
+
+// DeactivateExpired soft-expires coupons past their expiry date so they drop
+// out of the active set, and returns how many were deactivated. It returns
+// repository.ErrJobLocked if another instance is doing the same right now.
+func (s *CouponService) DeactivateExpired(ctx context.Context) (int64, error) {
+	n, err := s.repo.DeactivateExpired(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		s.cache.InvalidateApplicable(ctx)
+	}
+	return n, nil
+}
+
+// ErrInvalidPurgeCutoff is returned by PurgeUsage for a cutoff that is not in
+// the past.
+var ErrInvalidPurgeCutoff = errors.New("before must be in the past")
+
+// PurgeUsage deletes redemptions made before before of coupons that can no
+// longer be redeemed, and returns how many were deleted. See
+// repository.CouponRepository.PurgeUsage for what is kept and why.
+func (s *CouponService) PurgeUsage(ctx context.Context, before time.Time) (int64, error) {
+	now := time.Now()
+	if !before.Before(now) {
+		return 0, ErrInvalidPurgeCutoff
+	}
+	n, err := s.repo.PurgeUsage(ctx, before, now)
+	if n > 0 {
+		logging.FromContext(ctx).Info("purged coupon usage", "before", before, "count", n)
+	}
+	return n, err
+}
+
+// CountActive returns the number of active, unexpired coupons.
+func (s *CouponService) CountActive(ctx context.Context) (int64, error) {
+	return s.repo.CountActive(ctx, time.Now())
+}
+
+// DeactivateByPrefix deactivates every active coupon whose code starts with
+// prefix (case-insensitive), e.g. to kill a leaked campaign, and returns how
+// many were deactivated.
+func (s *CouponService) DeactivateByPrefix(ctx context.Context, prefix string) (int64, error) {
+	n, err := s.repo.DeactivateByPrefix(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		s.cache.InvalidateApplicable(ctx)
+	}
+	return n, nil
+}
+
+// DeactivateCodes deactivates the active coupons with the given codes and
+// returns how many were deactivated.
+func (s *CouponService) DeactivateCodes(ctx context.Context, codes []string) (int64, error) {
+	n, err := s.repo.DeactivateByCodes(ctx, codes)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		s.cache.InvalidateApplicable(ctx)
+	}
+	return n, nil
+}
+
+func (s *CouponService) GetCategoryMatrix(ctx context.Context, categoryIDs []uuid.UUID) (map[uuid.UUID][]string, error) {
+	return s.repo.GetCategoryMatrix(ctx, categoryIDs)
+}
+
+// SearchCoupons returns up to limit coupons whose code starts with prefix,
+// ignoring case.
+func (s *CouponService) SearchCoupons(ctx context.Context, prefix string, limit int) ([]models.CouponSearchResult, error) {
+	return s.repo.SearchByCodePrefix(ctx, prefix, limit)
+}
+
+// TopCoupons returns the best-performing coupons by redemptions used in
+// [from, to), ranked by sortBy.
+func (s *CouponService) TopCoupons(ctx context.Context, from, to time.Time, sortBy models.PerformanceSort, limit int) ([]models.CouponPerformance, error) {
+	return s.repo.TopCoupons(ctx, from, to, sortBy, limit)
+}
+
+// ListUserUsage returns a page of userID's redemptions, most recent first,
+// together with totals over all of the user's redemptions.
+func (s *CouponService) ListUserUsage(ctx context.Context, userID uuid.UUID, limit, offset int) ([]repository.UsageRecord, *models.UserUsageSummary, error) {
+	summary, err := s.repo.GetUserUsageSummary(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	usages, err := s.repo.ListUsageByUser(ctx, userID, limit, offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	return usages, summary, nil
+}
+
+// ErrInvalidLimit is returned by ListUsage for a page size that is not
+// positive.
+var ErrInvalidLimit = errors.New("limit must be positive")
+
+// ListUsage returns up to limit redemptions after cursor in (used_at, id)
+// order, and the cursor of the following page, which is nil after the last.
+func (s *CouponService) ListUsage(ctx context.Context, cursor repository.UsageCursor, limit int) ([]repository.UsageRecord, *repository.UsageCursor, error) {
+	if limit <= 0 {
+		return nil, nil, ErrInvalidLimit
+	}
+
+	// Fetch one extra row to learn whether another page follows
+	records, err := s.repo.ListUsageAfter(ctx, cursor, limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) <= limit {
+		return records, nil, nil
+	}
+
+	records = records[:limit]
+	last := records[limit-1]
+	return records, &repository.UsageCursor{UsedAt: last.UsedAt, ID: last.ID}, nil
+}
+
+// ExportUsage streams redemptions in [from, to) to fn in used_at order.
+func (s *CouponService) ExportUsage(ctx context.Context, from, to time.Time, fn func(repository.UsageRecord) error) error {
+	return s.repo.ListUsage(ctx, from, to, fn)
+}
@@ -0,0 +1,502 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"coupon-system/internal/cache"
+	"coupon-system/internal/models"
+	"coupon-system/internal/repository"
+	"coupon-system/internal/testdb"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/shopspring/decimal"
+)
+
+func amount(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+// newTestService returns a service on a freshly emptied test database,
+// without a cache.
+func newTestService(t *testing.T) (*CouponService, *repository.CouponRepository) {
+	t.Helper()
+	repo := repository.NewCouponRepository(testdb.Open(t))
+	return NewCouponService(repo, nil), repo
+}
+
+// createCoupon stores an active 10% multi-use coupon after applying opts.
+func createCoupon(t *testing.T, repo *repository.CouponRepository, code string, opts ...func(*models.Coupon)) *models.Coupon {
+	t.Helper()
+	coupon := &models.Coupon{
+		ID:                uuid.New(),
+		Code:              code,
+		ExpiryDate:        time.Now().Add(24 * time.Hour),
+		UsageType:         models.MultiUse,
+		DiscountType:      models.PercentageDiscount,
+		DiscountValue:     amount("10"),
+		MaxUsagePerUser:   10,
+		RolloutPercentage: 100,
+		IsActive:          true,
+		Version:           1,
+	}
+	for _, opt := range opts {
+		opt(coupon)
+	}
+	if err := repo.Create(context.Background(), coupon); err != nil {
+		t.Fatalf("create coupon %s: %v", code, err)
+	}
+	return coupon
+}
+
+// orderInput is a validation of code for userID's order of a single
+// medicine at total.
+func orderInput(code string, userID uuid.UUID, total string) ValidateCouponInput {
+	return ValidateCouponInput{
+		Code:          code,
+		CartItems:     []models.Medicine{{ID: uuid.New(), Price: amount(total)}},
+		Order:         models.OrderContext{ItemsTotal: amount(total)},
+		PaymentMethod: "upi",
+		UserID:        userID,
+		OrderID:       uuid.New(),
+		Timestamp:     time.Now(),
+	}
+}
+
+func TestTieredMinimumUsesOrderHistory(t *testing.T) {
+	svc, repo := newTestService(t)
+	ctx := context.Background()
+	createCoupon(t, repo, "LOYAL", func(c *models.Coupon) {
+		c.MinOrderValue = amount("500")
+		c.MinOrderTiers = models.MinOrderTiers{{MinPriorOrders: 1, MinOrderValue: amount("200")}}
+	})
+	createCoupon(t, repo, "WELCOME")
+
+	user := uuid.New()
+	tests := []struct {
+		name      string
+		history   bool
+		wantValid bool
+	}{
+		{"first coupon customer needs the base minimum", false, false},
+		{"repeat coupon customer gets the lower tier", true, true},
+	}
+	for _, tt := range tests {
+		if tt.history {
+			if _, err := svc.RecordCouponUsage(ctx, orderInput("WELCOME", user, "100")); err != nil {
+				t.Fatalf("RecordCouponUsage: %v", err)
+			}
+		}
+		got, err := svc.ValidateCoupon(ctx, orderInput("LOYAL", user, "300"))
+		if err != nil {
+			t.Fatalf("%s: ValidateCoupon: %v", tt.name, err)
+		}
+		if got.IsValid != tt.wantValid {
+			t.Errorf("%s: IsValid = %v (%s), want %v", tt.name, got.IsValid, got.Message, tt.wantValid)
+		}
+	}
+}
+
+func TestApplicableCouponsPassValidation(t *testing.T) {
+	svc, repo := newTestService(t)
+	ctx := context.Background()
+	user := uuid.New()
+
+	createCoupon(t, repo, "PLAIN")
+	createCoupon(t, repo, "CARDONLY", func(c *models.Coupon) {
+		c.DiscountValue = amount("50")
+		c.PaymentMethods = models.PaymentMethods{"card"}
+	})
+	createCoupon(t, repo, "NEWONLY", func(c *models.Coupon) {
+		c.DiscountValue = amount("40")
+		c.CustomerSegment = models.FirstCouponCustomers
+	})
+	createCoupon(t, repo, "SOLDOUT", func(c *models.Coupon) {
+		c.DiscountValue = amount("30")
+		c.MaxTotalUsage = 1
+		c.TimesUsed = 1
+	})
+	createCoupon(t, repo, "BULK", func(c *models.Coupon) {
+		c.DiscountValue = amount("20")
+		c.MinItemCount = 3
+	})
+	createCoupon(t, repo, "EURO", func(c *models.Coupon) {
+		c.DiscountType = models.FixedDiscount
+		c.DiscountValue = amount("100")
+		c.Currency = "EUR"
+	})
+	createCoupon(t, repo, "TIERED", func(c *models.Coupon) {
+		c.DiscountValue = amount("15")
+		c.MinOrderValue = amount("500")
+		c.MinOrderTiers = models.MinOrderTiers{{MinPriorOrders: 1, MinOrderValue: amount("200")}}
+	})
+	createCoupon(t, repo, "USEDUP", func(c *models.Coupon) {
+		c.DiscountValue = amount("25")
+		c.MaxUsagePerUser = 1
+	})
+	if _, err := svc.RecordCouponUsage(ctx, orderInput("USEDUP", user, "300")); err != nil {
+		t.Fatalf("RecordCouponUsage: %v", err)
+	}
+
+	input := orderInput("", user, "300")
+	coupons, err := svc.GetApplicableCoupons(ctx, input)
+	if err != nil {
+		t.Fatalf("GetApplicableCoupons: %v", err)
+	}
+	var codes []string
+	for _, c := range coupons {
+		codes = append(codes, c.Code)
+	}
+	// The usage of USEDUP makes the user a repeat coupon customer, which
+	// unlocks TIERED's lower minimum and closes NEWONLY
+	if want := []string{"TIERED", "PLAIN"}; !slices.Equal(codes, want) {
+		t.Errorf("applicable coupons = %v, want %v", codes, want)
+	}
+
+	best, err := svc.GetBestCoupon(ctx, input)
+	if err != nil {
+		t.Fatalf("GetBestCoupon: %v", err)
+	}
+	if best == nil || best.Coupon.Code != "TIERED" || !best.Savings.Equal(amount("45")) {
+		t.Errorf("best coupon = %+v, want TIERED saving 45", best)
+	}
+}
+
+func TestBestCouponSavingsMatchValidation(t *testing.T) {
+	svc, repo := newTestService(t)
+	ctx := context.Background()
+	svc.SetOrderDiscountCap(amount("15"))
+	createCoupon(t, repo, "PLAIN")
+	createCoupon(t, repo, "CAPPED", func(c *models.Coupon) {
+		c.DiscountValue = amount("40")
+		c.MaxDiscountAmount = amount("50")
+	})
+
+	// On 300, PLAIN grants 30 and CAPPED 120 clamped to 50, which the 15%
+	// order cap cuts to 45
+	input := orderInput("", uuid.New(), "300")
+	best, err := svc.GetBestCoupon(ctx, input)
+	if err != nil {
+		t.Fatalf("GetBestCoupon: %v", err)
+	}
+	if best == nil || best.Coupon.Code != "CAPPED" || !best.Savings.Equal(amount("45")) {
+		t.Fatalf("best coupon = %+v, want CAPPED saving 45", best)
+	}
+
+	input.Code = best.Coupon.Code
+	validated, err := svc.ValidateCoupon(ctx, input)
+	if err != nil {
+		t.Fatalf("ValidateCoupon: %v", err)
+	}
+	if !validated.TotalDiscount.Equal(best.Savings) {
+		t.Errorf("ValidateCoupon total discount = %s, GetBestCoupon savings = %s", validated.TotalDiscount, best.Savings)
+	}
+}
+
+func TestBetterCoupon(t *testing.T) {
+	soon, later := time.Now().Add(time.Hour), time.Now().Add(48*time.Hour)
+	tests := []struct {
+		name     string
+		a, b     models.Coupon
+		aSavings string
+		bSavings string
+		want     bool
+	}{
+		{"larger savings wins", models.Coupon{Code: "B", ExpiryDate: later}, models.Coupon{Code: "A", ExpiryDate: soon}, "50", "40", true},
+		{"smaller savings loses", models.Coupon{Code: "A", ExpiryDate: soon}, models.Coupon{Code: "B", ExpiryDate: later}, "40", "50", false},
+		{"tie goes to earlier expiry", models.Coupon{Code: "B", ExpiryDate: soon}, models.Coupon{Code: "A", ExpiryDate: later}, "30", "30", true},
+		{"full tie goes to smaller code", models.Coupon{Code: "A", ExpiryDate: soon}, models.Coupon{Code: "B", ExpiryDate: soon}, "30", "30", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := betterCoupon(&tt.a, amount(tt.aSavings), &tt.b, amount(tt.bSavings)); got != tt.want {
+				t.Errorf("betterCoupon() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplicableCouponsSortedBySavings(t *testing.T) {
+	svc, repo := newTestService(t)
+	ctx := context.Background()
+
+	createCoupon(t, repo, "TENPCT")
+	createCoupon(t, repo, "FLAT50", func(c *models.Coupon) {
+		c.DiscountType = models.FixedDiscount
+		c.DiscountValue = amount("50")
+	})
+	createCoupon(t, repo, "CAPPED", func(c *models.Coupon) {
+		c.DiscountValue = amount("20")
+		c.MaxDiscountAmount = amount("40")
+	})
+	createCoupon(t, repo, "EARLY", func(c *models.Coupon) {
+		c.DiscountType = models.FixedDiscount
+		c.DiscountValue = amount("30")
+		c.ExpiryDate = time.Now().Add(time.Hour)
+	})
+
+	coupons, err := svc.GetApplicableCoupons(ctx, orderInput("", uuid.New(), "300"))
+	if err != nil {
+		t.Fatalf("GetApplicableCoupons: %v", err)
+	}
+	var codes []string
+	for _, c := range coupons {
+		codes = append(codes, c.Code)
+	}
+	// TENPCT and EARLY both save 30; EARLY expires first
+	if want := []string{"FLAT50", "CAPPED", "EARLY", "TENPCT"}; !slices.Equal(codes, want) {
+		t.Errorf("applicable coupons = %v, want %v", codes, want)
+	}
+}
+
+func TestAssignedCoupon(t *testing.T) {
+	svc, repo := newTestService(t)
+	ctx := context.Background()
+	owner, other := uuid.New(), uuid.New()
+	createCoupon(t, repo, "WINBACK", func(c *models.Coupon) {
+		c.AssignedUserID = &owner
+	})
+
+	tests := []struct {
+		name           string
+		user           uuid.UUID
+		wantReason     string
+		wantApplicable bool
+	}{
+		{"owner", owner, "", true},
+		{"non-owner", other, ReasonNotYours, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := svc.ValidateCoupon(ctx, orderInput("WINBACK", tt.user, "300"))
+			if err != nil {
+				t.Fatalf("ValidateCoupon: %v", err)
+			}
+			if got.IsValid != (tt.wantReason == "") || got.Reason != tt.wantReason {
+				t.Errorf("ValidateCoupon() = valid %v reason %q, want reason %q", got.IsValid, got.Reason, tt.wantReason)
+			}
+
+			coupons, err := svc.GetApplicableCoupons(ctx, orderInput("", tt.user, "300"))
+			if err != nil {
+				t.Fatalf("GetApplicableCoupons: %v", err)
+			}
+			if listed := len(coupons) == 1; listed != tt.wantApplicable {
+				t.Errorf("listed as applicable = %v, want %v", listed, tt.wantApplicable)
+			}
+		})
+	}
+}
+
+func TestDailyUsageCap(t *testing.T) {
+	svc, repo := newTestService(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	tests := []struct {
+		name       string
+		usageAges  []time.Duration
+		wantReason string
+	}{
+		{"under the cap", []time.Duration{time.Hour}, ""},
+		{"at the cap within 24 hours", []time.Duration{23 * time.Hour, time.Hour}, ReasonDailyLimitExceeded},
+		{"older usage has left the window", []time.Duration{24*time.Hour + time.Minute, time.Hour}, ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := fmt.Sprintf("DAILY%d", i)
+			coupon := createCoupon(t, repo, code, func(c *models.Coupon) {
+				c.MaxUsagePerUserDay = 2
+			})
+			user := uuid.New()
+			for _, age := range tt.usageAges {
+				usage := &models.CouponUsage{ID: uuid.New(), CouponID: coupon.ID, UserID: user, OrderID: uuid.New(), UsedAt: now.Add(-age)}
+				if err := repo.RecordCouponUsage(ctx, usage, false); err != nil {
+					t.Fatalf("RecordCouponUsage: %v", err)
+				}
+			}
+
+			input := orderInput(code, user, "300")
+			input.Timestamp = now
+			got, err := svc.ValidateCoupon(ctx, input)
+			if err != nil {
+				t.Fatalf("ValidateCoupon: %v", err)
+			}
+			if got.Reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", got.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func newTestCache(t *testing.T) *cache.CouponCache {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { client.Close() })
+	return cache.NewCouponCache(client)
+}
+
+func TestPreviewServedFromCache(t *testing.T) {
+	// Without a repository any lookup would panic, so a result proves the
+	// preview never left the cache
+	couponCache := newTestCache(t)
+	svc := NewCouponService(nil, couponCache)
+	ctx := context.Background()
+
+	input := orderInput("save10", uuid.Nil, "300")
+	input.OrderID = uuid.Nil
+	couponCache.SetPreview(ctx, "SAVE10", previewSignature(input), &ValidateCouponOutput{IsValid: true, ItemsDiscount: amount("30")})
+
+	got, err := svc.PreviewCoupon(ctx, input)
+	if err != nil {
+		t.Fatalf("PreviewCoupon: %v", err)
+	}
+	if !got.IsValid || !got.ItemsDiscount.Equal(amount("30")) {
+		t.Errorf("PreviewCoupon() = valid %v discount %s, want the cached 30", got.IsValid, got.ItemsDiscount)
+	}
+}
+
+func TestPreviewCacheClearedOnUpdate(t *testing.T) {
+	repo := repository.NewCouponRepository(testdb.Open(t))
+	svc := NewCouponService(repo, newTestCache(t))
+	ctx := context.Background()
+	coupon := createCoupon(t, repo, "SAVE10")
+	input := orderInput("SAVE10", uuid.New(), "300")
+
+	preview := func() decimal.Decimal {
+		t.Helper()
+		got, err := svc.PreviewCoupon(ctx, input)
+		if err != nil {
+			t.Fatalf("PreviewCoupon: %v", err)
+		}
+		return got.ItemsDiscount
+	}
+	if got := preview(); !got.Equal(amount("30")) {
+		t.Fatalf("first preview discount = %s, want 30", got)
+	}
+
+	// A change the service does not see leaves the cached preview in place
+	edit := *coupon
+	edit.DiscountValue = amount("15")
+	if err := repo.Update(ctx, &edit, coupon.Version); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got := preview(); !got.Equal(amount("30")) {
+		t.Errorf("second preview discount = %s, want the cached 30", got)
+	}
+
+	update := CreateCouponInput{
+		Code:              "SAVE10",
+		ExpiryDate:        coupon.ExpiryDate,
+		UsageType:         models.MultiUse,
+		DiscountType:      models.PercentageDiscount,
+		DiscountValue:     amount("20"),
+		MaxUsagePerUser:   10,
+		RolloutPercentage: 100,
+	}
+	if _, err := svc.UpdateCoupon(ctx, coupon.ID, edit.Version, update); err != nil {
+		t.Fatalf("UpdateCoupon: %v", err)
+	}
+	if got := preview(); !got.Equal(amount("60")) {
+		t.Errorf("preview after update discount = %s, want 60", got)
+	}
+}
+
+func TestSuggestBetterCoupon(t *testing.T) {
+	tests := []struct {
+		name      string
+		current   string
+		exhausted bool
+		wantCode  string
+		wantSaves string
+	}{
+		{"better coupon exists", "PLAIN", false, "BIG", "60"},
+		{"already the best", "BIG", false, "", ""},
+		{"current code is invalid", "NOSUCH", false, "BIG", "60"},
+		{"better coupon used up by the user", "PLAIN", true, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, repo := newTestService(t)
+			ctx := context.Background()
+			user := uuid.New()
+			createCoupon(t, repo, "PLAIN")
+			createCoupon(t, repo, "BIG", func(c *models.Coupon) {
+				c.DiscountValue = amount("20")
+				c.MaxUsagePerUser = 1
+			})
+			if tt.exhausted {
+				if _, err := svc.RecordCouponUsage(ctx, orderInput("BIG", user, "300")); err != nil {
+					t.Fatalf("RecordCouponUsage: %v", err)
+				}
+			}
+
+			input := orderInput(tt.current, user, "300")
+			current, err := svc.ValidateCoupon(ctx, input)
+			if err != nil {
+				t.Fatalf("ValidateCoupon: %v", err)
+			}
+			got, err := svc.SuggestBetterCoupon(ctx, input, current)
+			if err != nil {
+				t.Fatalf("SuggestBetterCoupon: %v", err)
+			}
+
+			if tt.wantCode == "" {
+				if got != nil {
+					t.Errorf("SuggestBetterCoupon() = %+v, want no suggestion", got)
+				}
+				return
+			}
+			if got == nil || got.Code != tt.wantCode || !got.Savings.Equal(amount(tt.wantSaves)) {
+				t.Errorf("SuggestBetterCoupon() = %+v, want %s saving %s", got, tt.wantCode, tt.wantSaves)
+			}
+		})
+	}
+}
+
+func TestApplicableCouponsCountCharges(t *testing.T) {
+	svc, repo := newTestService(t)
+	ctx := context.Background()
+	createCoupon(t, repo, "WITHCHARGES", func(c *models.Coupon) {
+		c.MinOrderValue = amount("500")
+		c.MinOrderIncludesCharges = true
+	})
+
+	tests := []struct {
+		name     string
+		delivery string
+		want     int
+	}{
+		{"items alone fall short", "0", 0},
+		{"delivery and taxes reach the minimum", "40", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := orderInput("", uuid.New(), "460")
+			input.Order.DeliveryCharge = amount(tt.delivery)
+			input.Order.Taxes = amount("20")
+			coupons, err := svc.GetApplicableCoupons(ctx, input)
+			if err != nil {
+				t.Fatalf("GetApplicableCoupons: %v", err)
+			}
+			if len(coupons) != tt.want {
+				t.Errorf("got %d applicable coupons, want %d", len(coupons), tt.want)
+			}
+		})
+	}
+}
+
+func TestListUsageRejectsNonPositiveLimit(t *testing.T) {
+	// The limit is checked before the repository is touched
+	svc := NewCouponService(nil, nil)
+	for _, limit := range []int{0, -1} {
+		if _, _, err := svc.ListUsage(context.Background(), repository.UsageCursor{}, limit); !errors.Is(err, ErrInvalidLimit) {
+			t.Errorf("ListUsage(limit %d) error = %v, want ErrInvalidLimit", limit, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Package testdb connects integration tests to a scratch Postgres database.
+package testdb
+
+import (
+	"os"
+	"testing"
+
+	"coupon-system/internal/models"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Open connects to the database named by TEST_DATABASE_URL, migrates the
+// schema and empties every table, so each test starts from nothing. Tests
+// calling it are skipped when the variable is unset. The database is wiped,
+// so never point it at one holding real data.
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+		TranslateError: true,
+		Logger:         logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("connect to test database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("connect to test database: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	err = db.AutoMigrate(
+		&models.Coupon{},
+		&models.Medicine{},
+		&models.Category{},
+		&models.CouponUsage{},
+		&models.AuditLog{},
+	)
+	if err != nil {
+		t.Fatalf("migrate test database: %v", err)
+	}
+
+	err = db.Exec(`TRUNCATE coupons, medicines, categories, coupon_usages,
+		coupon_medicines, coupon_categories, audit_logs CASCADE`).Error
+	if err != nil {
+		t.Fatalf("empty test database: %v", err)
+	}
+	return db
+}